@@ -0,0 +1,96 @@
+package oak
+
+import(
+	`bytes`
+	js `encoding/json`
+)
+
+// Actions dispatches acts to handlers registered by name, the name is read from the act's
+// "type" value and the whole act is decoded into the handler's payload type.
+// Use its PerformAct method as Config.PerformAct.
+type Actions struct{
+	handlers map[string]PerformAct
+	fallback PerformAct
+	strict bool
+}
+
+// NewActions returns an empty registry, acts without a registered handler are passed to
+// fallback, or rejected as bad requests if it is nil.
+func NewActions(fallback PerformAct) *Actions {
+	return &Actions{
+		handlers: map[string]PerformAct{},
+		fallback: fallback,
+	}
+}
+
+// RegisterAction sets the handler for acts of type name, each act is decoded into a new P,
+// usually a struct, before handle is called. Acts which don't decode are rejected as bad requests.
+func RegisterAction[P any](actions *Actions, name string, handle func(payload P, userId string, e Entity) error) {
+	actions.handlers[name] = func(json Json, userId string, e Entity) error {
+		var payload P
+		decode := decodeJson
+		if actions.strict {
+			decode = decodeJsonStrict
+		}
+		if err := decode(json, &payload); err != nil {
+			return NewError(CodeBadRequest, `invalid ` + name + ` action: ` + err.Error())
+		}
+		return handle(payload, userId, e)
+	}
+}
+
+// DisallowUnknownFields makes registered actions reject acts with values their payload has no
+// field for, other than type, as encoding/json's Decoder.DisallowUnknownFields does.
+func (a *Actions) DisallowUnknownFields() *Actions {
+	a.strict = true
+	return a
+}
+
+// PerformAct runs the handler registered for the act's type.
+func (a *Actions) PerformAct(json Json, userId string, e Entity) error {
+	name, _ := json[_TYPE].(string)
+	if handler, exists := a.handlers[name]; exists {
+		return handler(json, userId, e)
+	}
+	if a.fallback != nil {
+		return a.fallback(json, userId, e)
+	}
+	if _, exists := json[_TYPE]; !exists {
+		return NewError(CodeBadRequest, _TYPE + ` value must be included in request`)
+	}
+	return NewError(CodeBadRequest, `unknown action "` + name + `"`)
+}
+
+// decodeJson converts json into the go value obj points to as encoding/json would.
+func decodeJson(json Json, obj interface{}) error {
+	data, err := js.Marshal(json)
+	if err != nil {
+		return err
+	}
+	return js.Unmarshal(data, obj)
+}
+
+// decodeJsonStrict is decodeJson erroring on values obj has no field for, the type value is
+// exempt as it is part of every act but need not be part of its payload.
+func decodeJsonStrict(json Json, obj interface{}) error {
+	rest := Json{}
+	for key, val := range json {
+		if key != _TYPE {
+			rest[key] = val
+		}
+	}
+	data, err := js.Marshal(rest)
+	if err != nil {
+		return err
+	}
+	decoder := js.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(obj); err != nil {
+		return err
+	}
+	if name, exists := json[_TYPE]; exists {
+		//set the payload's type field if it has one
+		return decodeJson(Json{_TYPE: name}, obj)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package oak
+
+import(
+	`errors`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+type testMove struct{
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+func Test_actions_dispatch_by_type(t *testing.T) {
+	actions := NewActions(nil)
+	var moves []testMove
+	RegisterAction(actions, `move`, func(move testMove, userId string, e Entity) error {
+		moves = append(moves, move)
+		return nil
+	})
+	RegisterAction(actions, `resign`, func(payload struct{}, userId string, e Entity) error {
+		return errors.New(`test_resign_error`)
+	})
+
+	assert.Nil(t, actions.PerformAct(Json{_TYPE: `move`, `x`: 1.0, `y`: 2.0}, `test_user_id`, &testEntity{}), `move should not error`)
+	assert.Equal(t, []testMove{{1, 2}}, moves, `move payload should have been decoded`)
+	assert.Equal(t, `test_resign_error`, actions.PerformAct(Json{_TYPE: `resign`}, `test_user_id`, &testEntity{}).Error(), `handler error should be returned`)
+}
+
+func Test_actions_with_invalid_acts(t *testing.T) {
+	actions := NewActions(nil)
+	RegisterAction(actions, `move`, func(move testMove, userId string, e Entity) error {
+		return nil
+	})
+
+	err := actions.PerformAct(Json{_TYPE: `fly`}, `test_user_id`, &testEntity{})
+	assert.Equal(t, NewError(CodeBadRequest, `unknown action "fly"`), err, `unknown actions should be bad requests`)
+
+	err = actions.PerformAct(Json{}, `test_user_id`, &testEntity{})
+	assert.Equal(t, NewError(CodeBadRequest, _TYPE + ` value must be included in request`), err, `acts without a type should be bad requests`)
+
+	err = actions.PerformAct(Json{_TYPE: `move`, `x`: `left`}, `test_user_id`, &testEntity{})
+	assert.Equal(t, CodeBadRequest, AsError(err).Code, `undecodable payloads should be bad requests`)
+}
+
+func Test_actions_disallowing_unknown_fields(t *testing.T) {
+	actions := NewActions(nil).DisallowUnknownFields()
+	var moves []testMove
+	RegisterAction(actions, `move`, func(move testMove, userId string, e Entity) error {
+		moves = append(moves, move)
+		return nil
+	})
+	var types []string
+	RegisterAction(actions, `named`, func(payload struct{Type string `json:"type"`}, userId string, e Entity) error {
+		types = append(types, payload.Type)
+		return nil
+	})
+
+	assert.Nil(t, actions.PerformAct(Json{_TYPE: `move`, `x`: 1.0}, `test_user_id`, &testEntity{}), `known fields should not error`)
+	assert.Nil(t, actions.PerformAct(Json{_TYPE: `named`}, `test_user_id`, &testEntity{}), `type field should not error`)
+	err := actions.PerformAct(Json{_TYPE: `move`, `x`: 1.0, `z`: 3.0}, `test_user_id`, &testEntity{})
+	assert.Equal(t, NewError(CodeBadRequest, `invalid move action: json: unknown field "z"`), err, `unknown fields should be bad requests`)
+	assert.Equal(t, []testMove{{1, 0}}, moves, `only the valid move should have been handled`)
+	assert.Equal(t, []string{`named`}, types, `type should still be decoded into payloads with a type field`)
+}
+
+func Test_actions_with_fallback(t *testing.T) {
+	var fellBack []Json
+	actions := NewActions(func(json Json, userId string, e Entity) error {
+		fellBack = append(fellBack, json)
+		return nil
+	})
+
+	assert.Nil(t, actions.PerformAct(Json{_TYPE: `legacy`}, `test_user_id`, &testEntity{}), `fallback should not error`)
+	assert.Nil(t, actions.PerformAct(Json{}, `test_user_id`, &testEntity{}), `fallback should not error`)
+	assert.Equal(t, []Json{{_TYPE: `legacy`}, {}}, fellBack, `unregistered acts should be passed to the fallback`)
+}
+
+func Test_act_with_unknown_action(t *testing.T) {
+	actions := NewActions(nil)
+	w, r := setup(nil, nil, actions.PerformAct, _ACT, `{"`+_TYPE+`":"fly"}`)
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeBadRequest, `unknown action "fly"`)
+	assert.Equal(t, 400, w.Code, `response code should be 400`)
+}
@@ -0,0 +1,313 @@
+package oak
+
+import(
+	`fmt`
+	`math`
+	`encoding/binary`
+	js `encoding/json`
+)
+
+const (
+	_CBOR_UINT		= 0
+	_CBOR_NEGINT	= 1
+	_CBOR_BYTES		= 2
+	_CBOR_TEXT		= 3
+	_CBOR_ARRAY		= 4
+	_CBOR_MAP		= 5
+	_CBOR_TAG		= 6
+	_CBOR_SIMPLE	= 7
+
+	_CBOR_INDEFINITE	= 31
+	_CBOR_BREAK			= 0xff
+)
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string {
+	return _CBOR_CONTENT_TYPE
+}
+
+func (cborCodec) Marshal(obj interface{}) ([]byte, error) {
+	val, err := toGeneric(obj)
+	if err != nil {
+		return nil, err
+	}
+	return appendCbor(nil, val)
+}
+
+func (cborCodec) Unmarshal(data []byte, obj interface{}) error {
+	d := &binaryReader{data: data}
+	val, err := decodeCbor(d)
+	if err == nil {
+		err = d.end()
+	}
+	if err != nil {
+		return fmt.Errorf(`invalid cbor: %w`, err)
+	}
+	return fromGeneric(val, obj)
+}
+
+func appendCbor(buf []byte, val interface{}) ([]byte, error) {
+	var err error
+	switch v := val.(type) {
+	case nil:
+		buf = append(buf, 0xf6)
+	case bool:
+		if v {
+			buf = append(buf, 0xf5)
+		} else {
+			buf = append(buf, 0xf4)
+		}
+	case string:
+		buf = append(appendCborHead(buf, _CBOR_TEXT, uint64(len(v))), v...)
+	case js.Number:
+		i, u, f, kind, err := numberKind(v)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case kind == 'u':
+			buf = appendCborHead(buf, _CBOR_UINT, u)
+		case kind == 'i' && i >= 0:
+			buf = appendCborHead(buf, _CBOR_UINT, uint64(i))
+		case kind == 'i':
+			buf = appendCborHead(buf, _CBOR_NEGINT, uint64(-1 - i))
+		default:
+			buf = binary.BigEndian.AppendUint64(append(buf, 0xfb), math.Float64bits(f))
+		}
+	case []interface{}:
+		buf = appendCborHead(buf, _CBOR_ARRAY, uint64(len(v)))
+		for _, item := range v {
+			if buf, err = appendCbor(buf, item); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		buf = appendCborHead(buf, _CBOR_MAP, uint64(len(v)))
+		for _, key := range sortedKeys(v) {
+			buf = append(appendCborHead(buf, _CBOR_TEXT, uint64(len(key))), key...)
+			if buf, err = appendCbor(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf(`cbor can't encode %T`, val)
+	}
+	return buf, nil
+}
+
+// appendCborHead appends the initial byte of an item of the major type with its argument n in the fewest bytes.
+func appendCborHead(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major | byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major | 24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major | 25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major | 26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, major | 27), n)
+}
+
+// readCborHead reads an item's initial byte and argument, indefinite is set for the indefinite length marker.
+func readCborHead(d *binaryReader) (major byte, info byte, n uint64, indefinite bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return
+	}
+	major, info = b >> 5, b & 0x1f
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		n, err = d.readUint(1 << (info - 24))
+	case info == _CBOR_INDEFINITE:
+		indefinite = true
+	default:
+		err = fmt.Errorf(`reserved additional info %d`, info)
+	}
+	return
+}
+
+func decodeCbor(d *binaryReader) (interface{}, error) {
+	major, info, n, indefinite, err := readCborHead(d)
+	if err != nil {
+		return nil, err
+	}
+	if indefinite && (major < _CBOR_BYTES || major > _CBOR_MAP) {
+		if major == _CBOR_SIMPLE {
+			return nil, fmt.Errorf(`unexpected break`)
+		}
+		return nil, fmt.Errorf(`indefinite length major type %d`, major)
+	}
+	switch major {
+	case _CBOR_UINT:
+		return float64(n), nil
+	case _CBOR_NEGINT:
+		return -1 - float64(n), nil
+	case _CBOR_BYTES, _CBOR_TEXT:
+		var bs []byte
+		if bs, err = decodeCborString(d, major, n, indefinite); err != nil {
+			return nil, err
+		}
+		if major == _CBOR_TEXT {
+			return string(bs), nil
+		}
+		return bs, nil
+	case _CBOR_ARRAY:
+		return decodeCborArray(d, n, indefinite)
+	case _CBOR_MAP:
+		return decodeCborMap(d, n, indefinite)
+	case _CBOR_TAG:
+		//tags only add meaning to the item they enclose which is decoded as it is
+		if err = d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+		return decodeCbor(d)
+	}
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return finite(float16(uint16(n)))
+	case 26:
+		return finite(float64(math.Float32frombits(uint32(n))))
+	case 27:
+		return finite(math.Float64frombits(n))
+	}
+	return nil, fmt.Errorf(`unsupported simple value %d`, n)
+}
+
+// decodeCborString reads a byte or text string, an indefinite length string is the concatenation
+// of the definite length chunks of the same major type up to the break.
+func decodeCborString(d *binaryReader, major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		bs, err := d.next(n)
+		return append([]byte{}, bs...), err
+	}
+	bs := []byte{}
+	for {
+		if d.remaining() > 0 && d.data[d.pos] == _CBOR_BREAK {
+			d.pos++
+			return bs, nil
+		}
+		chunkMajor, _, n, chunkIndefinite, err := readCborHead(d)
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkIndefinite {
+			return nil, fmt.Errorf(`invalid chunk in indefinite length string`)
+		}
+		chunk, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		bs = append(bs, chunk...)
+	}
+}
+
+// atBreak reports whether an indefinite length item has ended, consuming the break if so.
+func atBreak(d *binaryReader, indefinite bool, i uint64, n uint64) (bool, error) {
+	if !indefinite {
+		return i >= n, nil
+	}
+	if d.remaining() == 0 {
+		return false, errTruncated
+	}
+	if d.data[d.pos] == _CBOR_BREAK {
+		d.pos++
+		return true, nil
+	}
+	return false, nil
+}
+
+func decodeCborArray(d *binaryReader, n uint64, indefinite bool) (interface{}, error) {
+	if indefinite {
+		n = 0
+	} else if err := d.checkLen(n, 1); err != nil {
+		return nil, err
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	arr := make([]interface{}, 0, n)
+	for i := uint64(0); ; i++ {
+		done, err := atBreak(d, indefinite, i, n)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return arr, nil
+		}
+		item, err := decodeCbor(d)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, item)
+	}
+}
+
+func decodeCborMap(d *binaryReader, n uint64, indefinite bool) (interface{}, error) {
+	if indefinite {
+		n = 0
+	} else if err := d.checkLen(n, 2); err != nil {
+		return nil, err
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); ; i++ {
+		done, err := atBreak(d, indefinite, i, n)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return m, nil
+		}
+		key, err := decodeCbor(d)
+		if err != nil {
+			return nil, err
+		}
+		str, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf(`map key %v is not a string`, key)
+		}
+		if m[str], err = decodeCbor(d); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// float16 converts an IEEE 754 half precision float.
+func float16(bits uint16) float64 {
+	exp := int(bits >> 10) & 0x1f
+	mant := float64(bits & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant + 1024, exp - 25)
+	}
+	if bits & 0x8000 != 0 {
+		return -f
+	}
+	return f
+}
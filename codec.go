@@ -0,0 +1,312 @@
+package oak
+
+import(
+	`fmt`
+	`math`
+	`sort`
+	`mime`
+	`bytes`
+	`errors`
+	`strconv`
+	`strings`
+	`context`
+	`net/http`
+	`encoding/binary`
+	js `encoding/json`
+	gcontext `github.com/gorilla/context`
+)
+
+const (
+	_CONTENT_TYPE	= `Content-Type`
+	_ACCEPT			= `Accept`
+	_VARY			= `Vary`
+
+	_JSON_CONTENT_TYPE		= `application/json`
+	_MSGPACK_CONTENT_TYPE	= `application/msgpack`
+	_CBOR_CONTENT_TYPE		= `application/cbor`
+
+	_MAX_DECODE_DEPTH = 10000
+)
+
+// Codec encodes and decodes request and response bodies of one content type. Bodies are
+// decoded to the same values encoding/json gives, Json objects, []interface{} arrays, float64
+// numbers, strings, bools and nils, so PerformAct code is the same whichever codec a client uses.
+type Codec interface{
+	ContentType() string
+	Marshal(obj interface{}) ([]byte, error)
+	Unmarshal(data []byte, obj interface{}) error
+}
+
+var (
+	// JsonCodec is the default codec, used when a request has no or an unknown Content-Type.
+	JsonCodec Codec = jsonCodec{}
+	// MessagePackCodec encodes bodies as MessagePack, application/msgpack.
+	MessagePackCodec Codec = msgpackCodec{}
+	// CborCodec encodes bodies as CBOR (RFC 8949), application/cbor.
+	CborCodec Codec = cborCodec{}
+)
+
+func defaultCodecs() map[string]Codec {
+	return map[string]Codec{
+		_JSON_CONTENT_TYPE: JsonCodec,
+		_MSGPACK_CONTENT_TYPE: MessagePackCodec,
+		`application/x-msgpack`: MessagePackCodec,
+		_CBOR_CONTENT_TYPE: CborCodec,
+	}
+}
+
+// Codecs adds codecs for request and response bodies, replacing any codec of the same content type.
+// Request bodies are decoded by the codec of their Content-Type and responses encoded by the codec
+// the Accept header most prefers, falling back to the request's codec. JSON, MessagePack and CBOR
+// are always available, server sent events and websocket messages are always JSON.
+func Codecs(codecs ...Codec) Option {
+	return func(o *options) {
+		for _, codec := range codecs {
+			o.codecs[codec.ContentType()] = codec
+		}
+	}
+}
+
+// requestCodec picks the codec of the request's Content-Type, anything else is treated as JSON
+// as oak did before codecs were negotiated.
+func (o *options) requestCodec(r *http.Request) Codec {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get(_CONTENT_TYPE)); err == nil {
+		if codec, exists := o.codecs[mediaType]; exists {
+			return codec
+		}
+	}
+	return o.codecs[_JSON_CONTENT_TYPE]
+}
+
+// responseCodec picks the codec of the type with the highest q value in the Accept header,
+// wildcards, no Accept header and no supported type all give the request's codec.
+func (o *options) responseCodec(r *http.Request, reqCodec Codec) Codec {
+	best, bestQ := reqCodec, 0.0
+	for _, accepted := range strings.Split(r.Header.Get(_ACCEPT), `,`) {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qParam, exists := params[`q`]; exists {
+			if q, err = strconv.ParseFloat(qParam, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		if codec, exists := o.codecs[mediaType]; exists {
+			best, bestQ = codec, q
+		} else if mediaType == `*/*` || mediaType == `application/*` {
+			best, bestQ = reqCodec, q
+		}
+	}
+	return best
+}
+
+type codecsKey struct{}
+
+type negotiatedCodecs struct{
+	req Codec
+	resp Codec
+}
+
+// negotiate picks the request's codecs before any middleware runs so readJson, writeJson
+// and writeError all use them.
+func (srv *Server) negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCodec := srv.opts.requestCodec(r)
+		respCodec := srv.opts.responseCodec(r, reqCodec)
+		_, negotiated := r.Context().Value(codecsKey{}).(negotiatedCodecs)
+		if reqCodec == JsonCodec && respCodec == JsonCodec && !negotiated {
+			//the common case needs no copy of the request
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), codecsKey{}, negotiatedCodecs{reqCodec, respCodec}))
+		//sessions are registered against the request so the copy's must be cleared too
+		defer gcontext.Clear(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestCodec(r *http.Request) Codec {
+	if codecs, ok := r.Context().Value(codecsKey{}).(negotiatedCodecs); ok {
+		return codecs.req
+	}
+	return JsonCodec
+}
+
+func responseCodec(r *http.Request) Codec {
+	if codecs, ok := r.Context().Value(codecsKey{}).(negotiatedCodecs); ok {
+		return codecs.resp
+	}
+	return JsonCodec
+}
+
+func setContentType(w http.ResponseWriter, codec Codec) {
+	w.Header().Set(_CONTENT_TYPE, codec.ContentType())
+	w.Header().Set(_VARY, _ACCEPT + `, ` + _CONTENT_TYPE)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return _JSON_CONTENT_TYPE
+}
+
+func (jsonCodec) Marshal(obj interface{}) ([]byte, error) {
+	return js.Marshal(obj)
+}
+
+func (jsonCodec) Unmarshal(data []byte, obj interface{}) error {
+	return js.Unmarshal(data, obj)
+}
+
+/**
+ * binary codec helpers
+ *
+ * the binary codecs encode the value tree encoding/json would produce, so json tags and
+ * Marshalers are respected, and decode to the value tree encoding/json would decode.
+ */
+
+// toGeneric gives the value tree of obj's json encoding, numbers are kept as js.Number so
+// integers can be encoded as such.
+func toGeneric(obj interface{}) (interface{}, error) {
+	data, err := js.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	decoder := js.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var val interface{}
+	err = decoder.Decode(&val)
+	return val, err
+}
+
+// fromGeneric stores a decoded value tree in obj, a *Json or *interface{} is set directly
+// anything else goes through encoding/json.
+func fromGeneric(val interface{}, obj interface{}) error {
+	switch ptr := obj.(type) {
+	case *Json:
+		if m, ok := val.(map[string]interface{}); ok {
+			*ptr = Json(m)
+			return nil
+		}
+		if val == nil {
+			*ptr = nil
+			return nil
+		}
+	case *interface{}:
+		*ptr = val
+		return nil
+	}
+	data, err := js.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return js.Unmarshal(data, obj)
+}
+
+// numberKind splits a json number into the int, uint or float it is best encoded as.
+func numberKind(n js.Number) (i int64, u uint64, f float64, kind byte, err error) {
+	if i, err = n.Int64(); err == nil {
+		return i, 0, 0, 'i', nil
+	}
+	if u, err = strconv.ParseUint(string(n), 10, 64); err == nil {
+		return 0, u, 0, 'u', nil
+	}
+	f, err = n.Float64()
+	return 0, 0, f, 'f', err
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var errTruncated = errors.New(`unexpected end of data`)
+
+// binaryReader reads the big endian values both binary codecs are made of.
+type binaryReader struct{
+	data []byte
+	pos int
+	depth int
+}
+
+func (b *binaryReader) remaining() int {
+	return len(b.data) - b.pos
+}
+
+func (b *binaryReader) next(n uint64) ([]byte, error) {
+	if n > uint64(b.remaining()) {
+		return nil, errTruncated
+	}
+	bs := b.data[b.pos:b.pos+int(n)]
+	b.pos += int(n)
+	return bs, nil
+}
+
+func (b *binaryReader) readByte() (byte, error) {
+	bs, err := b.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return bs[0], nil
+}
+
+// readUint reads an unsigned integer of size bytes.
+func (b *binaryReader) readUint(size int) (uint64, error) {
+	bs, err := b.next(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(bs[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(bs)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(bs)), nil
+	}
+	return binary.BigEndian.Uint64(bs), nil
+}
+
+// checkLen guards allocations against lengths the remaining data can't hold, each item is at least minSize bytes.
+func (b *binaryReader) checkLen(n uint64, minSize uint64) error {
+	if n > uint64(b.remaining()) / minSize {
+		return errTruncated
+	}
+	return nil
+}
+
+func (b *binaryReader) enter() error {
+	if b.depth++; b.depth > _MAX_DECODE_DEPTH {
+		return errors.New(`exceeded max depth`)
+	}
+	return nil
+}
+
+func (b *binaryReader) leave() {
+	b.depth--
+}
+
+func (b *binaryReader) end() error {
+	if b.remaining() > 0 {
+		return fmt.Errorf(`%d bytes after top level value`, b.remaining())
+	}
+	return nil
+}
+
+// finite rejects the numbers json has no encoding for.
+func finite(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New(`unsupported number ` + strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return f, nil
+}
@@ -0,0 +1,194 @@
+package oak
+
+import(
+	`bytes`
+	`strings`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_binary_codecs_round_trip(t *testing.T) {
+	obj := Json{
+		`str`: `test_str`,
+		`long`: strings.Repeat(`a`, 70000),
+		`int`: 7,
+		`neg`: -1000,
+		`big`: uint64(1) << 63,
+		`float`: 1.5,
+		`bool`: true,
+		`nil`: nil,
+		`arr`: []interface{}{1, `two`, []int{3}},
+		`obj`: struct{
+			Field string `json:"field"`
+			Omitted string `json:"-"`
+		}{`test_field`, `test_omitted`},
+	}
+	expected := Json{}
+	decodeJson(obj, &expected)
+
+	for _, codec := range []Codec{MessagePackCodec, CborCodec} {
+		data, err := codec.Marshal(obj)
+		assert.Nil(t, err, codec.ContentType() + ` marshal should not error`)
+		decoded := Json{}
+		assert.Nil(t, codec.Unmarshal(data, &decoded), codec.ContentType() + ` unmarshal should not error`)
+		assert.Equal(t, expected, decoded, codec.ContentType() + ` should decode to the json values`)
+	}
+}
+
+func Test_msgpack_encoding(t *testing.T) {
+	for expected, obj := range map[string]interface{}{
+		"\x81\xa1a\x01": Json{`a`: 1},
+		"\x92\xff\xd0\x80": []int{-1, -128},
+		"\xcd\x01\x00": 256,
+		"\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00": 1.5,
+		"\xc0": nil,
+	} {
+		data, _ := MessagePackCodec.Marshal(obj)
+		assert.Equal(t, expected, string(data), `msgpack should use the smallest encoding`)
+	}
+}
+
+func Test_msgpack_decoding(t *testing.T) {
+	for data, expected := range map[string]interface{}{
+		"\xd1\xff\x00": float64(-256),
+		"\xca\x3f\xc0\x00\x00": 1.5,
+		"\xc4\x02ab": []byte(`ab`),
+		"\xdc\x00\x01\xc3": []interface{}{true},
+		"\xde\x00\x01\xd9\x01a\xc2": map[string]interface{}{`a`: false},
+	} {
+		var val interface{}
+		assert.Nil(t, MessagePackCodec.Unmarshal([]byte(data), &val), `msgpack should decode`)
+		assert.Equal(t, expected, val, `msgpack should decode to the json values`)
+	}
+}
+
+func Test_cbor_encoding(t *testing.T) {
+	for expected, obj := range map[string]interface{}{
+		"\xa1\x61a\x01": Json{`a`: 1},
+		"\x82\x20\x38\x63": []int{-1, -100},
+		"\x19\x01\x00": 256,
+		"\xfb\x3f\xf8\x00\x00\x00\x00\x00\x00": 1.5,
+		"\xf6": nil,
+	} {
+		data, _ := CborCodec.Marshal(obj)
+		assert.Equal(t, expected, string(data), `cbor should use the smallest encoding`)
+	}
+}
+
+func Test_cbor_decoding(t *testing.T) {
+	for data, expected := range map[string]interface{}{
+		"\xf9\x3c\x00": float64(1),
+		"\xf9\xc4\x00": float64(-4),
+		"\xfa\x3f\xc0\x00\x00": 1.5,
+		"\x9f\x01\x82\x02\x03\xff": []interface{}{float64(1), []interface{}{float64(2), float64(3)}},
+		"\xbf\x61a\xf5\xff": map[string]interface{}{`a`: true},
+		"\x7f\x62ab\x61c\xff": `abc`,
+		"\xc1\x1a\x51\x4b\x67\xb0": float64(1363896240),
+		"\xf7": nil,
+	} {
+		var val interface{}
+		assert.Nil(t, CborCodec.Unmarshal([]byte(data), &val), `cbor should decode`)
+		assert.Equal(t, expected, val, `cbor should decode to the json values`)
+	}
+}
+
+func Test_binary_codecs_with_invalid_data(t *testing.T) {
+	for _, data := range []string{``, "\xa2a", "\x81\x01\x01", "\xc1", "\xd4\x01\x01", "\x01\x01", "\xcb\x7f\xf8\x00\x00\x00\x00\x00\x00", "\xdd\xff\xff\xff\xff"} {
+		assert.NotNil(t, MessagePackCodec.Unmarshal([]byte(data), &Json{}), `invalid msgpack should error`)
+	}
+	for _, data := range []string{``, "\x62a", "\xa1\x01\x01", "\xff", "\x1c", "\x5f\x61a\xff", "\x01\x01", "\xf9\x7e\x00", "\x9b\xff\xff\xff\xff\xff\xff\xff\xff"} {
+		assert.NotNil(t, CborCodec.Unmarshal([]byte(data), &Json{}), `invalid cbor should error`)
+	}
+	deep := strings.Repeat("\x91", _MAX_DECODE_DEPTH + 1) + "\xc0"
+	assert.NotNil(t, MessagePackCodec.Unmarshal([]byte(deep), &Json{}), `too deep msgpack should error`)
+}
+
+func Test_response_codec_negotiation(t *testing.T) {
+	o := newOptions(nil)
+	for accept, expected := range map[string]Codec{
+		``: MessagePackCodec,
+		`application/json`: JsonCodec,
+		`application/cbor;q=0.5, application/json;q=0.9`: JsonCodec,
+		`text/html, */*;q=0.8`: MessagePackCodec,
+		`application/x-msgpack`: MessagePackCodec,
+		`text/plain`: MessagePackCodec,
+		`application/cbor;q=oops, application/cbor;q=0.1`: CborCodec,
+	} {
+		r, _ := http.NewRequest(`POST`, _ACT, nil)
+		r.Header.Set(`Content-Type`, `application/msgpack; charset=binary`)
+		r.Header.Set(`Accept`, accept)
+		assert.Equal(t, MessagePackCodec, o.requestCodec(r), `request codec should follow the content type`)
+		assert.Equal(t, expected, o.responseCodec(r, o.requestCodec(r)), `response codec should follow the accept header ` + accept)
+	}
+
+	r, _ := http.NewRequest(`POST`, _ACT, nil)
+	r.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	assert.Equal(t, JsonCodec, o.requestCodec(r), `unknown content types should be read as json`)
+}
+
+func Test_act_with_msgpack(t *testing.T) {
+	var actJson Json
+	_, r := setup(nil, func(userId string, entity Entity)Json{return Json{`test`: []int{1, 2}}}, func(json Json, userId string, e Entity)error{
+		actJson = json
+		return nil
+	}, _ACT, ``)
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	body, _ := MessagePackCodec.Marshal(Json{`move`: 3, `to`: `test_to`})
+	w := serveTestCodecRequest(_ACT, body, `application/msgpack`, ``)
+
+	resp := Json{}
+	assert.Equal(t, 200, w.Code, `response code should be 200`)
+	assert.Equal(t, `application/msgpack`, w.Header().Get(`Content-Type`), `response should be msgpack`)
+	assert.Nil(t, MessagePackCodec.Unmarshal(w.Body.Bytes(), &resp), `response should decode`)
+	assert.Equal(t, Json{`test`: []interface{}{float64(1), float64(2)}, _VERSION: float64(0)}, resp, `response should have the change response`)
+	assert.Equal(t, Json{`move`: float64(3), `to`: `test_to`}, actJson, `act should get the same values as from json`)
+	assert.Equal(t, `test_pre_set_user_id`, testSessionValue(_USER_ID), `session should still be set`)
+}
+
+func Test_join_with_cbor_error(t *testing.T) {
+	setup(nil, nil, nil, _JOIN, ``)
+
+	body, _ := CborCodec.Marshal(Json{_ID: 1})
+	w := serveTestCodecRequest(_JOIN, body, `application/cbor`, `application/cbor`)
+
+	e := &Error{}
+	assert.Equal(t, 400, w.Code, `response code should be 400`)
+	assert.Equal(t, `application/cbor`, w.Header().Get(`Content-Type`), `error should be cbor`)
+	assert.Nil(t, CborCodec.Unmarshal(w.Body.Bytes(), e), `error should decode`)
+	assert.Equal(t, &Error{Code: CodeBadRequest, Message: _ID + ` must be a string value`}, e, `error should be in the body`)
+}
+
+func Test_create_with_accept_header_only(t *testing.T) {
+	setup(nil, nil, nil, _CREATE, ``)
+	tes.entityId = `test_entity_id`
+
+	w := serveTestCodecRequest(_CREATE, nil, ``, `application/msgpack`)
+
+	resp := Json{}
+	assert.Equal(t, `application/msgpack`, w.Header().Get(`Content-Type`), `response should be msgpack`)
+	MessagePackCodec.Unmarshal(w.Body.Bytes(), &resp)
+	assert.Equal(t, `test_entity_id`, resp[_ID], `response should have the entity id`)
+}
+
+/**
+ * helpers
+ */
+
+func serveTestCodecRequest(path string, body []byte, contentType string, accept string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`POST`, path, bytes.NewReader(body))
+	if contentType != `` {
+		r.Header.Set(`Content-Type`, contentType)
+	}
+	if accept != `` {
+		r.Header.Set(`Accept`, accept)
+	}
+	tr.ServeHTTP(w, r)
+	return w
+}
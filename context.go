@@ -0,0 +1,43 @@
+package oak
+
+import(
+	`context`
+)
+
+// ContextEntityStore is an EntityStore whose operations take the request's context so
+// cancellation, deadlines and request scoped values reach the underlying storage.
+// Stores returned by an EntityStoreFactory which also implement ContextEntityStore are
+// always called through it.
+type ContextEntityStore interface{
+	CreateContext(ctx context.Context) (entityId string, entity Entity, err error)
+	ReadContext(ctx context.Context, entityId string) (entity Entity, err error)
+	UpdateContext(ctx context.Context, entityId string, entity Entity) (err error)
+}
+
+type ContextGetJoinResp func(ctx context.Context, userId string, e Entity) Json
+type ContextGetEntityChangeResp func(ctx context.Context, userId string, e Entity) Json
+type ContextPerformAct func(ctx context.Context, json Json, userId string, e Entity) (err error)
+
+// AdaptEntityStore returns store as a ContextEntityStore, stores which don't implement it ignore the context.
+func AdaptEntityStore(store EntityStore) ContextEntityStore {
+	if ctxStore, ok := store.(ContextEntityStore); ok {
+		return ctxStore
+	}
+	return &contextAdapter{store}
+}
+
+type contextAdapter struct{
+	store EntityStore
+}
+
+func (ca *contextAdapter) CreateContext(ctx context.Context) (string, Entity, error) {
+	return ca.store.Create()
+}
+
+func (ca *contextAdapter) ReadContext(ctx context.Context, entityId string) (Entity, error) {
+	return ca.store.Read(entityId)
+}
+
+func (ca *contextAdapter) UpdateContext(ctx context.Context, entityId string, entity Entity) error {
+	return ca.store.Update(entityId, entity)
+}
@@ -0,0 +1,108 @@
+package oak
+
+import(
+	`context`
+	`testing`
+	`net/http`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+type testContextKey struct{}
+
+func Test_server_prefers_context_store_and_callbacks(t *testing.T) {
+	store := &testContextEntityStore{MemoryEntityStore: NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})}
+	var callbackValues []interface{}
+	tss = &testSessionStore{}
+	tr = mux.NewRouter()
+	NewServer(Config{
+		SessionStore: tss,
+		SessionName: `test_session`,
+		Entity: &storeTestEntity{},
+		EntityStoreFactory: func(r *http.Request)EntityStore{return store},
+		GetJoinResp: func(userId string, e Entity)Json{
+			t.Error(`plain GetJoinResp should not be called`)
+			return Json{}
+		},
+		GetJoinRespContext: func(ctx context.Context, userId string, e Entity)Json{
+			callbackValues = append(callbackValues, ctx.Value(testContextKey{}))
+			return Json{}
+		},
+		GetEntityChangeRespContext: func(ctx context.Context, userId string, e Entity)Json{
+			callbackValues = append(callbackValues, ctx.Value(testContextKey{}))
+			return Json{}
+		},
+		PerformActContext: func(ctx context.Context, json Json, userId string, e Entity)error{
+			callbackValues = append(callbackValues, ctx.Value(testContextKey{}))
+			e.(*storeTestEntity).Version++
+			return nil
+		},
+	}, Wrap(func(op Op, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), testContextKey{}, `test_value`)))
+		})
+	})).Route(tr)
+
+	serveTestRequest(`POST`, _CREATE, ``)
+	entityId := testSessionValue(_ENTITY_ID).(string)
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	serveTestRequest(`POST`, _ACT, `{}`)
+
+	assert.Equal(t, []interface{}{`test_value`, `test_value`, `test_value`}, callbackValues, `context callbacks should receive the request context`)
+	assert.NotEmpty(t, store.values, `context store should have been used`)
+	for _, value := range store.values {
+		assert.Equal(t, `test_value`, value, `context store should receive the request context`)
+	}
+}
+
+func Test_adapt_entity_store(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	adapted := AdaptEntityStore(store)
+	ctx := context.Background()
+
+	entityId, _, err := adapted.CreateContext(ctx)
+	assert.Nil(t, err, `create should not error`)
+	assert.Nil(t, adapted.UpdateContext(ctx, entityId, &storeTestEntity{Version: 1}), `update should not error`)
+	entity, _ := adapted.ReadContext(ctx, entityId)
+	assert.Equal(t, 1, entity.GetVersion(), `adapter should pass through to the store`)
+
+	contextStore := &testContextEntityStore{MemoryEntityStore: store}
+	assert.True(t, contextStore == AdaptEntityStore(contextStore), `context stores should not be adapted`)
+}
+
+func Test_sql_store_with_cancelled_context(t *testing.T) {
+	db, _ := openFakeSql(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := store.CreateContext(ctx)
+	assert.Equal(t, context.Canceled, err, `create should return the context error`)
+	_, err = store.ReadContext(ctx, `test_entity_id`)
+	assert.Equal(t, context.Canceled, err, `read should return the context error`)
+	assert.Equal(t, context.Canceled, store.UpdateContext(ctx, `test_entity_id`, &storeTestEntity{Version: 1}), `update should return the context error`)
+}
+
+/**
+ * helpers
+ */
+
+type testContextEntityStore struct{
+	*MemoryEntityStore
+	values []interface{}
+}
+
+func (s *testContextEntityStore) CreateContext(ctx context.Context) (string, Entity, error) {
+	s.values = append(s.values, ctx.Value(testContextKey{}))
+	return s.Create()
+}
+
+func (s *testContextEntityStore) ReadContext(ctx context.Context, entityId string) (Entity, error) {
+	s.values = append(s.values, ctx.Value(testContextKey{}))
+	return s.Read(entityId)
+}
+
+func (s *testContextEntityStore) UpdateContext(ctx context.Context, entityId string, entity Entity) error {
+	s.values = append(s.values, ctx.Value(testContextKey{}))
+	return s.Update(entityId, entity)
+}
@@ -0,0 +1,162 @@
+package oak
+
+import(
+	`sort`
+	`sync`
+	`strconv`
+	`strings`
+	`reflect`
+	`container/list`
+)
+
+// Deltas lets polls ask for a JSON Patch (RFC 6902) from the change response of the version they
+// send instead of the full response, by including "delta": true. The last versions change
+// responses sent to each user of an entity, a view, are kept for up to views views, least recently
+// used first out. When the base version is not kept the full response is sent, patch responses
+// are {"v": version, "patch": [...]} and never include the version in the patch.
+func Deltas(views int, versions int) Option {
+	return func(o *options) {
+		o.deltaViews = views
+		o.deltaVersions = versions
+	}
+}
+
+// viewCache is an lru cache of the recent change responses sent to each user of each entity.
+type viewCache struct{
+	mtx sync.Mutex
+	maxViews int
+	maxVersions int
+	views map[string]*list.Element
+	order *list.List
+}
+
+type view struct{
+	key string
+	versions []int
+	snapshots map[int]Json
+}
+
+func newViewCache(maxViews int, maxVersions int) *viewCache {
+	return &viewCache{
+		maxViews: maxViews,
+		maxVersions: maxVersions,
+		views: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+// delta records resp as the user's view of version and, if wanted and the view of base
+// is still cached, returns the patch from it instead of resp.
+func (vc *viewCache) delta(entityId string, userId string, base int, version int, resp Json, wanted bool) Json {
+	snapshot, err := toJson(resp)
+	if err != nil {
+		//resp can't be sent either so there is no view to record
+		return resp
+	}
+	delete(snapshot, _VERSION)
+	key := entityId + "\x00" + userId
+	baseSnapshot, found := vc.put(key, base, version, snapshot)
+	if !wanted || !found {
+		return resp
+	}
+	return Json{
+		_VERSION: version,
+		_PATCH: diffJson(``, baseSnapshot, snapshot, []Json{}),
+	}
+}
+
+// put stores the snapshot of version, returning the snapshot of base if it is cached.
+func (vc *viewCache) put(key string, base int, version int, snapshot Json) (Json, bool) {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	var v *view
+	if elem, exists := vc.views[key]; exists {
+		vc.order.MoveToFront(elem)
+		v = elem.Value.(*view)
+	} else {
+		v = &view{key: key, snapshots: map[int]Json{}}
+		vc.views[key] = vc.order.PushFront(v)
+		if vc.order.Len() > vc.maxViews {
+			oldest := vc.order.Back()
+			vc.order.Remove(oldest)
+			delete(vc.views, oldest.Value.(*view).key)
+		}
+	}
+	baseSnapshot, found := v.snapshots[base]
+	if _, exists := v.snapshots[version]; !exists {
+		v.versions = append(v.versions, version)
+		if len(v.versions) > vc.maxVersions {
+			delete(v.snapshots, v.versions[0])
+			v.versions = v.versions[1:]
+		}
+	}
+	v.snapshots[version] = snapshot
+	return baseSnapshot, found
+}
+
+// diffJson appends the JSON Patch operations turning from into to, which must be values decoded
+// from json, objects are compared key by key, arrays element by element and anything else replaced.
+func diffJson(path string, from interface{}, to interface{}, ops []Json) []Json {
+	switch fromVal := from.(type) {
+	case map[string]interface{}:
+		if toVal, ok := to.(map[string]interface{}); ok {
+			return diffObjects(path, fromVal, toVal, ops)
+		}
+	case Json:
+		if toVal, ok := to.(Json); ok {
+			return diffObjects(path, fromVal, toVal, ops)
+		}
+	case []interface{}:
+		if toVal, ok := to.([]interface{}); ok {
+			return diffArrays(path, fromVal, toVal, ops)
+		}
+	}
+	if reflect.DeepEqual(from, to) {
+		return ops
+	}
+	return append(ops, Json{`op`: `replace`, `path`: path, `value`: to})
+}
+
+func diffObjects(path string, from map[string]interface{}, to map[string]interface{}, ops []Json) []Json {
+	keys := make([]string, 0, len(from) + len(to))
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, exists := from[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		keyPath := path + `/` + escapePointer(key)
+		fromVal, inFrom := from[key]
+		toVal, inTo := to[key]
+		switch {
+		case !inTo:
+			ops = append(ops, Json{`op`: `remove`, `path`: keyPath})
+		case !inFrom:
+			ops = append(ops, Json{`op`: `add`, `path`: keyPath, `value`: toVal})
+		default:
+			ops = diffJson(keyPath, fromVal, toVal, ops)
+		}
+	}
+	return ops
+}
+
+func diffArrays(path string, from []interface{}, to []interface{}, ops []Json) []Json {
+	if len(to) < len(from) {
+		return append(ops, Json{`op`: `replace`, `path`: path, `value`: to})
+	}
+	for i := range from {
+		ops = diffJson(path + `/` + strconv.Itoa(i), from[i], to[i], ops)
+	}
+	for _, val := range to[len(from):] {
+		ops = append(ops, Json{`op`: `add`, `path`: path + `/-`, `value`: val})
+	}
+	return ops
+}
+
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, `~`, `~0`), `/`, `~1`)
+}
@@ -0,0 +1,96 @@
+package oak
+
+import(
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_diff_json(t *testing.T) {
+	from, _ := toJson(Json{`same`: 1, `changed`: `a`, `removed`: true, `nested`: Json{`x`: 1, `y`: 2}, `list`: []int{1, 2}, `short`: []int{1, 2}, `a/b~c`: 1})
+	to, _ := toJson(Json{`same`: 1, `changed`: `b`, `added`: nil, `nested`: Json{`x`: 1, `y`: 3}, `list`: []int{1, 5, 6}, `short`: []int{1}, `a/b~c`: Json{}})
+
+	ops := diffJson(``, from, to, []Json{})
+
+	assert.Equal(t, []Json{
+		{`op`: `replace`, `path`: `/a~1b~0c`, `value`: map[string]interface{}{}},
+		{`op`: `add`, `path`: `/added`, `value`: nil},
+		{`op`: `replace`, `path`: `/changed`, `value`: `b`},
+		{`op`: `replace`, `path`: `/list/1`, `value`: 5.0},
+		{`op`: `add`, `path`: `/list/-`, `value`: 6.0},
+		{`op`: `replace`, `path`: `/nested/y`, `value`: 3.0},
+		{`op`: `remove`, `path`: `/removed`},
+		{`op`: `replace`, `path`: `/short`, `value`: []interface{}{1.0}},
+	}, ops, `ops should turn from into to`)
+	assert.Equal(t, []Json{}, diffJson(``, from, from, []Json{}), `equal values should have no ops`)
+}
+
+func Test_poll_with_deltas(t *testing.T) {
+	board := []interface{}{0, 0, 0}
+	w, _ := setup(nil, func(userId string, e Entity)Json{return Json{`board`: board, `turn`: userId}}, nil, _POLL, ``, Deltas(10, 2))
+	tes.Create()
+	version := 0
+	tes.entity.getVersion = func()int{return version}
+
+	w = serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":-1,"`+_DELTA+`":true}`)
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, Json{`board`: []interface{}{0.0, 0.0, 0.0}, `turn`: ``, _VERSION: 0.0}, resp, `first poll should get the full response`)
+
+	version = 1
+	board = []interface{}{0, 1, 0}
+	w = serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":0,"`+_DELTA+`":true}`)
+	resp = Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, Json{_VERSION: 1.0, _PATCH: []interface{}{map[string]interface{}{`op`: `replace`, `path`: `/board/1`, `value`: 1.0}}}, resp, `poll should get the patch from its version`)
+
+	version = 2
+	w = serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":1}`)
+	resp = Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, 2.0, resp[_VERSION], `poll without delta should get the full response`)
+	assert.Nil(t, resp[_PATCH], `poll without delta should get the full response`)
+
+	version = 3
+	w = serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":0,"`+_DELTA+`":true}`)
+	resp = Json{}
+	readTestJson(w, &resp)
+	assert.Nil(t, resp[_PATCH], `poll from an evicted version should get the full response`)
+	assert.Equal(t, 3.0, resp[_VERSION], `full response should have the version`)
+}
+
+func Test_act_records_view_for_deltas(t *testing.T) {
+	moves := 0
+	w, r := setup(nil, func(userId string, e Entity)Json{return Json{`moves`: moves}}, func(json Json, userId string, e Entity)error{
+		moves++
+		return nil
+	}, _ACT, `{}`, Deltas(10, 2))
+	tes.Create()
+	version := 0
+	tes.entity.getVersion = func()int{return version}
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+	tr.ServeHTTP(w, r)
+
+	version = 1
+	moves = 2
+	w = serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":0,"`+_DELTA+`":true}`)
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, []interface{}{map[string]interface{}{`op`: `replace`, `path`: `/moves`, `value`: 2.0}}, resp[_PATCH], `poll should get the patch from the act's response`)
+}
+
+func Test_view_cache_evicts_least_recently_used_views(t *testing.T) {
+	vc := newViewCache(2, 1)
+	vc.put(`a`, -1, 0, Json{})
+	vc.put(`b`, -1, 0, Json{})
+	vc.put(`a`, -1, 1, Json{})
+	vc.put(`c`, -1, 0, Json{})
+
+	_, found := vc.put(`a`, 1, 2, Json{})
+	assert.True(t, found, `recently used view should be kept`)
+	_, found = vc.put(`b`, 0, 1, Json{})
+	assert.False(t, found, `least recently used view should be evicted`)
+	_, found = vc.put(`a`, 1, 3, Json{})
+	assert.False(t, found, `only the last version should be kept`)
+}
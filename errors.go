@@ -0,0 +1,126 @@
+package oak
+
+import(
+	`errors`
+	`strconv`
+	`net/http`
+)
+
+// ErrorCode identifies the kind of an Error, each kind is sent with its own http status.
+type ErrorCode string
+
+const (
+	// CodeBadRequest is for malformed or incomplete requests, sent as 400.
+	CodeBadRequest	ErrorCode = `bad_request`
+	// CodeForbidden is for requests the user is not allowed to make, e.g. acting out of turn, sent as 403.
+	CodeForbidden	ErrorCode = `forbidden`
+	// CodeNotEngaged is for requests which need the user to be in an entity when they are not, sent as 403.
+	CodeNotEngaged	ErrorCode = `not_engaged`
+	// CodeNotFound is for entities which don't exist, sent as 404.
+	CodeNotFound	ErrorCode = `not_found`
+	// CodeConflict is for updates which clash with a concurrent change, sent as 409.
+	CodeConflict	ErrorCode = `conflict`
+	// CodeTooLarge is for request bodies over the server's MaxBodySize, sent as 413.
+	CodeTooLarge	ErrorCode = `too_large`
+	// CodeInternal is for everything else, sent as 500.
+	CodeInternal	ErrorCode = `internal`
+)
+
+var errorStatuses = map[ErrorCode]int{
+	CodeBadRequest: http.StatusBadRequest,
+	CodeForbidden: http.StatusForbidden,
+	CodeNotEngaged: http.StatusForbidden,
+	CodeNotFound: http.StatusNotFound,
+	CodeConflict: http.StatusConflict,
+	CodeTooLarge: http.StatusRequestEntityTooLarge,
+	CodeInternal: http.StatusInternalServerError,
+}
+
+// Error is the error model sent to clients as the json body of error responses. EntityStores,
+// PerformAct and Entity methods may return an *Error, or wrap one, to control the response,
+// any other error is sent as CodeInternal with its message.
+type Error struct{
+	Code ErrorCode `json:"code"`
+	Message string `json:"message"`
+	Details Json `json:"details,omitempty"`
+	Cause error `json:"-"`
+}
+
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{
+		Code: code,
+		Message: message,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Status returns the http status the error is sent with, unknown codes are sent as 500.
+func (e *Error) Status() int {
+	if status, exists := errorStatuses[e.Code]; exists {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// AsError returns the *Error in err's chain, an ErrNonsequentialUpdate becomes a CodeConflict error
+// and anything else a CodeInternal error, so custom ErrorHandlers can respond as the default one does.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var nonsequential *ErrNonsequentialUpdate
+	if errors.As(err, &nonsequential) {
+		return &Error{
+			Code: CodeConflict,
+			Message: err.Error(),
+			Details: Json{
+				_ID: nonsequential.EntityId,
+				`expectedVersion`: nonsequential.ExpectedVersion,
+				`actualVersion`: nonsequential.ActualVersion,
+			},
+			Cause: err,
+		}
+	}
+	return &Error{
+		Code: CodeInternal,
+		Message: err.Error(),
+		Cause: err,
+	}
+}
+
+func errEntityNotFound(entityId string) *Error {
+	return &Error{
+		Code: CodeNotFound,
+		Message: `no entity with id "` + entityId + `"`,
+		Details: Json{_ID: entityId},
+	}
+}
+
+// ErrNonsequentialUpdate must be returned by EntityStore.Update when the entity's version
+// is not exactly one past the stored version, oak treats it as an optimistic concurrency
+// conflict and retries the operation against the latest stored entity.
+type ErrNonsequentialUpdate struct{
+	EntityId string
+	ExpectedVersion int
+	ActualVersion int
+}
+
+func (e *ErrNonsequentialUpdate) Error() string {
+	return `nonsequential update for entity with id "` + e.EntityId + `", expected version ` + strconv.Itoa(e.ExpectedVersion) + ` but got ` + strconv.Itoa(e.ActualVersion)
+}
+
+func isNonsequentialUpdate(err error) bool {
+	var nonsequential *ErrNonsequentialUpdate
+	return errors.As(err, &nonsequential)
+}
@@ -0,0 +1,79 @@
+package oak
+
+import(
+	`fmt`
+	`errors`
+	`testing`
+	`net/http`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_error_statuses(t *testing.T) {
+	for code, status := range map[ErrorCode]int{
+		CodeBadRequest: 400,
+		CodeForbidden: 403,
+		CodeNotEngaged: 403,
+		CodeNotFound: 404,
+		CodeConflict: 409,
+		CodeTooLarge: 413,
+		CodeInternal: 500,
+		ErrorCode(`unknown`): 500,
+	} {
+		assert.Equal(t, status, NewError(code, ``).Status(), `status should match the code`)
+	}
+}
+
+func Test_as_error(t *testing.T) {
+	assert.Nil(t, AsError(nil), `nil should stay nil`)
+
+	typed := NewError(CodeForbidden, `test_forbidden`)
+	assert.True(t, typed == AsError(fmt.Errorf(`wrapped: %w`, typed)), `wrapped errors should be unwrapped`)
+
+	plain := errors.New(`test_error`)
+	assert.Equal(t, &Error{Code: CodeInternal, Message: `test_error`, Cause: plain}, AsError(plain), `other errors should be internal`)
+
+	nonsequential := &ErrNonsequentialUpdate{EntityId: `test_entity_id`, ExpectedVersion: 1, ActualVersion: 2}
+	e := AsError(nonsequential)
+	assert.Equal(t, CodeConflict, e.Code, `nonsequential updates should be conflicts`)
+	assert.Equal(t, Json{_ID: `test_entity_id`, `expectedVersion`: 1, `actualVersion`: 2}, e.Details, `conflict should have the versions`)
+	assert.True(t, isNonsequentialUpdate(e), `conflict should unwrap to the nonsequential update`)
+}
+
+func Test_act_with_typed_error(t *testing.T) {
+	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{
+		err := NewError(CodeForbidden, `not your turn`)
+		err.Details = Json{`turn`: `test_other_user_id`}
+		return err
+	}, _ACT, ``)
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	tr.ServeHTTP(w, r)
+
+	e := &Error{}
+	readTestJson(w, e)
+	assert.Equal(t, 403, w.Code, `response code should be 403`)
+	assert.Equal(t, &Error{Code: CodeForbidden, Message: `not your turn`, Details: Json{`turn`: `test_other_user_id`}}, e, `response body should have the error`)
+}
+
+func Test_join_with_unknown_entity(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	tss = &testSessionStore{}
+	tr = mux.NewRouter()
+	NewServer(Config{
+		SessionStore: tss,
+		SessionName: `test_session`,
+		Entity: &storeTestEntity{},
+		EntityStoreFactory: func(r *http.Request)EntityStore{return store},
+	}).Route(tr)
+
+	w := serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"test_entity_id"}`)
+
+	e := &Error{}
+	readTestJson(w, e)
+	assert.Equal(t, 404, w.Code, `response code should be 404`)
+	assert.Equal(t, &Error{Code: CodeNotFound, Message: `no entity with id "test_entity_id"`, Details: Json{_ID: `test_entity_id`}}, e, `response body should have the error`)
+}
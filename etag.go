@@ -0,0 +1,31 @@
+package oak
+
+import(
+	`strconv`
+	`strings`
+	`crypto/sha256`
+	`encoding/base64`
+)
+
+const (
+	_ETAG			= `ETag`
+	_IF_NONE_MATCH	= `If-None-Match`
+)
+
+// entityTag identifies the response a user gets for a version of an entity, the ids are hashed
+// so user ids are not exposed to caches.
+func entityTag(entityId string, userId string, version int) string {
+	hash := sha256.Sum256([]byte(entityId + "\x00" + userId))
+	return `"` + base64.RawURLEncoding.EncodeToString(hash[:12]) + `.` + strconv.Itoa(version) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag using the weak comparison RFC 7232 requires.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, `,`) {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), `W/`)
+		if tag == `*` || tag == etag {
+			return true
+		}
+	}
+	return false
+}
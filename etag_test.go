@@ -0,0 +1,81 @@
+package oak
+
+import(
+	`time`
+	`bytes`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_entity_tag(t *testing.T) {
+	etag := entityTag(`test_entity_id`, `test_user_id`, 3)
+
+	assert.Equal(t, etag, entityTag(`test_entity_id`, `test_user_id`, 3), `tags should be stable`)
+	assert.NotEqual(t, etag, entityTag(`test_entity_id`, `test_user_id`, 4), `tags should differ by version`)
+	assert.NotEqual(t, etag, entityTag(`test_entity_id`, `test_other_user_id`, 3), `tags should differ by user`)
+	assert.NotEqual(t, etag, entityTag(`test_other_entity_id`, `test_user_id`, 3), `tags should differ by entity`)
+	assert.NotContains(t, etag, `test_user_id`, `tags should not expose the user id`)
+}
+
+func Test_etag_matches(t *testing.T) {
+	etag := entityTag(`test_entity_id`, `test_user_id`, 3)
+
+	assert.True(t, etagMatches(etag, etag), `same tag should match`)
+	assert.True(t, etagMatches(`"other", W/` + etag, etag), `weak tags in a list should match`)
+	assert.True(t, etagMatches(`*`, etag), `* should match`)
+	assert.False(t, etagMatches(``, etag), `no tag should not match`)
+	assert.False(t, etagMatches(entityTag(`test_entity_id`, `test_user_id`, 2), etag), `other tag should not match`)
+}
+
+func Test_poll_with_etags(t *testing.T) {
+	w, r := setup(nil, func(userId string, e Entity)Json{return Json{}}, nil, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":-1}`)
+	tes.Create()
+
+	tr.ServeHTTP(w, r)
+	etag := w.Header().Get(_ETAG)
+	assert.Equal(t, entityTag(`test_entity_id`, ``, 0), etag, `response should be tagged`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, _POLL, bytes.NewBufferString(`{"`+_ID+`":"test_entity_id","`+_VERSION+`":-1}`))
+	r.Header.Set(_IF_NONE_MATCH, etag)
+	tr.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotModified, w.Code, `matching tag should not be modified`)
+	assert.Equal(t, etag, w.Header().Get(_ETAG), `not modified response should be tagged`)
+	assert.Equal(t, ``, w.Body.String(), `not modified response should be empty`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, _POLL, bytes.NewBufferString(`{"`+_ID+`":"test_entity_id","`+_VERSION+`":0}`))
+	tr.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code, `matching version without a tag should still be an empty 200`)
+	assert.Equal(t, ``, w.Body.String(), `response should be empty`)
+}
+
+func Test_long_poll_with_matching_etag(t *testing.T) {
+	w, r := setup(nil, nil, nil, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":-1}`, LongPoll(20 * time.Millisecond, 0))
+	tes.Create()
+	r.Header.Set(_IF_NONE_MATCH, entityTag(`test_entity_id`, ``, 0))
+
+	start := time.Now()
+	tr.ServeHTTP(w, r)
+
+	assert.True(t, time.Since(start) >= 20 * time.Millisecond, `request should have waited for a change`)
+	assert.Equal(t, http.StatusNotModified, w.Code, `unchanged entity should not be modified`)
+}
+
+func Test_join_with_etags(t *testing.T) {
+	w, r := setup(func(userId string, e Entity)Json{return Json{`test`: `yo`}}, nil, nil, _JOIN, `{"`+_ID+`":"test_entity_id"}`)
+	tes.Create()
+
+	tr.ServeHTTP(w, r)
+	etag := w.Header().Get(_ETAG)
+	assert.Equal(t, entityTag(`test_entity_id`, `test_user_id`, 0), etag, `response should be tagged for the joined user`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, _JOIN, bytes.NewBufferString(`{"`+_ID+`":"test_entity_id"}`))
+	r.Header.Set(_IF_NONE_MATCH, etag)
+	tr.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotModified, w.Code, `matching tag should not be modified`)
+	assert.Equal(t, ``, w.Body.String(), `not modified response should be empty`)
+}
@@ -0,0 +1,319 @@
+package oak
+
+import(
+	`io`
+	`os`
+	`sync`
+	`strings`
+	`hash/crc32`
+	`path/filepath`
+	`encoding/gob`
+	`encoding/binary`
+)
+
+const (
+	_SNAPSHOT_EXT	= `.entity`
+	_LOG_EXT		= `.log`
+	_TMP_EXT		= `.tmp`
+
+	_LOG_HEADER_SIZE	= 8
+	_LOG_VERSION_SIZE	= 8
+)
+
+// SyncPolicy controls when a FileEntityStore forces writes to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs every log append, snapshot and directory change before returning.
+	SyncAlways SyncPolicy = iota
+	// SyncLog only fsyncs log appends, snapshots lost in a crash are rebuilt from the log on start up.
+	SyncLog
+	// SyncNever leaves flushing to the operating system, a crash may lose recent updates.
+	SyncNever
+)
+
+// FileEntityStore is a durable EntityStore keeping each entity in its own files under a
+// directory: an append only log of every version and a snapshot of the latest version which
+// is replaced atomically by write-rename. The log is the source of truth, on start up torn log
+// records are truncated and missing or stale snapshots are rebuilt from it.
+// Update only succeeds when the entity's version is exactly one past the stored version.
+type FileEntityStore struct{
+	mtx sync.RWMutex
+	dir string
+	newEntity func() Entity
+	syncPolicy SyncPolicy
+	versions map[string]int
+}
+
+// FileStoreOption configures optional behaviour of a FileEntityStore.
+type FileStoreOption func(*FileEntityStore)
+
+// FileSync sets the fsync policy, the default is SyncAlways.
+func FileSync(policy SyncPolicy) FileStoreOption {
+	return func(fes *FileEntityStore) {
+		fes.syncPolicy = policy
+	}
+}
+
+// NewFileEntityStore opens the store in dir, creating it if needed, and recovers any entities
+// left in an inconsistent state by a crash. newEntity must return a fresh entity for each call to Create.
+func NewFileEntityStore(dir string, newEntity func() Entity, opts ...FileStoreOption) (*FileEntityStore, error) {
+	gob.Register(newEntity())
+	fes := &FileEntityStore{
+		dir: dir,
+		newEntity: newEntity,
+		syncPolicy: SyncAlways,
+		versions: map[string]int{},
+	}
+	for _, opt := range opts {
+		opt(fes)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := fes.recover(); err != nil {
+		return nil, err
+	}
+	return fes, nil
+}
+
+func (fes *FileEntityStore) Create() (entityId string, entity Entity, err error) {
+	entity = fes.newEntity()
+	data, err := encodeEntity(entity)
+	if err != nil {
+		return ``, nil, err
+	}
+	fes.mtx.Lock()
+	defer fes.mtx.Unlock()
+	for entityId == `` {
+		if entityId, err = newEntityId(); err != nil {
+			return ``, nil, err
+		}
+		if _, exists := fes.versions[entityId]; exists {
+			entityId = ``
+		}
+	}
+	if err = fes.write(entityId, entity.GetVersion(), data, true); err != nil {
+		return ``, nil, err
+	}
+	fes.versions[entityId] = entity.GetVersion()
+	entity, err = decodeEntity(data)
+	return
+}
+
+func (fes *FileEntityStore) Read(entityId string) (Entity, error) {
+	fes.mtx.RLock()
+	defer fes.mtx.RUnlock()
+	if _, exists := fes.versions[entityId]; !exists {
+		return nil, errEntityNotFound(entityId)
+	}
+	data, err := os.ReadFile(fes.path(entityId, _SNAPSHOT_EXT))
+	if err != nil {
+		return nil, err
+	}
+	return decodeEntity(data)
+}
+
+func (fes *FileEntityStore) Update(entityId string, entity Entity) error {
+	data, err := encodeEntity(entity)
+	if err != nil {
+		return err
+	}
+	fes.mtx.Lock()
+	defer fes.mtx.Unlock()
+	version, exists := fes.versions[entityId]
+	if !exists {
+		return errEntityNotFound(entityId)
+	}
+	if entity.GetVersion() != version + 1 {
+		return &ErrNonsequentialUpdate{
+			EntityId: entityId,
+			ExpectedVersion: version + 1,
+			ActualVersion: entity.GetVersion(),
+		}
+	}
+	if err = fes.write(entityId, entity.GetVersion(), data, false); err != nil {
+		return err
+	}
+	fes.versions[entityId] = entity.GetVersion()
+	return nil
+}
+
+func (fes *FileEntityStore) path(entityId string, ext string) string {
+	return filepath.Join(fes.dir, entityId + ext)
+}
+
+// write appends the version to the entity's log then replaces its snapshot.
+func (fes *FileEntityStore) write(entityId string, version int, data []byte, isNew bool) error {
+	flags := os.O_WRONLY | os.O_APPEND
+	if isNew {
+		flags |= os.O_CREATE | os.O_EXCL
+	}
+	log, err := os.OpenFile(fes.path(entityId, _LOG_EXT), flags, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = log.Write(encodeLogRecord(version, data))
+	if err == nil && fes.syncPolicy != SyncNever {
+		err = log.Sync()
+	}
+	if closeErr := log.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if isNew && fes.syncPolicy == SyncAlways {
+		if err = syncDir(fes.dir); err != nil {
+			return err
+		}
+	}
+	return fes.writeSnapshot(entityId, data)
+}
+
+func (fes *FileEntityStore) writeSnapshot(entityId string, data []byte) error {
+	tmpPath := fes.path(entityId, _SNAPSHOT_EXT + _TMP_EXT)
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil && fes.syncPolicy == SyncAlways {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, fes.path(entityId, _SNAPSHOT_EXT))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if fes.syncPolicy == SyncAlways {
+		return syncDir(fes.dir)
+	}
+	return nil
+}
+
+// recover loads the latest version of every entity in the directory, truncating torn log
+// records, rebuilding stale snapshots and removing entities whose creation never completed.
+func (fes *FileEntityStore) recover() error {
+	entries, err := os.ReadDir(fes.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, _TMP_EXT) {
+			if err = os.Remove(filepath.Join(fes.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, _LOG_EXT) {
+			continue
+		}
+		if err = fes.recoverEntity(strings.TrimSuffix(name, _LOG_EXT)); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, _SNAPSHOT_EXT) {
+			if _, exists := fes.versions[strings.TrimSuffix(name, _SNAPSHOT_EXT)]; !exists {
+				//a snapshot is only written after its log record so without a log it is garbage
+				if err = os.Remove(filepath.Join(fes.dir, name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (fes *FileEntityStore) recoverEntity(entityId string) error {
+	logPath := fes.path(entityId, _LOG_EXT)
+	log, err := os.OpenFile(logPath, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	info, err := log.Stat()
+	if err != nil {
+		return err
+	}
+	version, data, validSize, err := readLastLogRecord(log, info.Size())
+	if err != nil {
+		return err
+	}
+	if err = log.Truncate(validSize); err != nil {
+		return err
+	}
+	if data == nil {
+		//creation never completed, its snapshot if any is removed along with the other orphans
+		log.Close()
+		return os.Remove(logPath)
+	}
+	snapshot, err := os.ReadFile(fes.path(entityId, _SNAPSHOT_EXT))
+	if err != nil || string(snapshot) != string(data) {
+		if err = fes.writeSnapshot(entityId, data); err != nil {
+			return err
+		}
+	}
+	fes.versions[entityId] = version
+	return nil
+}
+
+// log records are: 4 byte payload length, 4 byte crc32 of the payload, 8 byte version, gob encoded entity.
+func encodeLogRecord(version int, data []byte) []byte {
+	record := make([]byte, _LOG_HEADER_SIZE + _LOG_VERSION_SIZE + len(data))
+	payload := record[_LOG_HEADER_SIZE:]
+	binary.BigEndian.PutUint64(payload, uint64(int64(version)))
+	copy(payload[_LOG_VERSION_SIZE:], data)
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	return record
+}
+
+// readLastLogRecord scans the log returning its last intact record and the size of the log up to the end of it.
+func readLastLogRecord(log io.Reader, size int64) (version int, data []byte, validSize int64, err error) {
+	var header [_LOG_HEADER_SIZE]byte
+	for {
+		if _, err = io.ReadFull(log, header[:]); err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		//a corrupt length near the uint32 max must not wrap around when the header is added
+		recordSize := _LOG_HEADER_SIZE + int64(length)
+		if length < _LOG_VERSION_SIZE || validSize + recordSize > size {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(log, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		version = int(int64(binary.BigEndian.Uint64(payload)))
+		data = payload[_LOG_VERSION_SIZE:]
+		validSize += recordSize
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
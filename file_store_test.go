@@ -0,0 +1,162 @@
+package oak
+
+import(
+	`os`
+	`bytes`
+	`runtime`
+	`testing`
+	`path/filepath`
+	`encoding/binary`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_file_store_create_read_and_update(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncLog, SyncNever} {
+		store, err := NewFileEntityStore(t.TempDir(), func()Entity{return &storeTestEntity{Creator: `test_creator_user_id`}}, FileSync(policy))
+		assert.Nil(t, err, `open should not error`)
+
+		entityId, entity, err := store.Create()
+		assert.Nil(t, err, `create should not error`)
+		assert.Equal(t, `test_creator_user_id`, entity.CreatedBy(), `created entity should be returned`)
+
+		entity.(*storeTestEntity).Users = []string{`test_user_id`}
+		read, err := store.Read(entityId)
+		assert.Nil(t, err, `read should not error`)
+		assert.Empty(t, read.(*storeTestEntity).Users, `mutating a created entity should not change the store`)
+
+		read.(*storeTestEntity).Version = 1
+		read.(*storeTestEntity).Users = []string{`test_user_id`}
+		assert.Nil(t, store.Update(entityId, read), `next version should be accepted`)
+		err = store.Update(entityId, &storeTestEntity{Version: 3})
+		assert.Equal(t, &ErrNonsequentialUpdate{EntityId: entityId, ExpectedVersion: 2, ActualVersion: 3}, err, `skipping a version should be nonsequential`)
+
+		read, _ = store.Read(entityId)
+		assert.Equal(t, &storeTestEntity{Version: 1, Creator: `test_creator_user_id`, Users: []string{`test_user_id`}}, read, `update should be stored`)
+	}
+}
+
+func Test_file_store_survives_reopen(t *testing.T) {
+	dir := t.TempDir()
+	newEntity := func()Entity{return &storeTestEntity{}}
+	store, _ := NewFileEntityStore(dir, newEntity)
+	entityId, _, _ := store.Create()
+	store.Update(entityId, &storeTestEntity{Version: 1, Users: []string{`a`}})
+	store.Update(entityId, &storeTestEntity{Version: 2, Users: []string{`a`, `b`}})
+
+	store, err := NewFileEntityStore(dir, newEntity)
+	assert.Nil(t, err, `reopen should not error`)
+
+	read, err := store.Read(entityId)
+	assert.Nil(t, err, `read should not error`)
+	assert.Equal(t, &storeTestEntity{Version: 2, Users: []string{`a`, `b`}}, read, `latest version should survive a reopen`)
+	assert.True(t, isNonsequentialUpdate(store.Update(entityId, &storeTestEntity{Version: 2})), `version checks should survive a reopen`)
+	assert.Nil(t, store.Update(entityId, &storeTestEntity{Version: 3}), `next version should be accepted after a reopen`)
+}
+
+func Test_file_store_recovers_torn_log_and_stale_snapshot(t *testing.T) {
+	dir := t.TempDir()
+	newEntity := func()Entity{return &storeTestEntity{}}
+	store, _ := NewFileEntityStore(dir, newEntity)
+	entityId, _, _ := store.Create()
+	store.Update(entityId, &storeTestEntity{Version: 1})
+	staleSnapshot, _ := os.ReadFile(filepath.Join(dir, entityId + _SNAPSHOT_EXT))
+	store.Update(entityId, &storeTestEntity{Version: 2})
+	logPath := filepath.Join(dir, entityId + _LOG_EXT)
+	info, _ := os.Stat(logPath)
+	validSize := info.Size()
+
+	//simulate a crash after the version 2 log append but before its snapshot rename, while appending version 3
+	os.WriteFile(filepath.Join(dir, entityId + _SNAPSHOT_EXT), staleSnapshot, 0600)
+	os.WriteFile(filepath.Join(dir, entityId + _SNAPSHOT_EXT + _TMP_EXT), []byte(`garbage`), 0600)
+	record := encodeLogRecord(3, []byte(`torn`))
+	log, _ := os.OpenFile(logPath, os.O_WRONLY | os.O_APPEND, 0600)
+	log.Write(record[:len(record) - 2])
+	log.Close()
+
+	store, err := NewFileEntityStore(dir, newEntity)
+	assert.Nil(t, err, `reopen should not error`)
+
+	read, _ := store.Read(entityId)
+	assert.Equal(t, 2, read.GetVersion(), `snapshot should be rebuilt from the log`)
+	info, _ = os.Stat(logPath)
+	assert.Equal(t, validSize, info.Size(), `torn log record should be truncated`)
+	_, err = os.Stat(filepath.Join(dir, entityId + _SNAPSHOT_EXT + _TMP_EXT))
+	assert.True(t, os.IsNotExist(err), `temp files should be removed`)
+	assert.Nil(t, store.Update(entityId, &storeTestEntity{Version: 3}), `updates should continue from the recovered version`)
+}
+
+func Test_file_store_recovers_corrupt_records_and_incomplete_creates(t *testing.T) {
+	dir := t.TempDir()
+	newEntity := func()Entity{return &storeTestEntity{}}
+	store, _ := NewFileEntityStore(dir, newEntity)
+	entityId, _, _ := store.Create()
+	logPath := filepath.Join(dir, entityId + _LOG_EXT)
+	record := encodeLogRecord(1, []byte(`corrupt`))
+	record[len(record) - 1] ^= 0xFF
+	log, _ := os.OpenFile(logPath, os.O_WRONLY | os.O_APPEND, 0600)
+	log.Write(record)
+	log.Close()
+	os.WriteFile(filepath.Join(dir, `empty` + _LOG_EXT), nil, 0600)
+	os.WriteFile(filepath.Join(dir, `empty` + _SNAPSHOT_EXT), []byte(`garbage`), 0600)
+	os.WriteFile(filepath.Join(dir, `orphan` + _SNAPSHOT_EXT), []byte(`garbage`), 0600)
+
+	store, err := NewFileEntityStore(dir, newEntity)
+	assert.Nil(t, err, `reopen should not error`)
+
+	read, _ := store.Read(entityId)
+	assert.Equal(t, 0, read.GetVersion(), `corrupt record should be ignored`)
+	for _, name := range []string{`empty` + _LOG_EXT, `empty` + _SNAPSHOT_EXT, `orphan` + _SNAPSHOT_EXT} {
+		_, err = os.Stat(filepath.Join(dir, name))
+		assert.True(t, os.IsNotExist(err), `incomplete entity files should be removed`)
+	}
+	_, err = store.Read(`empty`)
+	assert.NotNil(t, err, `incomplete entity should not be readable`)
+}
+
+func Test_file_store_recovery_with_record_length_near_max(t *testing.T) {
+	record := encodeLogRecord(1, []byte(`valid`))
+	corrupt := make([]byte, len(record) + 16)
+	copy(corrupt, record)
+	//8 added to this length wraps to 4 in uint32, which would pass as fitting in the log
+	binary.BigEndian.PutUint32(corrupt[len(record):], 0xFFFFFFFC)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	version, data, validSize, err := readLastLogRecord(bytes.NewReader(corrupt), int64(len(corrupt)))
+	runtime.ReadMemStats(&after)
+
+	assert.Nil(t, err, `recovery should not error`)
+	assert.True(t, after.TotalAlloc - before.TotalAlloc < 1 << 20, `recovery should not allocate for the corrupt length`)
+	assert.Equal(t, 1, version, `last valid record should be recovered`)
+	assert.Equal(t, []byte(`valid`), data, `last valid record data should be recovered`)
+	assert.Equal(t, int64(len(record)), validSize, `record with a length past the log should not be valid`)
+}
+
+func Test_file_store_with_unknown_entity(t *testing.T) {
+	store, _ := NewFileEntityStore(t.TempDir(), func()Entity{return &storeTestEntity{}})
+
+	_, err := store.Read(`../test_entity_id`)
+	assert.Equal(t, `no entity with id "../test_entity_id"`, err.Error(), `read should error`)
+
+	err = store.Update(`test_entity_id`, &storeTestEntity{Version: 1})
+	assert.Equal(t, `no entity with id "test_entity_id"`, err.Error(), `update should error`)
+}
+
+func Test_file_store_with_unencodable_entity(t *testing.T) {
+	store, _ := NewFileEntityStore(t.TempDir(), func()Entity{return &testEntity{}})
+
+	_, _, err := store.Create()
+	assert.NotNil(t, err, `create should error`)
+
+	err = store.Update(`test_entity_id`, &testEntity{})
+	assert.NotNil(t, err, `update should error`)
+}
+
+func Test_file_store_with_invalid_dir(t *testing.T) {
+	file := filepath.Join(t.TempDir(), `file`)
+	os.WriteFile(file, nil, 0600)
+
+	_, err := NewFileEntityStore(file, func()Entity{return &storeTestEntity{}})
+
+	assert.NotNil(t, err, `open should error`)
+}
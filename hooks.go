@@ -0,0 +1,151 @@
+package oak
+
+import(
+	`context`
+	`net/http`
+)
+
+// HookEvent describes what a hook is called for. Request is nil for hooks not run by a request,
+// UserId is the session's user in the entity, empty if they have none, and Resp is the response about to be sent.
+// For AfterAct, OnJoin and OnLeave Entity is the stored entity the op changed and Before a copy of it from
+// before the change, Before is nil for other hooks.
+type HookEvent struct{
+	Op Op
+	Context context.Context
+	Request *http.Request
+	UserId string
+	EntityId string
+	Entity Entity
+	Before Entity
+	Json Json
+	Resp Json
+}
+
+// BeforeHook runs before an operation changes anything, returning an error vetoes the operation
+// and is responded with as any other error, return an *Error to control the response.
+type BeforeHook func(e *HookEvent) error
+
+// AfterHook runs once an operation has happened, it may change e.Resp to change the response.
+type AfterHook func(e *HookEvent)
+
+// Hooks are run around the operations of a Server, unset hooks are skipped.
+//
+// BeforeCreate runs when a user in fewer than MaxEntities entities is about to create one, AfterCreate
+// before every create response with the created entity, or nil if the user was already in one.
+// BeforeJoin runs before every join with the entity being joined, OnJoin once the user has been
+// registered with it and AfterJoin before every join response.
+// BeforePoll runs before every poll, AfterPoll before every change response sent to a poll.
+// BeforeAct runs with the act's json each time it is about to be performed, which is more than once
+// when a nonsequential update is retried, AfterAct once the updated entity is stored.
+// BeforeLeave runs each time the user is about to be unregistered, OnLeave once they have been.
+// OnKick runs when a kick has updated an entity and OnEntityInactive when any update leaves an
+// active entity inactive, neither has a Request or UserId. BeforeLeave and OnLeave also run,
+// without a Request, when Presence unregisters an idle user.
+// Hooks are not run for /watch, /stream, changes pushed over websockets or the EntityInSession pre-check of acts.
+type Hooks struct{
+	BeforeCreate BeforeHook
+	AfterCreate AfterHook
+	BeforeJoin BeforeHook
+	OnJoin AfterHook
+	AfterJoin AfterHook
+	BeforePoll BeforeHook
+	AfterPoll AfterHook
+	BeforeAct BeforeHook
+	AfterAct AfterHook
+	BeforeLeave BeforeHook
+	OnLeave AfterHook
+	OnKick AfterHook
+	OnEntityInactive AfterHook
+}
+
+// Hook adds lifecycle hooks, the hooks of earlier Hook options run first and the first error
+// from a BeforeHook stops the rest.
+func Hook(hooks Hooks) Option {
+	return func(o *options) {
+		o.hooks = o.hooks.then(hooks)
+	}
+}
+
+func (h Hooks) then(next Hooks) Hooks {
+	return Hooks{
+		BeforeCreate: chainBefore(h.BeforeCreate, next.BeforeCreate),
+		AfterCreate: chainAfter(h.AfterCreate, next.AfterCreate),
+		BeforeJoin: chainBefore(h.BeforeJoin, next.BeforeJoin),
+		OnJoin: chainAfter(h.OnJoin, next.OnJoin),
+		AfterJoin: chainAfter(h.AfterJoin, next.AfterJoin),
+		BeforePoll: chainBefore(h.BeforePoll, next.BeforePoll),
+		AfterPoll: chainAfter(h.AfterPoll, next.AfterPoll),
+		BeforeAct: chainBefore(h.BeforeAct, next.BeforeAct),
+		AfterAct: chainAfter(h.AfterAct, next.AfterAct),
+		BeforeLeave: chainBefore(h.BeforeLeave, next.BeforeLeave),
+		OnLeave: chainAfter(h.OnLeave, next.OnLeave),
+		OnKick: chainAfter(h.OnKick, next.OnKick),
+		OnEntityInactive: chainAfter(h.OnEntityInactive, next.OnEntityInactive),
+	}
+}
+
+func chainBefore(first BeforeHook, second BeforeHook) BeforeHook {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	return func(e *HookEvent) error {
+		if err := first(e); err != nil {
+			return err
+		}
+		return second(e)
+	}
+}
+
+func chainAfter(first AfterHook, second AfterHook) AfterHook {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	return func(e *HookEvent) {
+		first(e)
+		second(e)
+	}
+}
+
+func (hook BeforeHook) run(e *HookEvent) error {
+	if hook == nil {
+		return nil
+	}
+	return hook(e)
+}
+
+func (hook AfterHook) run(e *HookEvent) {
+	if hook != nil {
+		hook(e)
+	}
+}
+
+// before copies the entity about to be changed for the hook's Before, entities are only copied when the hook is set.
+func (hook AfterHook) before(e Entity) Entity {
+	if hook == nil {
+		return nil
+	}
+	data, err := encodeEntity(e)
+	if err != nil {
+		return nil
+	}
+	before, _ := decodeEntity(data)
+	return before
+}
+
+// hookEvent starts the event of a request's op.
+func hookEvent(op Op, r *http.Request, userId string, entityId string, entity Entity) *HookEvent {
+	return &HookEvent{
+		Op: op,
+		Context: r.Context(),
+		Request: r,
+		UserId: userId,
+		EntityId: entityId,
+		Entity: entity,
+	}
+}
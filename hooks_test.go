@@ -0,0 +1,233 @@
+package oak
+
+import(
+	`errors`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_hooks_around_act(t *testing.T) {
+	calls := []string{}
+	performed := 0
+	w, r := setup(nil, func(userId string, e Entity)Json{return Json{`test`: `yo`}}, func(json Json, userId string, e Entity)error{
+		performed++
+		return nil
+	}, _ACT, `{"move":1}`, Hook(Hooks{
+		BeforeAct: func(e *HookEvent) error {
+			calls = append(calls, `first_before_` + string(e.Op))
+			assert.Equal(t, Json{`move`: 1.0}, e.Json, `before hook should get the act`)
+			assert.Equal(t, `test_pre_set_user_id`, e.UserId, `before hook should get the user`)
+			assert.Equal(t, `test_entity_id`, e.EntityId, `before hook should get the entity id`)
+			assert.NotNil(t, e.Request, `before hook should get the request`)
+			return nil
+		},
+		AfterAct: func(e *HookEvent) {
+			calls = append(calls, `first_after`)
+			e.Resp[`enriched`] = true
+		},
+	}), Hook(Hooks{
+		BeforeAct: func(e *HookEvent) error {
+			calls = append(calls, `second_before`)
+			return nil
+		},
+		AfterAct: func(e *HookEvent) {
+			calls = append(calls, `second_after`)
+		},
+	}))
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	tr.ServeHTTP(w, r)
+
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, Json{`test`: `yo`, `enriched`: true, _VERSION: 0.0}, resp, `after hook should be able to change the response`)
+	assert.Equal(t, []string{`first_before_act`, `second_before`, `first_after`, `second_after`}, calls, `hooks should run in the order they were added`)
+	assert.Equal(t, 1, performed, `act should be performed`)
+}
+
+func Test_hooks_vetoing_act(t *testing.T) {
+	secondRan := false
+	performed := false
+	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{
+		performed = true
+		return nil
+	}, _ACT, ``, Hook(Hooks{
+		BeforeAct: func(e *HookEvent) error {
+			return NewError(CodeForbidden, `test_veto`)
+		},
+	}), Hook(Hooks{
+		BeforeAct: func(e *HookEvent) error {
+			secondRan = true
+			return nil
+		},
+	}))
+	tes.Create()
+	tes.update = func(entityId string, entity Entity) error {
+		t.Error(`vetoed act should not be stored`)
+		return nil
+	}
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeForbidden, `test_veto`)
+	assert.Equal(t, 403, w.Code, `response code should be 403`)
+	assert.False(t, performed, `act should not be performed`)
+	assert.False(t, secondRan, `later hooks should not run after a veto`)
+}
+
+func Test_hooks_around_create_and_join(t *testing.T) {
+	var created, joined, afterJoin *HookEvent
+	setupServer(nil, Config{}, Hook(Hooks{
+		AfterCreate: func(e *HookEvent) {
+			created = e
+			e.Resp[`enriched`] = true
+		},
+		OnJoin: func(e *HookEvent) {
+			joined = e
+		},
+		AfterJoin: func(e *HookEvent) {
+			afterJoin = e
+		},
+	}))
+
+	w := serveTestRequest(`POST`, _CREATE, ``)
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, Json{_ID: `test_entity_id`, `enriched`: true}, resp, `after create should be able to change the response`)
+	assert.Equal(t, tes.entity, created.Entity, `after create should get the created entity`)
+	assert.Equal(t, `test_creator_user_id`, created.UserId, `after create should get the creator`)
+
+	tss.session.Values = map[interface{}]interface{}{}
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"test_entity_id"}`)
+	assert.Equal(t, `test_user_id`, joined.UserId, `on join should get the new user`)
+	assert.Equal(t, `test_entity_id`, joined.EntityId, `on join should get the entity id`)
+	assert.Equal(t, Json{_VERSION: 0}, afterJoin.Resp, `after join should get the response`)
+
+	joined = nil
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"test_entity_id"}`)
+	assert.Nil(t, joined, `on join should not run when the user is already in the entity`)
+}
+
+func Test_hooks_vetoing_create_join_poll_and_leave(t *testing.T) {
+	veto := NewError(CodeForbidden, `test_veto`)
+	setupServer(nil, Config{}, Hook(Hooks{
+		BeforeCreate: func(e *HookEvent) error { return veto },
+		BeforeJoin: func(e *HookEvent) error { return veto },
+		BeforePoll: func(e *HookEvent) error { return veto },
+		BeforeLeave: func(e *HookEvent) error { return veto },
+		OnLeave: func(e *HookEvent) { t.Error(`on leave should not run after a veto`) },
+	}))
+	tes.Create()
+
+	assert.Equal(t, 403, serveTestRequest(`POST`, _CREATE, ``).Code, `create should be vetoed`)
+	assert.Equal(t, 403, serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"test_entity_id"}`).Code, `join should be vetoed`)
+	assert.Equal(t, 403, serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":-1}`).Code, `poll should be vetoed`)
+
+	s, _ := tss.Get(nil, ``)
+	s.Values[_USER_ID] = `test_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+	assert.Equal(t, 403, serveTestRequest(`POST`, _LEAVE, ``).Code, `leave should be vetoed`)
+	assert.Equal(t, `test_entity_id`, testSessionValue(_ENTITY_ID), `session should not be cleared`)
+}
+
+func Test_hooks_on_leave(t *testing.T) {
+	var left *HookEvent
+	setupServer(nil, Config{}, Hook(Hooks{
+		OnLeave: func(e *HookEvent) {
+			left = e
+		},
+	}))
+	tes.Create()
+	s, _ := tss.Get(nil, ``)
+	s.Values[_USER_ID] = `test_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	serveTestRequest(`POST`, _LEAVE, ``)
+
+	assert.Equal(t, `test_user_id`, left.UserId, `on leave should get the user who left`)
+	assert.Equal(t, tes.entity, left.Entity, `on leave should get the updated entity`)
+}
+
+func Test_hooks_with_entity_before_change(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	events := map[string]*HookEvent{}
+	setupServer(store, Config{
+		Entity: &storeTestEntity{},
+		PerformAct: func(json Json, userId string, e Entity)error{
+			e.(*storeTestEntity).Version++
+			return nil
+		},
+	}, Hook(Hooks{
+		OnJoin: func(e *HookEvent) {
+			events[`join`] = e
+		},
+		AfterAct: func(e *HookEvent) {
+			events[`act`] = e
+		},
+		OnLeave: func(e *HookEvent) {
+			events[`leave`] = e
+		},
+		AfterJoin: func(e *HookEvent) {
+			events[`afterJoin`] = e
+		},
+	}))
+	entityId, _, _ := store.Create()
+
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	serveTestRequest(`POST`, _ACT, `{}`)
+	serveTestRequest(`POST`, _LEAVE, ``)
+
+	assert.Equal(t, &storeTestEntity{}, events[`join`].Before, `on join should get the entity before the user was registered`)
+	assert.Equal(t, &storeTestEntity{Version: 1, Users: []string{`test_user_1`}}, events[`join`].Entity, `on join should get the updated entity`)
+	assert.Equal(t, 1, events[`act`].Before.GetVersion(), `after act should get the entity before the act`)
+	assert.Equal(t, 2, events[`act`].Entity.GetVersion(), `after act should get the updated entity`)
+	assert.Equal(t, []string{`test_user_1`}, events[`leave`].Before.(*storeTestEntity).Users, `on leave should get the entity before the user was unregistered`)
+	assert.Empty(t, events[`leave`].Entity.(*storeTestEntity).Users, `on leave should get the updated entity`)
+	assert.Nil(t, events[`afterJoin`].Before, `other hooks should not get the entity before`)
+}
+
+func Test_hooks_on_kick_and_entity_inactive(t *testing.T) {
+	var kicked, inactive, polled *HookEvent
+	setupServer(nil, Config{}, Hook(Hooks{
+		OnKick: func(e *HookEvent) {
+			kicked = e
+		},
+		OnEntityInactive: func(e *HookEvent) {
+			inactive = e
+		},
+		AfterPoll: func(e *HookEvent) {
+			polled = e
+			e.Resp[`enriched`] = true
+		},
+	}))
+	tes.Create()
+	version, active := 0, true
+	tes.entity.getVersion = func() int { return version }
+	tes.entity.isActive = func() bool { return active }
+	tes.entity.kick = func() bool {
+		version, active = 1, false
+		return true
+	}
+
+	w := serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":0}`)
+
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, OpKick, kicked.Op, `on kick should run`)
+	assert.Nil(t, kicked.Request, `on kick should not get a request`)
+	assert.Equal(t, `test_entity_id`, inactive.EntityId, `on entity inactive should run`)
+	assert.Equal(t, OpPoll, polled.Op, `after poll should run`)
+	assert.Equal(t, true, resp[`enriched`], `after poll should be able to change the response`)
+
+	inactive = nil
+	tes.updateErr = errors.New(`test_update_error`)
+	version, active = 0, true
+	serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"test_entity_id","`+_VERSION+`":0}`)
+	assert.Nil(t, inactive, `on entity inactive should not run when the update fails`)
+}
@@ -0,0 +1,171 @@
+package oak
+
+import(
+	`fmt`
+	`sync`
+	`time`
+	`context`
+	`net/http`
+	`crypto/sha256`
+	`encoding/hex`
+	js `encoding/json`
+)
+
+const (
+	_IDEMPOTENCY_KEY_HEADER	= `Idempotency-Key`
+	_IDEMPOTENCY_KEY		= `idempotencyKey`
+	_IDEMPOTENT_REPLAYED	= `Idempotent-Replayed`
+
+	_MAX_IDEMPOTENCY_KEY_LENGTH = 255
+)
+
+// IdempotencyStore remembers the responses of acts sent with an idempotency key so retried acts
+// are answered with the original response rather than being performed again. Keys are scoped to
+// the entity and user so clients only need them to be unique among their own acts. The remembered
+// resp also holds a hash of the act so stores need only keep the bytes they are given.
+type IdempotencyStore interface{
+	Get(ctx context.Context, entityId string, userId string, key string) (resp []byte, found bool, err error)
+	Put(ctx context.Context, entityId string, userId string, key string, resp []byte) error
+}
+
+// Idempotency enables idempotency keys for /act, sent in the Idempotency-Key header or, over
+// websockets, as the act's "idempotencyKey" value. Duplicates are serialised within this process,
+// if Put fails after the act was stored a retry performs the act again. A key reused for an act
+// with different json is refused with CodeConflict.
+func Idempotency(store IdempotencyStore) Option {
+	return func(o *options) {
+		o.idempotencyStore = store
+	}
+}
+
+// getIdempotencyKey takes the key from the request header or json, removing it from the json so it is not seen as part of the act.
+func getIdempotencyKey(r *http.Request, json Json) (string, error) {
+	key := r.Header.Get(_IDEMPOTENCY_KEY_HEADER)
+	if val, exists := json[_IDEMPOTENCY_KEY]; exists {
+		delete(json, _IDEMPOTENCY_KEY)
+		if key == `` {
+			str, ok := val.(string)
+			if !ok {
+				return ``, NewError(CodeBadRequest, _IDEMPOTENCY_KEY + ` must be a string value`)
+			}
+			key = str
+		}
+	}
+	if len(key) > _MAX_IDEMPOTENCY_KEY_LENGTH {
+		return ``, NewError(CodeBadRequest, `idempotency key must be at most 255 characters`)
+	}
+	return key, nil
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore keeping responses in process memory for a fixed time.
+type MemoryIdempotencyStore struct{
+	mtx sync.Mutex
+	ttl time.Duration
+	lastSweep time.Time
+	records map[string]*idempotencyRecord
+}
+
+type idempotencyRecord struct{
+	resp []byte
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore returns a store which remembers responses for ttl.
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl: ttl,
+		lastSweep: time.Now(),
+		records: map[string]*idempotencyRecord{},
+	}
+}
+
+func (mis *MemoryIdempotencyStore) Get(ctx context.Context, entityId string, userId string, key string) ([]byte, bool, error) {
+	mis.mtx.Lock()
+	defer mis.mtx.Unlock()
+	record, exists := mis.records[idempotencyRecordKey(entityId, userId, key)]
+	if !exists || time.Now().After(record.expires) {
+		return nil, false, nil
+	}
+	return record.resp, true, nil
+}
+
+func (mis *MemoryIdempotencyStore) Put(ctx context.Context, entityId string, userId string, key string, resp []byte) error {
+	mis.mtx.Lock()
+	defer mis.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(mis.lastSweep) > mis.ttl {
+		for recordKey, record := range mis.records {
+			if now.After(record.expires) {
+				delete(mis.records, recordKey)
+			}
+		}
+		mis.lastSweep = now
+	}
+	mis.records[idempotencyRecordKey(entityId, userId, key)] = &idempotencyRecord{
+		resp: resp,
+		expires: now.Add(mis.ttl),
+	}
+	return nil
+}
+
+// idempotentResp is what is remembered for an act's idempotency key, the act's hash tells a retry
+// from a different act reusing the key.
+type idempotentResp struct{
+	ActHash string `json:"actHash"`
+	Resp Json `json:"resp"`
+}
+
+// hashAct hashes the act's json, which marshals with its keys sorted so the same act from any codec
+// has the same hash. Values json can't marshal are hashed as formatted, which also sorts map keys.
+func hashAct(json Json) string {
+	data, err := js.Marshal(json)
+	if err != nil {
+		data = []byte(fmt.Sprint(json))
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func idempotencyRecordKey(entityId string, userId string, key string) string {
+	return entityId + "\x00" + userId + "\x00" + key
+}
+
+// keyedMutex serialises work on the same key, locks are dropped once no one holds or waits for them.
+type keyedMutex struct{
+	mtx sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct{
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{
+		locks: map[string]*keyedLock{},
+	}
+}
+
+// lock blocks until key is free and returns the func to free it.
+func (km *keyedMutex) lock(key string) func() {
+	km.mtx.Lock()
+	lock, exists := km.locks[key]
+	if !exists {
+		lock = &keyedLock{}
+		km.locks[key] = lock
+	}
+	lock.refs++
+	km.mtx.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		km.mtx.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mtx.Unlock()
+	}
+}
@@ -0,0 +1,208 @@
+package oak
+
+import(
+	`sync`
+	`time`
+	`errors`
+	`strings`
+	`context`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_act_with_idempotency_key_replays_response(t *testing.T) {
+	actCount := 0
+	w, r := setup(nil, func(userId string, e Entity)Json{return Json{"acts": actCount}}, func(json Json, userId string, e Entity)error{
+		actCount++
+		return nil
+	}, _ACT, `{}`, Idempotency(NewMemoryIdempotencyStore(time.Minute)))
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+	r.Header.Set(_IDEMPOTENCY_KEY_HEADER, `test_key`)
+
+	tr.ServeHTTP(w, r)
+	w2 := httptest.NewRecorder()
+	r2, _ := http.NewRequest(`POST`, _ACT, nil)
+	r2.Header.Set(_IDEMPOTENCY_KEY_HEADER, `test_key`)
+	tr.ServeHTTP(w2, r2)
+
+	assert.Equal(t, 1, actCount, `act should only have been performed once`)
+	assert.Equal(t, w.Body.String(), w2.Body.String(), `duplicate should get the original response`)
+	assert.Equal(t, `true`, w2.Header().Get(_IDEMPOTENT_REPLAYED), `duplicate should be marked as replayed`)
+	assert.Equal(t, ``, w.Header().Get(_IDEMPOTENT_REPLAYED), `original should not be marked as replayed`)
+
+	r3, _ := http.NewRequest(`POST`, _ACT, nil)
+	r3.Header.Set(_IDEMPOTENCY_KEY_HEADER, `test_other_key`)
+	tr.ServeHTTP(httptest.NewRecorder(), r3)
+	assert.Equal(t, 2, actCount, `a new key should perform the act`)
+
+	s.Values[_USER_ID] = `test_other_user_id`
+	tr.ServeHTTP(httptest.NewRecorder(), r2)
+	assert.Equal(t, 3, actCount, `keys should be scoped to the user`)
+}
+
+func Test_act_with_idempotency_key_in_json(t *testing.T) {
+	var acts []Json
+	w, r := setup(nil, func(userId string, e Entity)Json{return Json{}}, func(json Json, userId string, e Entity)error{
+		acts = append(acts, json)
+		return nil
+	}, _ACT, `{"`+_IDEMPOTENCY_KEY+`":"test_key","move":1}`, Idempotency(NewMemoryIdempotencyStore(time.Minute)))
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	tr.ServeHTTP(w, r)
+	w = serveTestRequest(`POST`, _ACT, `{"`+_IDEMPOTENCY_KEY+`":"test_key","move":1}`)
+
+	assert.Equal(t, []Json{{`move`: 1.0}}, acts, `act should have been performed once without the key`)
+	assert.Equal(t, `true`, w.Header().Get(_IDEMPOTENT_REPLAYED), `duplicate should be marked as replayed`)
+}
+
+func Test_act_with_idempotency_key_reused_for_a_different_act(t *testing.T) {
+	var acts []Json
+	w, r := setup(nil, func(userId string, e Entity)Json{return Json{}}, func(json Json, userId string, e Entity)error{
+		acts = append(acts, json)
+		return nil
+	}, _ACT, `{"move":1,"piece":"a"}`, Idempotency(NewMemoryIdempotencyStore(time.Minute)))
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+	r.Header.Set(_IDEMPOTENCY_KEY_HEADER, `test_key`)
+
+	tr.ServeHTTP(w, r)
+	w = serveTestRequest(`POST`, _ACT, `{"`+_IDEMPOTENCY_KEY+`":"test_key","move":2,"piece":"a"}`)
+	assertTestError(t, w, CodeConflict, `idempotency key was used for a different act`)
+	w = serveTestRequest(`POST`, _ACT, `{"`+_IDEMPOTENCY_KEY+`":"test_key","piece":"a","move":1}`)
+	assert.Equal(t, `true`, w.Header().Get(_IDEMPOTENT_REPLAYED), `the same act with its values in another order should be replayed`)
+
+	assert.Equal(t, []Json{{`move`: 1.0, `piece`: `a`}}, acts, `act should only have been performed once`)
+}
+
+func Test_act_with_idempotency_key_and_failed_act(t *testing.T) {
+	actCount := 0
+	w, r := setup(nil, func(userId string, e Entity)Json{return Json{}}, func(json Json, userId string, e Entity)error{
+		actCount++
+		if actCount == 1 {
+			return errors.New(`test_perform_act_error`)
+		}
+		return nil
+	}, _ACT, `{"`+_IDEMPOTENCY_KEY+`":"test_key"}`, Idempotency(NewMemoryIdempotencyStore(time.Minute)))
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	tr.ServeHTTP(w, r)
+	w = serveTestRequest(`POST`, _ACT, `{"`+_IDEMPOTENCY_KEY+`":"test_key"}`)
+
+	assert.Equal(t, 2, actCount, `failed acts should not be remembered`)
+	assert.Equal(t, 200, w.Code, `retry should succeed`)
+}
+
+func Test_act_with_invalid_idempotency_keys(t *testing.T) {
+	for _, test := range []struct{
+		reqJson string
+		message string
+	}{
+		{`{"`+_IDEMPOTENCY_KEY+`":1}`, _IDEMPOTENCY_KEY + ` must be a string value`},
+		{`{"`+_IDEMPOTENCY_KEY+`":"` + strings.Repeat(`a`, 256) + `"}`, `idempotency key must be at most 255 characters`},
+	} {
+		w, r := setup(nil, nil, nil, _ACT, test.reqJson, Idempotency(NewMemoryIdempotencyStore(time.Minute)))
+		s, _ := tss.Get(r, ``)
+		s.Values[_USER_ID] = `test_pre_set_user_id`
+		s.Values[_ENTITY_ID] = `test_entity_id`
+
+		tr.ServeHTTP(w, r)
+
+		assertTestError(t, w, CodeBadRequest, test.message)
+	}
+}
+
+func Test_act_with_idempotency_store_error(t *testing.T) {
+	w, r := setup(nil, nil, nil, _ACT, `{"`+_IDEMPOTENCY_KEY+`":"test_key"}`, Idempotency(&failingIdempotencyStore{}))
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeInternal, `test_idempotency_error`)
+}
+
+func Test_act_with_concurrent_duplicates(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	var mtx sync.Mutex
+	actCount := 0
+	tss = &testSessionStore{}
+	tr = mux.NewRouter()
+	NewServer(Config{
+		SessionStore: tss,
+		SessionName: `test_session`,
+		Entity: &storeTestEntity{},
+		EntityStoreFactory: func(r *http.Request)EntityStore{return store},
+		GetEntityChangeResp: func(userId string, e Entity)Json{return Json{}},
+		PerformAct: func(json Json, userId string, e Entity)error{
+			mtx.Lock()
+			actCount++
+			mtx.Unlock()
+			e.(*storeTestEntity).Version++
+			return nil
+		},
+	}, Idempotency(NewMemoryIdempotencyStore(time.Minute)), Retry(RetryPolicy{MaxAttempts: 20})).Route(tr)
+	entityId, _, _ := store.Create()
+	tss.Get(nil, ``)
+	tss.session.Values[_USER_ID] = `test_user_id`
+	tss.session.Values[_ENTITY_ID] = entityId
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveTestRequest(`POST`, _ACT, `{"`+_IDEMPOTENCY_KEY+`":"test_key"}`)
+		}()
+	}
+	wg.Wait()
+
+	entity, _ := store.Read(entityId)
+	assert.Equal(t, 1, entity.GetVersion(), `act should only have been stored once`)
+	assert.Equal(t, 1, actCount, `act should only have been performed once`)
+}
+
+func Test_memory_idempotency_store_expiry(t *testing.T) {
+	store := NewMemoryIdempotencyStore(20 * time.Millisecond)
+	ctx := context.Background()
+	store.Put(ctx, `test_entity_id`, `test_user_id`, `test_key`, []byte(`{}`))
+
+	resp, found, _ := store.Get(ctx, `test_entity_id`, `test_user_id`, `test_key`)
+	assert.True(t, found, `response should be found`)
+	assert.Equal(t, []byte(`{}`), resp, `response should be returned`)
+
+	time.Sleep(30 * time.Millisecond)
+	_, found, _ = store.Get(ctx, `test_entity_id`, `test_user_id`, `test_key`)
+	assert.False(t, found, `expired responses should not be found`)
+
+	store.Put(ctx, `test_entity_id`, `test_user_id`, `test_other_key`, []byte(`{}`))
+	assert.Equal(t, 1, len(store.records), `expired responses should be swept`)
+}
+
+/**
+ * helpers
+ */
+
+type failingIdempotencyStore struct{}
+
+func (s *failingIdempotencyStore) Get(ctx context.Context, entityId string, userId string, key string) ([]byte, bool, error) {
+	return nil, false, errors.New(`test_idempotency_error`)
+}
+
+func (s *failingIdempotencyStore) Put(ctx context.Context, entityId string, userId string, key string, resp []byte) error {
+	return errors.New(`test_idempotency_error`)
+}
@@ -0,0 +1,117 @@
+package oak
+
+import(
+	`sync`
+	`bytes`
+	`crypto/rand`
+	`encoding/hex`
+	`encoding/gob`
+)
+
+// MemoryEntityStore is a concurrency safe EntityStore holding gob encoded copies of its entities
+// in process memory, so callers never share state with the store or each other.
+// Update only succeeds when the entity's version is exactly one past the stored version.
+type MemoryEntityStore struct{
+	mtx sync.RWMutex
+	newEntity func() Entity
+	records map[string]*memoryRecord
+}
+
+type memoryRecord struct{
+	version int
+	data []byte
+}
+
+// NewMemoryEntityStore returns an empty store, newEntity must return a fresh entity for each call to Create.
+func NewMemoryEntityStore(newEntity func() Entity) *MemoryEntityStore {
+	gob.Register(newEntity())
+	return &MemoryEntityStore{
+		newEntity: newEntity,
+		records: map[string]*memoryRecord{},
+	}
+}
+
+func (mes *MemoryEntityStore) Create() (entityId string, entity Entity, err error) {
+	entity = mes.newEntity()
+	data, err := encodeEntity(entity)
+	if err != nil {
+		return ``, nil, err
+	}
+	mes.mtx.Lock()
+	defer mes.mtx.Unlock()
+	for entityId == `` {
+		if entityId, err = newEntityId(); err != nil {
+			return ``, nil, err
+		}
+		if _, exists := mes.records[entityId]; exists {
+			entityId = ``
+		}
+	}
+	mes.records[entityId] = &memoryRecord{
+		version: entity.GetVersion(),
+		data: data,
+	}
+	entity, err = decodeEntity(data)
+	return
+}
+
+func (mes *MemoryEntityStore) Read(entityId string) (Entity, error) {
+	mes.mtx.RLock()
+	record, exists := mes.records[entityId]
+	mes.mtx.RUnlock()
+	if !exists {
+		return nil, errEntityNotFound(entityId)
+	}
+	return decodeEntity(record.data)
+}
+
+func (mes *MemoryEntityStore) Update(entityId string, entity Entity) error {
+	data, err := encodeEntity(entity)
+	if err != nil {
+		return err
+	}
+	mes.mtx.Lock()
+	defer mes.mtx.Unlock()
+	record, exists := mes.records[entityId]
+	if !exists {
+		return errEntityNotFound(entityId)
+	}
+	if entity.GetVersion() != record.version + 1 {
+		return &ErrNonsequentialUpdate{
+			EntityId: entityId,
+			ExpectedVersion: record.version + 1,
+			ActualVersion: entity.GetVersion(),
+		}
+	}
+	mes.records[entityId] = &memoryRecord{
+		version: entity.GetVersion(),
+		data: data,
+	}
+	return nil
+}
+
+func newEntityId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ``, err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// encodeEntity gob encodes entity as an interface value so it can be decoded
+// without knowing its concrete type, the type must have been registered with gob.
+func encodeEntity(entity Entity) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&entity); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeEntity(data []byte) (Entity, error) {
+	var entity Entity
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entity); err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
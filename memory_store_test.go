@@ -0,0 +1,171 @@
+package oak
+
+import(
+	`sync`
+	`strconv`
+	`testing`
+	`net/http`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_memory_store_create_and_read(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{Creator: `test_creator_user_id`}})
+
+	entityId, entity, err := store.Create()
+	assert.Nil(t, err, `create should not error`)
+	assert.Equal(t, 32, len(entityId), `entity id should be generated`)
+	assert.Equal(t, `test_creator_user_id`, entity.CreatedBy(), `created entity should be returned`)
+
+	read, err := store.Read(entityId)
+	assert.Nil(t, err, `read should not error`)
+	assert.Equal(t, entity, read, `read entity should equal the created entity`)
+
+	otherId, _, _ := store.Create()
+	assert.NotEqual(t, entityId, otherId, `entity ids should be unique`)
+}
+
+func Test_memory_store_copies_entities(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	entityId, entity, _ := store.Create()
+
+	entity.(*storeTestEntity).Users = append(entity.(*storeTestEntity).Users, `test_user_id`)
+	read, _ := store.Read(entityId)
+	assert.Empty(t, read.(*storeTestEntity).Users, `mutating a created entity should not change the store`)
+
+	read.(*storeTestEntity).Version = 1
+	store.Update(entityId, read)
+	read.(*storeTestEntity).Users = []string{`test_user_id`}
+	reread, _ := store.Read(entityId)
+	assert.Equal(t, 1, reread.GetVersion(), `update should be stored`)
+	assert.Empty(t, reread.(*storeTestEntity).Users, `mutating an updated entity should not change the store`)
+	assert.False(t, read == reread, `each read should return a new copy`)
+}
+
+func Test_memory_store_update_requires_next_version(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	entityId, _, _ := store.Create()
+
+	err := store.Update(entityId, &storeTestEntity{Version: 2})
+	assert.Equal(t, &ErrNonsequentialUpdate{EntityId: entityId, ExpectedVersion: 1, ActualVersion: 2}, err, `skipping a version should be nonsequential`)
+
+	err = store.Update(entityId, &storeTestEntity{Version: 0})
+	assert.True(t, isNonsequentialUpdate(err), `repeating a version should be nonsequential`)
+
+	assert.Nil(t, store.Update(entityId, &storeTestEntity{Version: 1}), `next version should be accepted`)
+	assert.True(t, isNonsequentialUpdate(store.Update(entityId, &storeTestEntity{Version: 1})), `stale version should be nonsequential`)
+}
+
+func Test_memory_store_with_unknown_entity(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+
+	_, err := store.Read(`test_entity_id`)
+	assert.Equal(t, `no entity with id "test_entity_id"`, err.Error(), `read should error`)
+
+	err = store.Update(`test_entity_id`, &storeTestEntity{Version: 1})
+	assert.Equal(t, `no entity with id "test_entity_id"`, err.Error(), `update should error`)
+}
+
+func Test_memory_store_with_unencodable_entity(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &testEntity{}})
+
+	_, _, err := store.Create()
+	assert.NotNil(t, err, `create should error`)
+
+	err = store.Update(`test_entity_id`, &testEntity{})
+	assert.NotNil(t, err, `update should error`)
+}
+
+func Test_memory_store_concurrent_updates(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	entityId, _, _ := store.Create()
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	succeeded := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entity, _ := store.Read(entityId)
+			entity.(*storeTestEntity).Version++
+			if store.Update(entityId, entity) == nil {
+				mtx.Lock()
+				succeeded++
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	entity, _ := store.Read(entityId)
+	assert.Equal(t, succeeded, entity.GetVersion(), `only sequential updates should succeed`)
+}
+
+func Test_memory_store_with_server(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{Creator: `test_creator_user_id`}})
+	tss = &testSessionStore{}
+	tr = mux.NewRouter()
+	NewServer(Config{
+		SessionStore: tss,
+		SessionName: `test_session`,
+		Entity: &storeTestEntity{},
+		EntityStoreFactory: func(r *http.Request)EntityStore{return store},
+		GetJoinResp: func(userId string, e Entity)Json{return Json{`users`: e.(*storeTestEntity).Users}},
+		GetEntityChangeResp: func(userId string, e Entity)Json{return Json{}},
+		PerformAct: func(json Json, userId string, e Entity)error{return nil},
+	}).Route(tr)
+	entityId, _, _ := store.Create()
+
+	w := serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, 1, int(resp[_VERSION].(float64)), `join should have updated the stored entity`)
+	assert.Equal(t, []interface{}{`test_user_1`}, resp[`users`], `join should have registered the user`)
+	entity, _ := store.Read(entityId)
+	assert.Equal(t, []string{`test_user_1`}, entity.(*storeTestEntity).Users, `registration should be stored`)
+}
+
+/**
+ * helpers
+ */
+
+type storeTestEntity struct{
+	Version int
+	Creator string
+	Users []string
+}
+
+func (e *storeTestEntity) GetVersion() int {
+	return e.Version
+}
+
+func (e *storeTestEntity) IsActive() bool {
+	return true
+}
+
+func (e *storeTestEntity) CreatedBy() string {
+	return e.Creator
+}
+
+func (e *storeTestEntity) RegisterNewUser() (string, error) {
+	e.Version++
+	userId := `test_user_` + strconv.Itoa(len(e.Users) + 1)
+	e.Users = append(e.Users, userId)
+	return userId, nil
+}
+
+func (e *storeTestEntity) UnregisterUser(userId string) error {
+	e.Version++
+	for i, user := range e.Users {
+		if user == userId {
+			e.Users = append(e.Users[:i], e.Users[i + 1:]...)
+		}
+	}
+	return nil
+}
+
+func (e *storeTestEntity) Kick() bool {
+	return false
+}
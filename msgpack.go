@@ -0,0 +1,267 @@
+package oak
+
+import(
+	`fmt`
+	`math`
+	`encoding/binary`
+	js `encoding/json`
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return _MSGPACK_CONTENT_TYPE
+}
+
+func (msgpackCodec) Marshal(obj interface{}) ([]byte, error) {
+	val, err := toGeneric(obj)
+	if err != nil {
+		return nil, err
+	}
+	return appendMsgpack(nil, val)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, obj interface{}) error {
+	d := &binaryReader{data: data}
+	val, err := decodeMsgpack(d)
+	if err == nil {
+		err = d.end()
+	}
+	if err != nil {
+		return fmt.Errorf(`invalid msgpack: %w`, err)
+	}
+	return fromGeneric(val, obj)
+}
+
+func appendMsgpack(buf []byte, val interface{}) ([]byte, error) {
+	var err error
+	switch v := val.(type) {
+	case nil:
+		buf = append(buf, 0xc0)
+	case bool:
+		if v {
+			buf = append(buf, 0xc3)
+		} else {
+			buf = append(buf, 0xc2)
+		}
+	case string:
+		buf = appendMsgpackStr(buf, v)
+	case js.Number:
+		i, u, f, kind, err := numberKind(v)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case 'i':
+			buf = appendMsgpackInt(buf, i)
+		case 'u':
+			buf = appendMsgpackUint(buf, u)
+		default:
+			buf = binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(f))
+		}
+	case []interface{}:
+		buf = appendMsgpackLen(buf, uint64(len(v)), 0x90, 0xdc)
+		for _, item := range v {
+			if buf, err = appendMsgpack(buf, item); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		buf = appendMsgpackLen(buf, uint64(len(v)), 0x80, 0xde)
+		for _, key := range sortedKeys(v) {
+			buf = appendMsgpackStr(buf, key)
+			if buf, err = appendMsgpack(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf(`msgpack can't encode %T`, val)
+	}
+	return buf, nil
+}
+
+func appendMsgpackStr(buf []byte, str string) []byte {
+	n := len(str)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, str...)
+}
+
+// appendMsgpackLen appends the header of an array or map, fix is its code for under 16 items
+// and code16 its code for 16 bit lengths, which is followed by the 32 bit code.
+func appendMsgpackLen(buf []byte, n uint64, fix byte, code16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix | byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, code16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, code16 + 1), uint32(n))
+}
+
+func appendMsgpackUint(buf []byte, u uint64) []byte {
+	switch {
+	case u <= 0x7f:
+		return append(buf, byte(u))
+	case u <= math.MaxUint8:
+		return append(buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(u))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xcf), u)
+}
+
+func appendMsgpackInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendMsgpackUint(buf, uint64(i))
+	case i >= -32:
+		return append(buf, byte(i))
+	case i >= math.MinInt8:
+		return append(buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(i))
+}
+
+func decodeMsgpack(d *binaryReader) (interface{}, error) {
+	b, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7f:
+		return float64(b), nil
+	case b <= 0x8f:
+		return decodeMsgpackMap(d, uint64(b & 0x0f))
+	case b <= 0x9f:
+		return decodeMsgpackArray(d, uint64(b & 0x0f))
+	case b <= 0xbf:
+		return decodeMsgpackStr(d, uint64(b & 0x1f))
+	case b >= 0xe0:
+		return float64(int8(b)), nil
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bs, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, bs...), nil
+	case 0xca:
+		bits, err := d.readUint(4)
+		if err != nil {
+			return nil, err
+		}
+		return finite(float64(math.Float32frombits(uint32(bits))))
+	case 0xcb:
+		bits, err := d.readUint(8)
+		if err != nil {
+			return nil, err
+		}
+		return finite(math.Float64frombits(bits))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.readUint(1 << (b - 0xcc))
+		return float64(u), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		u, err := d.readUint(size)
+		//sign extend from the top bit of the value
+		shift := 64 - 8 * size
+		return float64(int64(u << shift) >> shift), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackStr(d, n)
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackArray(d, n)
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackMap(d, n)
+	}
+	return nil, fmt.Errorf(`unsupported type 0x%x`, b)
+}
+
+func decodeMsgpackStr(d *binaryReader, n uint64) (interface{}, error) {
+	bs, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(bs), nil
+}
+
+func decodeMsgpackArray(d *binaryReader, n uint64) (interface{}, error) {
+	if err := d.checkLen(n, 1); err != nil {
+		return nil, err
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	arr := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		item, err := decodeMsgpack(d)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, item)
+	}
+	return arr, nil
+}
+
+func decodeMsgpackMap(d *binaryReader, n uint64) (interface{}, error) {
+	if err := d.checkLen(n, 2); err != nil {
+		return nil, err
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := decodeMsgpack(d)
+		if err != nil {
+			return nil, err
+		}
+		str, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf(`map key %v is not a string`, key)
+		}
+		if m[str], err = decodeMsgpack(d); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
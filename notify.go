@@ -0,0 +1,85 @@
+package oak
+
+import(
+	`sync`
+)
+
+// notifier is an in process broadcaster of entity changes, every successful
+// EntityStore.Update made by oak signals all current subscribers of that entityId.
+type notifier struct{
+	mtx sync.Mutex
+	signals map[string]*signal
+}
+
+type signal struct{
+	changed chan struct{}
+	subscribers int
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		signals: map[string]*signal{},
+	}
+}
+
+// subscription waits for changes to a single entity, changed is closed on the next
+// change after which renew must be called to wait for any further changes.
+// cancel must always be called once the subscriber is done waiting.
+type subscription struct{
+	notifier *notifier
+	entityId string
+	signal *signal
+	changed <-chan struct{}
+}
+
+func (n *notifier) subscribe(entityId string) *subscription {
+	sub := &subscription{
+		notifier: n,
+		entityId: entityId,
+	}
+	sub.renew()
+	return sub
+}
+
+func (sub *subscription) renew() {
+	n := sub.notifier
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.release(sub)
+	s, exists := n.signals[sub.entityId]
+	if !exists {
+		s = &signal{changed: make(chan struct{})}
+		n.signals[sub.entityId] = s
+	}
+	s.subscribers++
+	sub.signal = s
+	sub.changed = s.changed
+}
+
+func (sub *subscription) cancel() {
+	n := sub.notifier
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.release(sub)
+}
+
+func (n *notifier) release(sub *subscription) {
+	if sub.signal == nil {
+		return
+	}
+	s := sub.signal
+	sub.signal = nil
+	s.subscribers--
+	if s.subscribers == 0 && n.signals[sub.entityId] == s {
+		delete(n.signals, sub.entityId)
+	}
+}
+
+func (n *notifier) notify(entityId string) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if s, exists := n.signals[entityId]; exists {
+		close(s.changed)
+		delete(n.signals, entityId)
+	}
+}
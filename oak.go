@@ -1,10 +1,12 @@
 package oak
 
 import(
+	`io`
+	`fmt`
+	`sort`
 	`errors`
-	`strings`
+	`strconv`
 	`net/http`
-	`encoding/gob`
 	js `encoding/json`
 	`github.com/gorilla/mux`
 	`github.com/gorilla/sessions`
@@ -13,16 +15,26 @@ import(
 const (
 	_CREATE = `/create`
 	_JOIN 	= `/join`
+	_WATCH	= `/watch`
 	_POLL 	= `/poll`
+	_STREAM	= `/stream`
+	_SOCKET	= `/socket`
 	_ACT 	= `/act`
 	_LEAVE 	= `/leave`
 
 	_USER_ID	= `userId`
 	_ENTITY_ID	= `entityId`
 	_ENTITY		= `entity`
+	_SPECTATOR	= `spectator`
+	_ENTITIES	= `entities`
 
 	_ID			= `id`
 	_VERSION	= `v`
+	_TYPE		= `type`
+	_DELTA		= `delta`
+	_PATCH		= `patch`
+
+	_LAST_EVENT_ID	= `Last-Event-ID`
 )
 
 type EntityStore interface{
@@ -46,294 +58,193 @@ type GetJoinResp func(userId string, e Entity) Json
 type GetEntityChangeResp func(userId string, e Entity) Json
 type PerformAct func(json Json, userId string, e Entity) (err error)
 
-func Route(router *mux.Router, sessionStore sessions.Store, sessionName string, entity Entity, entityStoreFactory EntityStoreFactory, getJoinResp GetJoinResp, getEntityChangeResp GetEntityChangeResp, performAct PerformAct){
-	gob.Register(entity)
-
-	getSession := func(w http.ResponseWriter, r *http.Request) (*session, error) {
-		s, err := sessionStore.Get(r, sessionName)
+// Route registers the oak handlers on router, it is equivalent to NewServer(Config{...}, opts...).Route(router).
+func Route(router *mux.Router, sessionStore sessions.Store, sessionName string, entity Entity, entityStoreFactory EntityStoreFactory, getJoinResp GetJoinResp, getEntityChangeResp GetEntityChangeResp, performAct PerformAct, opts ...Option){
+	NewServer(Config{
+		SessionStore: sessionStore,
+		SessionName: sessionName,
+		Entity: entity,
+		EntityStoreFactory: entityStoreFactory,
+		GetJoinResp: getJoinResp,
+		GetEntityChangeResp: getEntityChangeResp,
+		PerformAct: performAct,
+	}, opts...).Route(router)
+}
 
-		session := &session{
-			writer: w,
-			request: r,
-			internalSession: s,
-		}
+type session struct{
+	writer http.ResponseWriter
+	request *http.Request
+	internalSession *sessions.Session
+	withEntity bool
+	key string
+	entities map[string]*sessionEntry
+}
 
-		var val interface{}
-		var exists bool
+// sessionEntry is what a session holds for each entity its user is in, Entity is only kept with EntityInSession.
+type sessionEntry struct{
+	UserId string
+	Spectator bool
+	Entity Entity
+}
 
-		if val, exists = s.Values[_USER_ID]; exists {
-			session.userId = val.(string)
-		}else{
-			session.userId = ``
-		}
+// set records the user as a player of the entity alongside any other entities they are in.
+func (s *session) set(userId string, entityId string, entity Entity) error {
+	entry := &sessionEntry{UserId: userId}
+	if s.withEntity {
+		entry.Entity = entity
+	}
+	s.entities[entityId] = entry
+	return s.save()
+}
 
-		if val, exists = s.Values[_ENTITY_ID]; exists {
-			session.entityId = val.(string)
-		}else{
-			session.entityId = ``
-		}
+// spectate records the user as a spectator of the entity, spectators never have the entity in their session.
+func (s *session) spectate(spectatorId string, entityId string) error {
+	s.entities[entityId] = &sessionEntry{UserId: spectatorId, Spectator: true}
+	return s.save()
+}
 
-		if val, exists = s.Values[_ENTITY]; exists && val != nil {
-			session.entity = val.(Entity)
-		}else{
-			session.entity = nil
-		}
+// remove takes the entity out of the session.
+func (s *session) remove(entityId string) error {
+	delete(s.entities, entityId)
+	return s.save()
+}
 
-		return session, err
-	}
+func (s *session) clear() error {
+	s.entities = map[string]*sessionEntry{}
+	return s.save()
+}
 
-	fetchEntity := func(entityId string, entityStore EntityStore) (entity Entity, err error) {
-		retryCount := 0
-		for {
-			entity, err = entityStore.Read(entityId)
-			if err == nil {
-				if entity.Kick() {
-					err = entityStore.Update(entityId, entity)
-					if err != nil && retryCount == 0 && strings.Contains(err.Error(), `nonsequential update for entity with id "`+entityId+`"`) {
-						err = nil
-						retryCount++
-						continue
-					}
-				}
-			}
-			break
-		}
-		return
+// save writes the entities to the session under its key, leaving the entities of other entity types be.
+// The single entity values sessions used to hold are dropped once saved under the untyped key.
+func (s *session) save() error {
+	if s.internalSession.Values == nil {
+		s.internalSession.Values = map[interface{}]interface{}{}
 	}
-
-	create := func(w http.ResponseWriter, r *http.Request){
-		s, _ := getSession(w, r)
-		if s.isNotEngaged() {
-			entityStore := entityStoreFactory(r)
-			entityId, entity, err := entityStore.Create()
-			if err != nil {
-				writeError(w, err)
-				return
-			}
-			s.set(entity.CreatedBy(), entityId, entity)
-		}
-		writeJson(w, &Json{_ID: s.getEntityId()})
+	values := s.internalSession.Values
+	if s.key == _ENTITIES {
+		delete(values, _USER_ID)
+		delete(values, _ENTITY_ID)
+		delete(values, _ENTITY)
+		delete(values, _SPECTATOR)
 	}
-
-	join := func(w http.ResponseWriter, r *http.Request) {
-		entityId, _, err := getRequestData(r, false)
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		entityStore := entityStoreFactory(r)
-		entity, err := fetchEntity(entityId, entityStore)
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		s, _ := getSession(w, r)
-		if s.isNotEngaged() && entity.IsActive() {
-			if userId, err := entity.RegisterNewUser(); err == nil {
-				if err := entityStore.Update(entityId, entity); err == nil {
-					//entity was updated successfully this user is now active in this entity
-					s.set(userId, entityId, entity)
-				}
-			}
-		}
-
-		respJson := getJoinResp(s.getUserId(), entity)
-		respJson[_VERSION] = entity.GetVersion()
-		writeJson(w, &respJson)
+	if len(s.entities) > 0 {
+		values[s.key] = s.entities
+	} else {
+		delete(values, s.key)
 	}
+	return sessions.Save(s.request, s.writer)
+}
 
-	poll := func(w http.ResponseWriter, r *http.Request) {
-		entityId, version, err := getRequestData(r, true)
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		entityStore := entityStoreFactory(r)
-		entity, err := fetchEntity(entityId, entityStore)
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		if version == entity.GetVersion() {
-			return
-		}
-
-		s, _ := getSession(w, r)
-		userId := s.getUserId()
-		if s.getEntityId() == entityId {
-			if entity.IsActive() {
-				s.set(userId, entityId, entity)
-			} else {
-				s.clear()
-			}
-		}
-		respJson := getEntityChangeResp(userId, entity)
-		respJson[_VERSION] = entity.GetVersion()
-		writeJson(w, &respJson)
+// sync keeps the session in step with the latest version of one of its entities, removing it once it is inactive.
+func (s *session) sync(entityId string, entity Entity) error {
+	entry := s.entities[entityId]
+	if entry == nil {
+		return nil
 	}
-
-	act := func(w http.ResponseWriter, r *http.Request) {
-		s, _ := getSession(w, r)
-		userId := s.getUserId()
-		sessionEntity := s.getEntity()
-		if sessionEntity == nil {
-			writeError(w, errors.New(`no entity in session`))
-			return
-		}
-
-		json := readJson(r)
-		err := performAct(json, userId, sessionEntity)
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		entityStore := entityStoreFactory(r)
-		entityId := s.getEntityId()
-		entity, err := fetchEntity(entityId, entityStore)
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		if err = performAct(json, userId, entity); err != nil {
-			writeError(w, err)
-			return
-		}
-
-		if err = entityStore.Update(entityId, entity); err != nil {
-			writeError(w, err)
-			return
-		}
-
-		if entity.IsActive() {
-			s.set(s.getUserId(), entityId, entity)
-		} else {
-			s.clear()
-		}
-		respJson := getEntityChangeResp(userId, entity)
-		respJson[_VERSION] = entity.GetVersion()
-		writeJson(w, &respJson)
+	if !entity.IsActive() {
+		return s.remove(entityId)
 	}
-
-	leave := func(w http.ResponseWriter, r *http.Request) {
-		s, _ := getSession(w, r)
-		entityId := s.getEntityId()
-		sessionEntity := s.getEntity()
-		if sessionEntity == nil{
-			s.clear()
-			return
-		}
-
-		err := sessionEntity.UnregisterUser(s.getUserId())
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		entityStore := entityStoreFactory(r)
-		entity, err := entityStore.Read(entityId)
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		err = entity.UnregisterUser(s.getUserId())
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		err = entityStore.Update(entityId, entity)
-		if err != nil {
-			writeError(w, err)
-			return
-		}
-
-		s.clear()
+	if s.withEntity && !entry.Spectator {
+		return s.set(entry.UserId, entityId, entity)
 	}
-
-	router.Path(_CREATE).HandlerFunc(create)
-	router.Path(_JOIN).HandlerFunc(join)
-	router.Path(_POLL).HandlerFunc(poll)
-	router.Path(_ACT).HandlerFunc(act)
-	router.Path(_LEAVE).HandlerFunc(leave)
-}
-
-type session struct{
-	writer http.ResponseWriter
-	request *http.Request
-	internalSession *sessions.Session
-	userId string
-	entityId string
-	entity Entity
+	return nil
 }
 
-func (s *session) set(userId string, entityId string, entity Entity) error {
-	s.userId = userId
-	s.entityId = entityId
-	s.entity = entity
-	s.internalSession.Values = map[interface{}]interface{}{
-		_USER_ID: userId,
-		_ENTITY_ID: entityId,
-		_ENTITY: entity,
+// getUserId gives the user's id in the entity, empty if they are not in it.
+func (s *session) getUserId(entityId string) string {
+	if entry := s.entities[entityId]; entry != nil {
+		return entry.UserId
 	}
-	return sessions.Save(s.request, s.writer)
+	return ``
 }
 
-func (s *session) clear() error {
-	s.userId = ``
-	s.entityId = ``
-	s.entity = nil
-	s.internalSession.Values = map[interface{}]interface{}{}
-	return sessions.Save(s.request, s.writer)
-}
-
-func (s *session) isNotEngaged() bool {
-	return s.entity == nil || !s.entity.IsActive()
+func (s *session) getEntity(entityId string) Entity {
+	if entry := s.entities[entityId]; entry != nil {
+		return entry.Entity
+	}
+	return nil
 }
 
-func (s *session) getUserId() string {
-	return s.userId
+func (s *session) has(entityId string) bool {
+	return s.entities[entityId] != nil
 }
 
-func (s *session) getEntityId() string {
-	return s.entityId
+func (s *session) isSpectator(entityId string) bool {
+	entry := s.entities[entityId]
+	return entry != nil && entry.Spectator
 }
 
-func (s *session) getEntity() Entity {
-	return s.entity
+// entityIds gives the ids of the session's entities, sorted.
+func (s *session) entityIds() []string {
+	entityIds := make([]string, 0, len(s.entities))
+	for entityId := range s.entities {
+		entityIds = append(entityIds, entityId)
+	}
+	sort.Strings(entityIds)
+	return entityIds
 }
 
 type Json map[string]interface{}
 
-func writeJson(w http.ResponseWriter, obj interface{}) error{
-	js, err := js.Marshal(obj)
-	w.Header().Set(`Content-Type`, `application/json`)
-	w.Write(js)
+// writeJson writes obj with the codec negotiated for the response, JSON unless the client asked for another.
+func writeJson(w http.ResponseWriter, r *http.Request, obj interface{}) error{
+	codec := responseCodec(r)
+	data, err := codec.Marshal(obj)
+	setContentType(w, codec)
+	w.Write(data)
 	return err
 }
 
-func readJson(r *http.Request) Json {
+// readJson decodes the request body with the codec of its Content-Type, an empty body is an empty
+// object and a body which doesn't decode to an object is a bad request.
+func readJson(r *http.Request) (Json, error) {
 	json := Json{}
 	if r.Body == nil {
-		return json
+		return json, nil
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, NewError(CodeTooLarge, `request body must be at most ` + strconv.FormatInt(tooLarge.Limit, 10) + ` bytes`)
+		}
+		return nil, NewError(CodeBadRequest, `request body could not be read: ` + err.Error())
+	}
+	if len(data) == 0 {
+		return json, nil
 	}
-	decoder := js.NewDecoder(r.Body)
-	decoder.Decode(&json)
-	return json
+	if err = requestCodec(r).Unmarshal(data, &json); err != nil {
+		return nil, NewError(CodeBadRequest, `invalid request body: ` + err.Error())
+	}
+	if json == nil {
+		return nil, NewError(CodeBadRequest, `request body must be an object`)
+	}
+	return json, nil
+}
+
+func writeEvent(w http.ResponseWriter, id int, obj interface{}) error {
+	data, err := js.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", id, data)
+	return err
 }
 
-func writeError(w http.ResponseWriter, err error){
-	http.Error(w, err.Error(), 500)
+func writeError(w http.ResponseWriter, r *http.Request, err error){
+	e := AsError(err)
+	codec := responseCodec(r)
+	data, _ := codec.Marshal(e)
+	setContentType(w, codec)
+	w.Header().Set(`X-Content-Type-Options`, `nosniff`)
+	w.WriteHeader(e.Status())
+	w.Write(data)
 }
 
-func getRequestData(r *http.Request, isForPoll bool) (entityId string, version int, err error) {
-	reqJson := readJson(r)
+func getRequestData(r *http.Request, isForPoll bool) (entityId string, version int, reqJson Json, err error) {
+	if reqJson, err = readJson(r); err != nil {
+		return
+	}
 	if idParam, exists := reqJson[_ID]; exists {
 		if id, ok := idParam.(string); ok {
 			entityId = id
@@ -342,17 +253,63 @@ func getRequestData(r *http.Request, isForPoll bool) (entityId string, version i
 					if v, ok := versionParam.(float64); ok {
 						version = int(v)
 					} else {
-						err = errors.New(_VERSION + ` must be a number value`)
+						err = NewError(CodeBadRequest, _VERSION + ` must be a number value`)
 					}
 				} else {
-					err = errors.New(_VERSION + ` value must be included in request`)
+					err = NewError(CodeBadRequest, _VERSION + ` value must be included in request`)
 				}
 			}
 		} else {
-			err = errors.New(_ID + ` must be a string value`)
+			err = NewError(CodeBadRequest, _ID + ` must be a string value`)
 		}
 	} else {
-		err = errors.New(_ID +` value must be included in request`)
+		err = NewError(CodeBadRequest, _ID + ` value must be included in request`)
 	}
 	return
-}
\ No newline at end of file
+}
+
+// actEntityId takes the entityId of the entity an act is for out of its json, leaving any id the act
+// has for its own use, an act without one is for the session's entity if it is in only one.
+func actEntityId(s *session, json Json) (string, error) {
+	idParam, exists := json[_ENTITY_ID]
+	if !exists {
+		switch len(s.entities) {
+		case 0:
+			return ``, NewError(CodeNotEngaged, `no entity in session`)
+		case 1:
+			return s.entityIds()[0], nil
+		}
+		return ``, NewError(CodeBadRequest, _ENTITY_ID + ` value must be included in request`)
+	}
+	delete(json, _ENTITY_ID)
+	entityId, ok := idParam.(string)
+	if !ok {
+		return ``, NewError(CodeBadRequest, _ENTITY_ID + ` must be a string value`)
+	}
+	if !s.has(entityId) {
+		return ``, NewError(CodeNotEngaged, `entity not in session`)
+	}
+	return entityId, nil
+}
+
+// getStreamRequestData reads the entity id from the query string, the last seen version is
+// taken from the Last-Event-ID header a reconnecting EventSource sends, falling back to the v query param.
+func getStreamRequestData(r *http.Request) (entityId string, version int, hasVersion bool, err error) {
+	query := r.URL.Query()
+	if entityId = query.Get(_ID); entityId == `` {
+		err = NewError(CodeBadRequest, _ID + ` value must be included in request`)
+		return
+	}
+	versionParam := r.Header.Get(_LAST_EVENT_ID)
+	if versionParam == `` {
+		versionParam = query.Get(_VERSION)
+	}
+	if versionParam != `` {
+		if version, err = strconv.Atoi(versionParam); err != nil {
+			err = NewError(CodeBadRequest, _VERSION + ` must be a number value`)
+			return
+		}
+		hasVersion = true
+	}
+	return
+}
@@ -1,9 +1,15 @@
 package oak
 
 import(
+	`time`
+	`fmt`
 	`bytes`
 	`errors`
+	`context`
+	`strconv`
+	`strings`
 	`testing`
+	`sync/atomic`
 	`net/http`
 	js `encoding/json`
 	`net/http/httptest`
@@ -13,20 +19,20 @@ import(
 )
 
 func Test_create_without_existing_session(t *testing.T){
-	w, r := setup(nil, nil, nil, _CREATE, ``)
+	w, r := setup(nil, nil, nil, _CREATE, ``, EntityInSession())
 
 	tr.ServeHTTP(w, r)
 
 	resp := Json{}
 	readTestJson(w, &resp)
 	assert.Equal(t, `test_entity_id`, resp[_ID].(string), `response json should contain the returned entityId`)
-	assert.Equal(t, `test_creator_user_id`, tss.session.Values[_USER_ID], `session should have the provided user id`)
-	assert.Equal(t, resp[_ID].(string), tss.session.Values[_ENTITY_ID].(string), `session should have a entityId matching the json response`)
-	assert.Equal(t, tes.entity, tss.session.Values[_ENTITY].(*testEntity), `session should have the entity`)
+	assert.Equal(t, `test_creator_user_id`, testSessionValue(_USER_ID), `session should have the provided user id`)
+	assert.Equal(t, resp[_ID].(string), testSessionValue(_ENTITY_ID).(string), `session should have a entityId matching the json response`)
+	assert.Equal(t, tes.entity, testSessionValue(_ENTITY).(*testEntity), `session should have the entity`)
 }
 
 func Test_create_with_existing_session(t *testing.T){
-	w, r := setup(nil, nil, nil, _CREATE, ``)
+	w, r := setup(nil, nil, nil, _CREATE, ``, EntityInSession())
 	tes.Create()
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
@@ -39,26 +45,26 @@ func Test_create_with_existing_session(t *testing.T){
 	resp := Json{}
 	readTestJson(w, &resp)
 	assert.Equal(t, `test_pre_set_entity_id`, resp[_ID].(string), `response json should have the existing entityId`)
-	assert.Equal(t, `test_pre_set_user_id`, tss.session.Values[_USER_ID], `session should have the existing user id`)
-	assert.Equal(t, resp[_ID].(string), tss.session.Values[_ENTITY_ID].(string), `session should have a entityId matching the json response`)
-	assert.Equal(t, entity, tss.session.Values[_ENTITY], `session should have the existing entity`)
+	assert.Equal(t, `test_pre_set_user_id`, testSessionValue(_USER_ID), `session should have the existing user id`)
+	assert.Equal(t, resp[_ID].(string), testSessionValue(_ENTITY_ID).(string), `session should have a entityId matching the json response`)
+	assert.Equal(t, entity, testSessionValue(_ENTITY), `session should have the existing entity`)
 }
 
 func Test_create_with_store_error(t *testing.T){
-	w, r := setup(nil, nil, nil, _CREATE, ``)
+	w, r := setup(nil, nil, nil, _CREATE, ``, EntityInSession())
 	tes.createErr = errors.New(`test_create_error`)
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_create_error\n", w.Body.String(), `response body should be error message`)
+	assertTestError(t, w, CodeInternal, "test_create_error")
 	assert.Equal(t, 500, w.Code, `return code should be 500`)
-	assert.Nil(t, tss.session.Values[_USER_ID], `session should not have a userId`)
-	assert.Nil(t, tss.session.Values[_ENTITY_ID], `session should not have an entityId`)
-	assert.Nil(t, tss.session.Values[_ENTITY], `session should not have an entity`)
+	assert.Nil(t, testSessionValue(_USER_ID), `session should not have a userId`)
+	assert.Nil(t, testSessionValue(_ENTITY_ID), `session should not have an entityId`)
+	assert.Nil(t, testSessionValue(_ENTITY), `session should not have an entity`)
 }
 
 func Test_join_without_existing_session(t *testing.T){
-	w, r := setup(func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, nil, _JOIN, `{"`+_ID+`":"req_test_entity_id"}`)
+	w, r := setup(func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, nil, _JOIN, `{"`+_ID+`":"req_test_entity_id"}`, EntityInSession())
 	tes.Create()
 
 	tr.ServeHTTP(w, r)
@@ -67,13 +73,13 @@ func Test_join_without_existing_session(t *testing.T){
 	readTestJson(w, &resp)
 	assert.Equal(t, `yo`, resp[`test`].(string), `response json should contain the returned data from getJoinResp`)
 	assert.Equal(t, 0, int(resp[_VERSION].(float64)), `response json should contain the version number`)
-	assert.Equal(t, `test_user_id`, tss.session.Values[_USER_ID], `session should have the provided user id`)
-	assert.Equal(t, `req_test_entity_id`, tss.session.Values[_ENTITY_ID].(string), `session should have the entityId`)
-	assert.Equal(t, tes.entity, tss.session.Values[_ENTITY].(*testEntity), `session should have the entity`)
+	assert.Equal(t, `test_user_id`, testSessionValue(_USER_ID), `session should have the provided user id`)
+	assert.Equal(t, `req_test_entity_id`, testSessionValue(_ENTITY_ID).(string), `session should have the entityId`)
+	assert.Equal(t, tes.entity, testSessionValue(_ENTITY).(*testEntity), `session should have the entity`)
 }
 
 func Test_join_with_existing_session(t *testing.T){
-	w, r := setup(func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, nil, _JOIN, `{"`+_ID+`":"req_test_entity_id"}`)
+	w, r := setup(func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, nil, _JOIN, `{"`+_ID+`":"req_test_entity_id"}`, EntityInSession())
 	tes.Create()
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
@@ -87,9 +93,9 @@ func Test_join_with_existing_session(t *testing.T){
 	readTestJson(w, &resp)
 	assert.Equal(t, `yo`, resp[`test`].(string), `response json should contain the returned data from getJoinResp`)
 	assert.Equal(t, 0, int(resp[_VERSION].(float64)), `response json should contain the version number`)
-	assert.Equal(t, `test_pre_set_user_id`, tss.session.Values[_USER_ID], `session should have the existing user id`)
-	assert.Equal(t, `test_pre_set_entity_id`, tss.session.Values[_ENTITY_ID], `response json should have the existing entityId`)
-	assert.Equal(t, entity, tss.session.Values[_ENTITY], `session should have the existing entity`)
+	assert.Equal(t, `test_pre_set_user_id`, testSessionValue(_USER_ID), `session should have the existing user id`)
+	assert.Equal(t, `test_pre_set_entity_id`, testSessionValue(_ENTITY_ID), `response json should have the existing entityId`)
+	assert.Equal(t, entity, testSessionValue(_ENTITY), `session should have the existing entity`)
 }
 
 func Test_join_with_request_missing_id(t *testing.T) {
@@ -97,8 +103,8 @@ func Test_join_with_request_missing_id(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, _ID + " value must be included in request\n", w.Body.String(), `response body should be error message`)
-	assert.Equal(t, 500, w.Code, `return code should be 500`)
+	assertTestError(t, w, CodeBadRequest, _ID + " value must be included in request")
+	assert.Equal(t, 400, w.Code, `return code should be 400`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
 
@@ -107,8 +113,8 @@ func Test_join_with_request_nonstring_id(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, _ID + " must be a string value\n", w.Body.String(), `response body should be error message`)
-	assert.Equal(t, 500, w.Code, `return code should be 500`)
+	assertTestError(t, w, CodeBadRequest, _ID + " must be a string value")
+	assert.Equal(t, 400, w.Code, `return code should be 400`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
 
@@ -118,7 +124,7 @@ func Test_join_with_entity_store_read_error(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_read_error\n", w.Body.String(), `response body should be error message`)
+	assertTestError(t, w, CodeInternal, "test_read_error")
 	assert.Equal(t, 500, w.Code, `return code should be 500`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
@@ -129,7 +135,7 @@ func Test_join_with_entity_store_update_error_on_second_update_pass(t *testing.T
 	tes.update = func(entityId string, entity Entity) error{
 		if callCount == 0 {
 			callCount++
-			return errors.New(`nonsequential update for entity with id "test_entity_id"`)
+			return &ErrNonsequentialUpdate{EntityId: `test_entity_id`, ExpectedVersion: 1, ActualVersion: 2}
 		} else {
 			return errors.New(`test_update_error`)
 		}
@@ -139,7 +145,7 @@ func Test_join_with_entity_store_update_error_on_second_update_pass(t *testing.T
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_update_error\n", w.Body.String(), `response body should be error message`)
+	assertTestError(t, w, CodeInternal, "test_update_error")
 	assert.Equal(t, 500, w.Code, `return code should be 500`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
@@ -149,17 +155,155 @@ func Test_join_with_never_ending_nonsequential_update_errors(t *testing.T) {
 	callCount := 0
 	tes.update = func(entityId string, entity Entity) error{
 		callCount++
-		return errors.New(`nonsequential update for entity with id "test_entity_id"`)
+		return &ErrNonsequentialUpdate{EntityId: `test_entity_id`, ExpectedVersion: 1, ActualVersion: 2}
 	}
 	tes.entity = &testEntity{kick:func()bool{return true}}
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "nonsequential update for entity with id \"test_entity_id\"\n", w.Body.String(), `response body should be error message`)
-	assert.Equal(t, 500, w.Code, `return code should be 500`)
+	assertTestError(t, w, CodeConflict, "nonsequential update for entity with id \"test_entity_id\", expected version 1 but got 2")
+	assert.Equal(t, 409, w.Code, `return code should be 409`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
 
+func Test_join_with_nonsequential_registration_update(t *testing.T) {
+	w, r := setup(func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, nil, _JOIN, `{"`+_ID+`": "test_entity_id"}`)
+	tes.Create()
+	updateCount := 0
+	tes.update = func(entityId string, entity Entity) error{
+		updateCount++
+		if updateCount == 1 {
+			return fmt.Errorf(`wrapped: %w`, &ErrNonsequentialUpdate{EntityId: entityId})
+		}
+		return nil
+	}
+	registerCount := 0
+	tes.entity.registerNewUser = func()(string, error){
+		registerCount++
+		return `test_user_id_` + strconv.Itoa(registerCount), nil
+	}
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, 2, updateCount, `update should have been retried`)
+	assert.Equal(t, `test_user_id_2`, testSessionValue(_USER_ID), `session should have the user id from the retried registration`)
+	assert.Equal(t, 200, w.Code, `return code should be 200`)
+}
+
+func Test_join_with_nonsequential_registration_update_and_inactive_entity_on_retry(t *testing.T) {
+	w, r := setup(func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, nil, _JOIN, `{"`+_ID+`": "test_entity_id"}`)
+	tes.Create()
+	tes.update = func(entityId string, entity Entity) error{
+		tes.entity.isActive = func()bool{return false}
+		return &ErrNonsequentialUpdate{EntityId: entityId}
+	}
+
+	tr.ServeHTTP(w, r)
+
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, `yo`, resp[`test`].(string), `response json should contain the returned data from getJoinResp`)
+	assert.Nil(t, testSessionValue(_USER_ID), `session should not have a user id`)
+}
+
+func Test_join_with_read_error_after_nonsequential_registration_update(t *testing.T) {
+	w, r := setup(nil, nil, nil, _JOIN, `{"`+_ID+`": "test_entity_id"}`)
+	tes.Create()
+	tes.update = func(entityId string, entity Entity) error{
+		tes.readErr = errors.New(`test_read_error`)
+		return &ErrNonsequentialUpdate{EntityId: entityId}
+	}
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeInternal, "test_read_error")
+	assert.Equal(t, 500, w.Code, `return code should be 500`)
+}
+
+func Test_join_with_registration_error(t *testing.T) {
+	w, r := setup(func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, nil, _JOIN, `{"`+_ID+`": "test_entity_id"}`)
+	tes.Create()
+	tes.entity.registerNewUser = func()(string, error){return ``, errors.New(`test_full`)}
+
+	tr.ServeHTTP(w, r)
+
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, 200, w.Code, `return code should be 200`)
+	assert.Equal(t, `yo`, resp[`test`].(string), `user the entity won't register should get the join response`)
+	assert.Nil(t, testSessionValue(_USER_ID), `session should not have a user id`)
+}
+
+func Test_join_with_registration_error_response(t *testing.T) {
+	w, r := setup(nil, nil, nil, _JOIN, `{"`+_ID+`": "test_entity_id"}`)
+	tes.Create()
+	tes.entity.registerNewUser = func()(string, error){return ``, NewError(CodeForbidden, `test_game_full`)}
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeForbidden, `test_game_full`)
+	assert.Equal(t, 403, w.Code, `return code should be 403`)
+	assert.Nil(t, testSessionValue(_USER_ID), `session should not have a user id`)
+}
+
+func Test_join_with_registration_update_error(t *testing.T) {
+	w, r := setup(nil, nil, nil, _JOIN, `{"`+_ID+`": "test_entity_id"}`)
+	tes.Create()
+	tes.updateErr = errors.New(`test_update_error`)
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeInternal, `test_update_error`)
+	assert.Equal(t, 500, w.Code, `return code should be 500`)
+	assert.Nil(t, testSessionValue(_USER_ID), `session should not have a user id`)
+}
+
+func Test_join_with_never_ending_nonsequential_registration_updates(t *testing.T) {
+	w, r := setup(nil, nil, nil, _JOIN, `{"`+_ID+`": "test_entity_id"}`)
+	tes.Create()
+	tes.update = func(entityId string, entity Entity) error{
+		return &ErrNonsequentialUpdate{EntityId: entityId, ExpectedVersion: 1, ActualVersion: 2}
+	}
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeConflict, "nonsequential update for entity with id \"test_entity_id\", expected version 1 but got 2")
+	assert.Equal(t, 409, w.Code, `return code should be 409`)
+	assert.Nil(t, testSessionValue(_USER_ID), `session should not have a user id`)
+}
+
+func Test_poll_with_kick_retry_policy_disabled(t *testing.T) {
+	w, r := setup(nil, nil, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": 0}`, RetryOp(OpKick, RetryPolicy{MaxAttempts: 1}))
+	tes.Create()
+	tes.entity.kick = func()bool{return true}
+	updateCount := 0
+	tes.update = func(entityId string, entity Entity) error{
+		updateCount++
+		return &ErrNonsequentialUpdate{EntityId: entityId, ExpectedVersion: 1, ActualVersion: 2}
+	}
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, 1, updateCount, `kick update should not have been retried`)
+	assertTestError(t, w, CodeConflict, "nonsequential update for entity with id \"test_entity_id\", expected version 1 but got 2")
+}
+
+func Test_poll_with_kick_retry_and_cancelled_request(t *testing.T) {
+	w, r := setup(nil, nil, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": 0}`, RetryOp(OpKick, RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour}))
+	tes.Create()
+	tes.entity.kick = func()bool{return true}
+	tes.update = func(entityId string, entity Entity) error{
+		return &ErrNonsequentialUpdate{EntityId: entityId}
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+
+	tr.ServeHTTP(w, r.WithContext(ctx))
+
+	assertTestError(t, w, CodeInternal, "context canceled")
+	assert.Equal(t, 500, w.Code, `response code should be 500`)
+}
+
 func Test_poll_with_no_change(t *testing.T) {
 	w, r := setup(nil, nil, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": 0}`)
 	tes.Create()
@@ -183,7 +327,7 @@ func Test_poll_with_change(t *testing.T) {
 }
 
 func Test_poll_with_session_user_and_entity_is_active(t *testing.T) {
-	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": -1}`)
+	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": -1}`, EntityInSession())
 	tes.Create()
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
@@ -197,14 +341,14 @@ func Test_poll_with_session_user_and_entity_is_active(t *testing.T) {
 	readTestJson(w, &resp)
 	assert.Equal(t, `yo`, resp[`test`].(string), `response json should contain the returned data from getJoinResp`)
 	assert.Equal(t, 0, int(resp[_VERSION].(float64)), `response json should contain the version number`)
-	assert.Equal(t, `test_pre_set_user_id`, s.Values[_USER_ID], `session userId should be unchanged`)
-	assert.Equal(t, `test_entity_id`, s.Values[_ENTITY_ID], `session entityId should be unchanged`)
-	assert.NotEqual(t, entity, s.Values[_ENTITY], `session entity should not be it's original value`)
-	assert.Equal(t, tes.entity, s.Values[_ENTITY], `session entity should be updated to the stores entity`)
+	assert.Equal(t, `test_pre_set_user_id`, testSessionValue(_USER_ID), `session userId should be unchanged`)
+	assert.Equal(t, `test_entity_id`, testSessionValue(_ENTITY_ID), `session entityId should be unchanged`)
+	assert.NotEqual(t, entity, testSessionValue(_ENTITY), `session entity should not be it's original value`)
+	assert.Equal(t, tes.entity, testSessionValue(_ENTITY), `session entity should be updated to the stores entity`)
 }
 
 func Test_poll_with_session_user_and_entity_is_not_active(t *testing.T) {
-	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": -1}`)
+	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": -1}`, EntityInSession())
 	tes.Create()
 	tes.entity.isActive = func()bool{return false}
 	s, _ := tss.Get(r, ``)
@@ -219,9 +363,9 @@ func Test_poll_with_session_user_and_entity_is_not_active(t *testing.T) {
 	readTestJson(w, &resp)
 	assert.Equal(t, `yo`, resp[`test`].(string), `response json should contain the returned data from getJoinResp`)
 	assert.Equal(t, 0, int(resp[_VERSION].(float64)), `response json should contain the version number`)
-	assert.Nil(t, s.Values[_USER_ID], `session should be completely cleared`)
-	assert.Nil(t, s.Values[_ENTITY_ID], `session should be completely cleared`)
-	assert.Nil(t, s.Values[_ENTITY], `session should be completely cleared`)
+	assert.Nil(t, testSessionValue(_USER_ID), `session should be completely cleared`)
+	assert.Nil(t, testSessionValue(_ENTITY_ID), `session should be completely cleared`)
+	assert.Nil(t, testSessionValue(_ENTITY), `session should be completely cleared`)
 }
 
 func Test_poll_with_entity_store_read_error(t *testing.T) {
@@ -230,7 +374,7 @@ func Test_poll_with_entity_store_read_error(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_read_error\n", w.Body.String(), `response body should be error message`)
+	assertTestError(t, w, CodeInternal, "test_read_error")
 	assert.Equal(t, 500, w.Code, `return code should be 500`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
@@ -240,8 +384,8 @@ func Test_poll_with_request_missing_id(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, _ID + " value must be included in request\n", w.Body.String(), `response body should be error message`)
-	assert.Equal(t, 500, w.Code, `return code should be 500`)
+	assertTestError(t, w, CodeBadRequest, _ID + " value must be included in request")
+	assert.Equal(t, 400, w.Code, `return code should be 400`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
 
@@ -250,8 +394,8 @@ func Test_poll_with_request_nonstring_id(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, _ID + " must be a string value\n", w.Body.String(), `response body should be error message`)
-	assert.Equal(t, 500, w.Code, `return code should be 500`)
+	assertTestError(t, w, CodeBadRequest, _ID + " must be a string value")
+	assert.Equal(t, 400, w.Code, `return code should be 400`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
 
@@ -260,8 +404,8 @@ func Test_poll_with_request_missing_version(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, _VERSION + " value must be included in request\n", w.Body.String(), `response body should be error message`)
-	assert.Equal(t, 500, w.Code, `return code should be 500`)
+	assertTestError(t, w, CodeBadRequest, _VERSION + " value must be included in request")
+	assert.Equal(t, 400, w.Code, `return code should be 400`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
 
@@ -270,13 +414,240 @@ func Test_poll_with_request_nonnumber_version(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, _VERSION + " must be a number value\n", w.Body.String(), `response body should be error message`)
-	assert.Equal(t, 500, w.Code, `return code should be 500`)
+	assertTestError(t, w, CodeBadRequest, _VERSION + " must be a number value")
+	assert.Equal(t, 400, w.Code, `return code should be 400`)
 	assert.Nil(t, tss.session, `session should not have been initialised`)
 }
 
+func Test_poll_long_poll_with_no_change_times_out(t *testing.T) {
+	w, r := setup(nil, nil, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": 0}`, LongPoll(20 * time.Millisecond, 0))
+	tes.Create()
+
+	start := time.Now()
+	tr.ServeHTTP(w, r)
+
+	assert.True(t, time.Since(start) >= 20 * time.Millisecond, `request should have blocked until the timeout`)
+	assert.Equal(t, ``, w.Body.String(), `response body should be empty`)
+	assert.Equal(t, 200, w.Code, `return code should be 200`)
+}
+
+func Test_poll_long_poll_with_change_made_by_join(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	setupServer(store, Config{
+		SessionStore: newTestCookieStore(),
+		GetEntityChangeResp: func(userId string, e Entity)Json{return Json{"test": "yo"}},
+	}, LongPoll(5 * time.Second, 0))
+	entityId, _, _ := store.Create()
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		r, _ := http.NewRequest(`POST`, _POLL, bytes.NewBufferString(`{"`+_ID+`": "`+entityId+`", "`+_VERSION+`": 0}`))
+		tr.ServeHTTP(w, r)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	<-done
+
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, `yo`, resp[`test`].(string), `response json should contain the returned data from getEntityChangeResp`)
+	assert.Equal(t, 1, int(resp[_VERSION].(float64)), `response json should contain the new version number`)
+}
+
+func Test_poll_long_poll_with_change_made_by_kick(t *testing.T) {
+	var version int32
+	w, r := setup(nil, func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": 0}`, LongPoll(5 * time.Second, 5 * time.Millisecond))
+	tes.Create()
+	tes.entity.getVersion = func()int{return int(atomic.LoadInt32(&version))}
+	kickAt := time.Now().Add(20 * time.Millisecond)
+	tes.entity.kick = func()bool{
+		if atomic.LoadInt32(&version) == 0 && time.Now().After(kickAt) {
+			atomic.StoreInt32(&version, 1)
+			return true
+		}
+		return false
+	}
+
+	tr.ServeHTTP(w, r)
+
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, `yo`, resp[`test`].(string), `response json should contain the returned data from getEntityChangeResp`)
+	assert.Equal(t, 1, int(resp[_VERSION].(float64)), `response json should contain the kicked version number`)
+}
+
+func Test_poll_long_poll_with_cancelled_request(t *testing.T) {
+	w, r := setup(nil, nil, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": 0}`, LongPoll(5 * time.Second, 0))
+	tes.Create()
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(ctx)
+	cancel()
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, ``, w.Body.String(), `response body should be empty`)
+	assert.Nil(t, tss.session, `session should not have been initialised`)
+}
+
+func Test_poll_long_poll_with_read_error_after_change(t *testing.T) {
+	w, r := setup(nil, nil, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": 0}`, LongPoll(5 * time.Second, 5 * time.Millisecond))
+	tes.Create()
+	tes.entity.kick = func()bool{
+		tes.readErr = errors.New(`test_read_error`)
+		return true
+	}
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeInternal, "test_read_error")
+	assert.Equal(t, 500, w.Code, `return code should be 500`)
+}
+
+func Test_stream_with_inactive_entity(t *testing.T) {
+	w, _ := setup(nil, func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, _STREAM, ``)
+	tes.Create()
+	tes.entity.isActive = func()bool{return false}
+	r, _ := http.NewRequest(`GET`, _STREAM + `?` + _ID + `=test_entity_id`, nil)
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, "id: 0\ndata: {\"test\":\"yo\",\"v\":0}\n\n", w.Body.String(), `response body should contain a single event`)
+	assert.Equal(t, `text/event-stream`, w.Header().Get(`Content-Type`), `content type should be text/event-stream`)
+	assert.Equal(t, 200, w.Code, `return code should be 200`)
+}
+
+func Test_stream_with_inactive_entity_and_last_event_id_matching_version(t *testing.T) {
+	w, _ := setup(nil, func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, _STREAM, ``)
+	tes.Create()
+	tes.entity.isActive = func()bool{return false}
+	r, _ := http.NewRequest(`GET`, _STREAM + `?` + _ID + `=test_entity_id`, nil)
+	r.Header.Set(_LAST_EVENT_ID, `0`)
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, ``, w.Body.String(), `response body should be empty`)
+	assert.Equal(t, ``, w.Header().Get(`Content-Type`), `response should not be an event stream`)
+	assert.Equal(t, 204, w.Code, `return code should be 204`)
+}
+
+func Test_stream_with_change_made_by_join(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	setupServer(store, Config{
+		SessionStore: newTestCookieStore(),
+		GetEntityChangeResp: func(userId string, e Entity)Json{return Json{"test": "yo"}},
+	})
+	entityId, _, _ := store.Create()
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _ := http.NewRequest(`GET`, _STREAM + `?` + _ID + `=` + entityId, nil)
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		tr.ServeHTTP(w, r)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, "id: 0\ndata: {\"test\":\"yo\",\"v\":0}\n\nid: 1\ndata: {\"test\":\"yo\",\"v\":1}\n\n", w.Body.String(), `response body should contain an event per version`)
+}
+
+func Test_stream_with_last_event_id_matching_version(t *testing.T) {
+	var version int32
+	w, _ := setup(nil, func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, _STREAM, ``, StreamKickInterval(5 * time.Millisecond))
+	tes.Create()
+	tes.entity.getVersion = func()int{return int(atomic.LoadInt32(&version))}
+	kickAt := time.Now().Add(20 * time.Millisecond)
+	tes.entity.kick = func()bool{
+		if atomic.LoadInt32(&version) == 0 && time.Now().After(kickAt) {
+			atomic.StoreInt32(&version, 1)
+			return true
+		}
+		return false
+	}
+	tes.entity.isActive = func()bool{return atomic.LoadInt32(&version) == 0}
+	r, _ := http.NewRequest(`GET`, _STREAM + `?` + _ID + `=test_entity_id`, nil)
+	r.Header.Set(_LAST_EVENT_ID, `0`)
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, "id: 1\ndata: {\"test\":\"yo\",\"v\":1}\n\n", w.Body.String(), `response body should only contain the kicked version`)
+}
+
+func Test_stream_with_unmarshalable_change_resp(t *testing.T) {
+	w, _ := setup(nil, func(userId string, e Entity)Json{return Json{"test": func(){}}}, nil, _STREAM, ``)
+	tes.Create()
+	r, _ := http.NewRequest(`GET`, _STREAM + `?` + _ID + `=test_entity_id`, nil)
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, ``, w.Body.String(), `response body should be empty`)
+	assert.Equal(t, 200, w.Code, `return code should be 200`)
+}
+
+func Test_stream_with_request_missing_id(t *testing.T) {
+	w, _ := setup(nil, nil, nil, _STREAM, ``)
+	r, _ := http.NewRequest(`GET`, _STREAM, nil)
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeBadRequest, _ID + " value must be included in request")
+	assert.Equal(t, 400, w.Code, `return code should be 400`)
+}
+
+func Test_stream_with_request_nonnumber_version(t *testing.T) {
+	w, _ := setup(nil, nil, nil, _STREAM, ``)
+	r, _ := http.NewRequest(`GET`, _STREAM + `?` + _ID + `=test_entity_id&` + _VERSION + `=yo`, nil)
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeBadRequest, _VERSION + " must be a number value")
+	assert.Equal(t, 400, w.Code, `return code should be 400`)
+}
+
+func Test_stream_with_nonflushing_response_writer(t *testing.T) {
+	w, _ := setup(nil, nil, nil, _STREAM, ``)
+	r, _ := http.NewRequest(`GET`, _STREAM + `?` + _ID + `=test_entity_id`, nil)
+
+	tr.ServeHTTP(&nonFlushingWriter{w}, r)
+
+	assertTestError(t, w, CodeInternal, "streaming is not supported by the response writer")
+	assert.Equal(t, 500, w.Code, `return code should be 500`)
+}
+
+func Test_stream_with_entity_store_read_error(t *testing.T) {
+	w, _ := setup(nil, nil, nil, _STREAM, ``)
+	tes.readErr = errors.New(`test_read_error`)
+	r, _ := http.NewRequest(`GET`, _STREAM + `?` + _ID + `=test_entity_id`, nil)
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeInternal, "test_read_error")
+	assert.Equal(t, 500, w.Code, `return code should be 500`)
+}
+
+func Test_stream_with_read_error_after_change(t *testing.T) {
+	w, _ := setup(nil, func(userId string, e Entity)Json{return Json{"test": "yo"}}, nil, _STREAM, ``, StreamKickInterval(5 * time.Millisecond))
+	tes.Create()
+	tes.entity.kick = func()bool{
+		tes.readErr = errors.New(`test_read_error`)
+		return true
+	}
+	r, _ := http.NewRequest(`GET`, _STREAM + `?` + _ID + `=test_entity_id`, nil)
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, "id: 0\ndata: {\"test\":\"yo\",\"v\":0}\n\n", w.Body.String(), `response body should end after the first event`)
+}
+
 func Test_act_success(t *testing.T) {
-	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``)
+	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``, EntityInSession())
 	tes.Create()
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
@@ -290,14 +661,14 @@ func Test_act_success(t *testing.T) {
 	readTestJson(w, &resp)
 	assert.Equal(t, `yo`, resp[`test`].(string), `response json should contain the returned data from getEntityChangeResp`)
 	assert.Equal(t, 0, int(resp[_VERSION].(float64)), `response json should contain the version number`)
-	assert.Equal(t, `test_pre_set_user_id`, s.Values[_USER_ID], `session should contain same userId`)
-	assert.Equal(t, `test_pre_set_entity_id`, s.Values[_ENTITY_ID], `session should contain same entityId`)
-	assert.NotEqual(t, entity, s.Values[_ENTITY], `session entity should not be it's original value`)
-	assert.Equal(t, tes.entity, s.Values[_ENTITY], `session entity should be updated to the stores entity`)
+	assert.Equal(t, `test_pre_set_user_id`, testSessionValue(_USER_ID), `session should contain same userId`)
+	assert.Equal(t, `test_pre_set_entity_id`, testSessionValue(_ENTITY_ID), `session should contain same entityId`)
+	assert.NotEqual(t, entity, testSessionValue(_ENTITY), `session entity should not be it's original value`)
+	assert.Equal(t, tes.entity, testSessionValue(_ENTITY), `session entity should be updated to the stores entity`)
 }
 
 func Test_act_to_inactive_entity(t *testing.T) {
-	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``)
+	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``, EntityInSession())
 	tes.Create()
 	tes.entity.isActive = func()bool{return false}
 	s, _ := tss.Get(r, ``)
@@ -312,9 +683,9 @@ func Test_act_to_inactive_entity(t *testing.T) {
 	readTestJson(w, &resp)
 	assert.Equal(t, `yo`, resp[`test`].(string), `response json should contain the returned data from getEntityChangeResp`)
 	assert.Equal(t, 0, int(resp[_VERSION].(float64)), `response json should contain the version number`)
-	assert.Nil(t, s.Values[_USER_ID], `session should have been cleared`)
-	assert.Nil(t, s.Values[_ENTITY_ID], `session should have been cleared`)
-	assert.Nil(t, s.Values[_ENTITY], `session should have been cleared`)
+	assert.Nil(t, testSessionValue(_USER_ID), `session should have been cleared`)
+	assert.Nil(t, testSessionValue(_ENTITY_ID), `session should have been cleared`)
+	assert.Nil(t, testSessionValue(_ENTITY), `session should have been cleared`)
 }
 
 func Test_act_with_empty_session(t *testing.T) {
@@ -322,12 +693,55 @@ func Test_act_with_empty_session(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "no entity in session\n", w.Body.String(), `response body should have error message`)
-	assert.Equal(t, 500, w.Code, `response code should be 500`)
+	assertTestError(t, w, CodeNotEngaged, "no entity in session")
+	assert.Equal(t, 403, w.Code, `response code should be 403`)
+}
+
+func Test_act_with_invalid_body(t *testing.T) {
+	for reqJson, message := range map[string]string{
+		`{"x":`: `invalid request body: unexpected end of JSON input`,
+		`{"x":1} {"y":2}`: `invalid request body: invalid character '{' after top-level value`,
+		`[1]`: `invalid request body: json: cannot unmarshal array into Go value of type oak.Json`,
+		`null`: `request body must be an object`,
+	} {
+		performed := false
+		w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{
+			performed = true
+			return nil
+		}, _ACT, reqJson)
+		tes.Create()
+		s, _ := tss.Get(r, ``)
+		s.Values[_USER_ID] = `test_pre_set_user_id`
+		s.Values[_ENTITY_ID] = `test_entity_id`
+
+		tr.ServeHTTP(w, r)
+
+		assertTestError(t, w, CodeBadRequest, message)
+		assert.Equal(t, 400, w.Code, `response code should be 400`)
+		assert.False(t, performed, `act should not be performed`)
+	}
+}
+
+func Test_join_with_too_large_body(t *testing.T) {
+	w, r := setup(nil, nil, nil, _JOIN, `{"`+_ID+`":"`+strings.Repeat(`a`, 100)+`"}`, MaxBodySize(64))
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeTooLarge, `request body must be at most 64 bytes`)
+	assert.Equal(t, 413, w.Code, `response code should be 413`)
+}
+
+func Test_join_without_body_limit(t *testing.T) {
+	w, r := setup(func(userId string, e Entity)Json{return Json{}}, nil, nil, _JOIN, `{"`+_ID+`":"test_entity_id","pad":"`+strings.Repeat(`a`, DefaultMaxBodySize)+`"}`, MaxBodySize(0))
+	tes.Create()
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, 200, w.Code, `response code should be 200`)
 }
 
 func Test_act_with_performAct_error_on_session_entity(t *testing.T) {
-	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{return errors.New(`test_perform_act_error`)}, _ACT, ``)
+	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{return errors.New(`test_perform_act_error`)}, _ACT, ``, EntityInSession())
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
 	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
@@ -336,12 +750,12 @@ func Test_act_with_performAct_error_on_session_entity(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_perform_act_error\n", w.Body.String(), `response body should have error message`)
+	assertTestError(t, w, CodeInternal, "test_perform_act_error")
 	assert.Equal(t, 500, w.Code, `response code should be 500`)
 }
 
 func Test_act_with_read_error(t *testing.T) {
-	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``)
+	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``, EntityInSession())
 	tes.readErr = errors.New(`test_read_error`)
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
@@ -351,7 +765,7 @@ func Test_act_with_read_error(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_read_error\n", w.Body.String(), `response body should have error message`)
+	assertTestError(t, w, CodeInternal, "test_read_error")
 	assert.Equal(t, 500, w.Code, `response code should be 500`)
 }
 
@@ -363,7 +777,7 @@ func Test_act_with_performAct_error_on_stored_entity(t *testing.T) {
 			return nil
 		}
 		return errors.New(`test_perform_act_error`)
-	}, _ACT, ``)
+	}, _ACT, ``, EntityInSession())
 	tes.Create()
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
@@ -373,12 +787,12 @@ func Test_act_with_performAct_error_on_stored_entity(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_perform_act_error\n", w.Body.String(), `response body should have error message`)
+	assertTestError(t, w, CodeInternal, "test_perform_act_error")
 	assert.Equal(t, 500, w.Code, `response code should be 500`)
 }
 
 func Test_act_with_update_error(t *testing.T) {
-	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``)
+	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``, EntityInSession())
 	tes.Create()
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
@@ -389,10 +803,97 @@ func Test_act_with_update_error(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_update_error\n", w.Body.String(), `response body should have error message`)
+	assertTestError(t, w, CodeInternal, "test_update_error")
 	assert.Equal(t, 500, w.Code, `response code should be 500`)
 }
 
+func Test_act_with_nonsequential_update(t *testing.T) {
+	actCount := 0
+	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, func(json Json, userId string, e Entity)error{
+		actCount++
+		return nil
+	}, _ACT, ``, EntityInSession())
+	tes.Create()
+	updateCount := 0
+	tes.update = func(entityId string, entity Entity) error{
+		updateCount++
+		if updateCount == 1 {
+			return &ErrNonsequentialUpdate{EntityId: entityId}
+		}
+		return nil
+	}
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
+	s.Values[_ENTITY] = &testEntity{}
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, 3, actCount, `performAct should have been called on the session entity and on each stored entity`)
+	assert.Equal(t, 2, updateCount, `update should have been retried`)
+	assert.Equal(t, 200, w.Code, `response code should be 200`)
+}
+
+func Test_act_with_never_ending_nonsequential_update_errors(t *testing.T) {
+	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``, EntityInSession())
+	tes.Create()
+	tes.update = func(entityId string, entity Entity) error{
+		return &ErrNonsequentialUpdate{EntityId: entityId, ExpectedVersion: 1, ActualVersion: 2}
+	}
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
+	s.Values[_ENTITY] = &testEntity{}
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeConflict, "nonsequential update for entity with id \"test_pre_set_entity_id\", expected version 1 but got 2")
+	assert.Equal(t, 409, w.Code, `response code should be 409`)
+}
+
+func Test_act_with_retry_policy(t *testing.T) {
+	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``, Retry(RetryPolicy{MaxAttempts: 1}), RetryOp(OpAct, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}), EntityInSession())
+	tes.Create()
+	updateCount := 0
+	tes.update = func(entityId string, entity Entity) error{
+		updateCount++
+		if updateCount < 3 {
+			return &ErrNonsequentialUpdate{EntityId: entityId}
+		}
+		return nil
+	}
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
+	s.Values[_ENTITY] = &testEntity{}
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, 3, updateCount, `update should have been attempted three times`)
+	assert.Equal(t, 200, w.Code, `response code should be 200`)
+}
+
+func Test_act_with_retry_policy_and_cancelled_request(t *testing.T) {
+	w, r := setup(nil, nil, func(json Json, userId string, e Entity)error{return nil}, _ACT, ``, Retry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}), EntityInSession())
+	tes.Create()
+	updateCount := 0
+	tes.update = func(entityId string, entity Entity) error{
+		updateCount++
+		return &ErrNonsequentialUpdate{EntityId: entityId}
+	}
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
+	s.Values[_ENTITY] = &testEntity{}
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+
+	tr.ServeHTTP(w, r.WithContext(ctx))
+
+	assert.Equal(t, 1, updateCount, `update should not have been retried`)
+	assert.Equal(t, 409, w.Code, `response code should be 409 for the unresolved conflict`)
+}
+
 func Test_leave_without_session(t *testing.T) {
 	w, r := setup(nil, nil, nil, _LEAVE, ``)
 
@@ -403,7 +904,7 @@ func Test_leave_without_session(t *testing.T) {
 }
 
 func Test_leave_with_session(t *testing.T) {
-	w, r := setup(nil, nil, nil, _LEAVE, ``)
+	w, r := setup(nil, nil, nil, _LEAVE, ``, EntityInSession())
 	tes.Create()
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
@@ -418,7 +919,7 @@ func Test_leave_with_session(t *testing.T) {
 }
 
 func Test_leave_with_session_entity_unregister_user_error(t *testing.T) {
-	w, r := setup(nil, nil, nil, _LEAVE, ``)
+	w, r := setup(nil, nil, nil, _LEAVE, ``, EntityInSession())
 	tes.Create()
 	s, _ := tss.Get(r, ``)
 	s.Values[_USER_ID] = `test_pre_set_user_id`
@@ -428,12 +929,12 @@ func Test_leave_with_session_entity_unregister_user_error(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_unregister_user_error\n", w.Body.String(), `response body should contain error`)
+	assertTestError(t, w, CodeInternal, "test_unregister_user_error")
 	assert.Equal(t, 500, w.Code, `response code should be 500`)
 }
 
 func Test_leave_with_read_error(t *testing.T) {
-	w, r := setup(nil, nil, nil, _LEAVE, ``)
+	w, r := setup(nil, nil, nil, _LEAVE, ``, EntityInSession())
 	tes.Create()
 	tes.readErr = errors.New(`test_read_error`)
 	s, _ := tss.Get(r, ``)
@@ -444,12 +945,12 @@ func Test_leave_with_read_error(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_read_error\n", w.Body.String(), `response body should contain error`)
+	assertTestError(t, w, CodeInternal, "test_read_error")
 	assert.Equal(t, 500, w.Code, `response code should be 500`)
 }
 
 func Test_leave_with_stored_entity_unregister_user_error(t *testing.T) {
-	w, r := setup(nil, nil, nil, _LEAVE, ``)
+	w, r := setup(nil, nil, nil, _LEAVE, ``, EntityInSession())
 	tes.Create()
 	tes.entity.unregisterUser = func(s string)error{return errors.New(`test_unregister_user_error`)}
 	s, _ := tss.Get(r, ``)
@@ -460,12 +961,40 @@ func Test_leave_with_stored_entity_unregister_user_error(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_unregister_user_error\n", w.Body.String(), `response body should contain error`)
+	assertTestError(t, w, CodeInternal, "test_unregister_user_error")
 	assert.Equal(t, 500, w.Code, `response code should be 500`)
 }
 
+func Test_leave_with_nonsequential_update(t *testing.T) {
+	w, r := setup(nil, nil, nil, _LEAVE, ``, EntityInSession())
+	tes.Create()
+	unregisterCount := 0
+	tes.entity.unregisterUser = func(s string)error{
+		unregisterCount++
+		return nil
+	}
+	updateCount := 0
+	tes.update = func(entityId string, entity Entity) error{
+		updateCount++
+		if updateCount == 1 {
+			return &ErrNonsequentialUpdate{EntityId: entityId}
+		}
+		return nil
+	}
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
+	s.Values[_ENTITY] = &testEntity{}
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, 2, unregisterCount, `UnregisterUser should have been retried on the stored entity`)
+	assert.Equal(t, 200, w.Code, `response code should be 200`)
+	assert.Nil(t, testSessionValue(_USER_ID), `session should have been cleared`)
+}
+
 func Test_leave_with_update_error(t *testing.T) {
-	w, r := setup(nil, nil, nil, _LEAVE, ``)
+	w, r := setup(nil, nil, nil, _LEAVE, ``, EntityInSession())
 	tes.Create()
 	tes.updateErr = errors.New(`test_update_error`)
 	s, _ := tss.Get(r, ``)
@@ -476,10 +1005,128 @@ func Test_leave_with_update_error(t *testing.T) {
 
 	tr.ServeHTTP(w, r)
 
-	assert.Equal(t, "test_update_error\n", w.Body.String(), `response body should contain error`)
+	assertTestError(t, w, CodeInternal, "test_update_error")
 	assert.Equal(t, 500, w.Code, `response code should be 500`)
 }
 
+func Test_create_without_existing_session_keeps_only_ids(t *testing.T){
+	w, r := setup(nil, nil, nil, _CREATE, ``)
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, `test_creator_user_id`, testSessionValue(_USER_ID), `session should have the provided user id`)
+	assert.Equal(t, `test_entity_id`, testSessionValue(_ENTITY_ID), `session should have the entityId`)
+	assert.Nil(t, testSessionValue(_ENTITY), `session should not have the entity`)
+}
+
+func Test_create_with_existing_session_reads_engagement_from_store(t *testing.T){
+	w, r := setup(nil, nil, nil, _CREATE, ``)
+	tes.Create()
+	tes.entityId = `test_new_entity_id`
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
+
+	tr.ServeHTTP(w, r)
+
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, `test_pre_set_entity_id`, resp[_ID].(string), `response json should have the existing entityId while the stored entity is active`)
+
+	tes.entity.isActive = func()bool{return false}
+	w = httptest.NewRecorder()
+	tr.ServeHTTP(w, r)
+
+	resp = Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, `test_new_entity_id`, resp[_ID].(string), `response json should have a new entityId once the stored entity is inactive`)
+	assert.Equal(t, `test_new_entity_id`, testSessionValue(_ENTITY_ID), `session should have the new entityId`)
+}
+
+func Test_join_with_existing_session_reads_engagement_from_store(t *testing.T){
+	w, r := setup(func(userId string, e Entity)Json{return Json{}}, nil, nil, _JOIN, `{"`+_ID+`":"req_test_entity_id"}`)
+	tes.Create()
+	registered := false
+	tes.entity.registerNewUser = func()(string, error){
+		registered = true
+		return `test_user_id`, nil
+	}
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
+
+	tr.ServeHTTP(w, r)
+
+	assert.False(t, registered, `user engaged in an active stored entity should not be registered`)
+	assert.Equal(t, `test_pre_set_user_id`, testSessionValue(_USER_ID), `session should have the existing user id`)
+	assert.Equal(t, 200, w.Code, `return code should be 200`)
+}
+
+func Test_act_reads_entity_from_store(t *testing.T) {
+	var actedOn []Entity
+	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{"test": "yo"}}, func(json Json, userId string, e Entity)error{
+		actedOn = append(actedOn, e)
+		return nil
+	}, _ACT, ``)
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
+	stale := &testEntity{}
+	s.Values[_ENTITY] = stale
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, []Entity{tes.entity}, actedOn, `performAct should only have been called on the stored entity`)
+	assert.Equal(t, 200, w.Code, `response code should be 200`)
+	assert.Equal(t, `test_pre_set_user_id`, testSessionValue(_USER_ID), `session should contain same userId`)
+	assert.Equal(t, `test_pre_set_entity_id`, testSessionValue(_ENTITY_ID), `session should contain same entityId`)
+}
+
+func Test_act_with_only_user_id_in_session(t *testing.T) {
+	w, r := setup(nil, nil, nil, _ACT, ``)
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w, CodeNotEngaged, "no entity in session")
+	assert.Equal(t, 403, w.Code, `response code should be 403`)
+}
+
+func Test_leave_unregisters_from_stored_entity(t *testing.T) {
+	w, r := setup(nil, nil, nil, _LEAVE, ``)
+	tes.Create()
+	var unregistered []string
+	tes.entity.unregisterUser = func(userId string)error{
+		unregistered = append(unregistered, userId)
+		return nil
+	}
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_pre_set_entity_id`
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, []string{`test_pre_set_user_id`}, unregistered, `user should have been unregistered once from the stored entity`)
+	assert.Equal(t, 200, w.Code, `response code should be 200`)
+	assert.Nil(t, testSessionValue(_ENTITY_ID), `session should have been cleared`)
+}
+
+func Test_poll_with_session_user_keeps_only_ids(t *testing.T) {
+	w, r := setup(nil, func(userId string, entity Entity)Json{return Json{}}, nil, _POLL, `{"`+_ID+`": "test_entity_id", "`+_VERSION+`": -1}`)
+	tes.Create()
+	s, _ := tss.Get(r, ``)
+	s.Values[_USER_ID] = `test_pre_set_user_id`
+	s.Values[_ENTITY_ID] = `test_entity_id`
+
+	tr.ServeHTTP(w, r)
+
+	assert.Equal(t, `test_pre_set_user_id`, testSessionValue(_USER_ID), `session userId should be unchanged`)
+	assert.Equal(t, `test_entity_id`, testSessionValue(_ENTITY_ID), `session entityId should be unchanged`)
+	assert.Nil(t, testSessionValue(_ENTITY), `session should not have the entity`)
+}
+
 /**
  * helpers
  */
@@ -490,11 +1137,13 @@ func readTestJson(w *httptest.ResponseRecorder, obj interface{}) error{
 	return js.Unmarshal(w.Body.Bytes(), obj)
 }
 
-func setup(gjr GetJoinResp, gecr GetEntityChangeResp, pa PerformAct, path string, reqJson string) (*httptest.ResponseRecorder, *http.Request){
+func setup(gjr GetJoinResp, gecr GetEntityChangeResp, pa PerformAct, path string, reqJson string, opts ...Option) (*httptest.ResponseRecorder, *http.Request){
 	tss = &testSessionStore{}
 	tes = &testEntityStore{}
 	tr = mux.NewRouter()
-	Route(tr, tss, `test_session`, &testEntity{}, func(r *http.Request)EntityStore{return tes}, gjr, gecr, pa)
+	//handlers still running from an earlier test keep using its store
+	store := tes
+	Route(tr, tss, `test_session`, &testEntity{}, func(r *http.Request)EntityStore{return store}, gjr, gecr, pa, opts...)
 	w := httptest.NewRecorder()
 	var r *http.Request
 	if reqJson != `` {
@@ -505,6 +1154,18 @@ func setup(gjr GetJoinResp, gecr GetEntityChangeResp, pa PerformAct, path string
 	return w, r
 }
 
+func assertTestError(t *testing.T, w *httptest.ResponseRecorder, code ErrorCode, message string) {
+	e := &Error{}
+	readTestJson(w, e)
+	assert.Equal(t, `application/json`, w.Header().Get(`Content-Type`), `error response should be json`)
+	assert.Equal(t, code, e.Code, `response body should have the error code`)
+	assert.Equal(t, message, e.Message, `response body should have the error message`)
+}
+
+type nonFlushingWriter struct{
+	http.ResponseWriter
+}
+
 /**
  * Session
  */
@@ -533,6 +1194,36 @@ func (tss *testSessionStore) Save(r *http.Request, w http.ResponseWriter, s *ses
 	return nil
 }
 
+// newTestCookieStore gives every request without a cookie its own session, for tests making concurrent requests.
+func newTestCookieStore() sessions.Store {
+	return sessions.NewCookieStore([]byte(`test_session_key`))
+}
+
+// testSessionValue gives a value of the test session's entity as sessions held them before they could hold many.
+func testSessionValue(key string) interface{} {
+	entities, _ := tss.session.Values[_ENTITIES].(map[string]*sessionEntry)
+	if len(entities) != 1 {
+		return tss.session.Values[key]
+	}
+	for entityId, entry := range entities {
+		switch key {
+		case _USER_ID:
+			return entry.UserId
+		case _ENTITY_ID:
+			return entityId
+		case _ENTITY:
+			if entry.Entity != nil {
+				return entry.Entity
+			}
+		case _SPECTATOR:
+			if entry.Spectator {
+				return true
+			}
+		}
+	}
+	return nil
+}
+
 /**
  * Entity
  */
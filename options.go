@@ -0,0 +1,232 @@
+package oak
+
+import(
+	`time`
+	`net/http`
+)
+
+// Op identifies one of the operations oak performs, it is used to select per operation
+// behaviour such as paths, methods and retry policies.
+type Op string
+
+const (
+	OpCreate	= Op(`create`)
+	OpJoin		= Op(`join`)
+	OpWatch		= Op(`watch`)
+	OpPoll		= Op(`poll`)
+	OpStream	= Op(`stream`)
+	OpSocket	= Op(`socket`)
+	OpAct		= Op(`act`)
+	OpLeave		= Op(`leave`)
+	OpKick		= Op(`kick`)
+)
+
+// routeOps are the operations with their own route in the order they are registered.
+var routeOps = []Op{OpCreate, OpJoin, OpWatch, OpPoll, OpStream, OpAct, OpLeave, OpSocket}
+
+var defaultPaths = map[Op]string{
+	OpCreate: _CREATE,
+	OpJoin: _JOIN,
+	OpWatch: _WATCH,
+	OpPoll: _POLL,
+	OpStream: _STREAM,
+	OpSocket: _SOCKET,
+	OpAct: _ACT,
+	OpLeave: _LEAVE,
+}
+
+// DefaultMaxBodySize is the most bytes of a request body a Server reads unless MaxBodySize is given.
+const DefaultMaxBodySize = 1 << 20
+
+// Option configures optional behaviour of a Server.
+type Option func(*options)
+
+// ErrorHandler writes the response for an error returned while handling a request.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// Middleware wraps the handler of an operation, it is applied to the http routes and to
+// the same operations carried over websockets.
+type Middleware func(op Op, next http.Handler) http.Handler
+
+type options struct{
+	entityType string
+	pathPrefix string
+	paths map[Op]string
+	methods map[Op][]string
+	disabled map[Op]bool
+	errorHandler ErrorHandler
+	middlewares []Middleware
+	longPollTimeout time.Duration
+	longPollKickInterval time.Duration
+	streamKickInterval time.Duration
+	retryPolicy RetryPolicy
+	retryPolicies map[Op]RetryPolicy
+	entityInSession bool
+	idempotencyStore IdempotencyStore
+	deltaViews int
+	deltaVersions int
+	codecs map[string]Codec
+	maxBodySize int64
+	hooks Hooks
+	kickStore EntityStore
+	kickRetryDelay time.Duration
+	idleTimeout time.Duration
+	presenceStore EntityStore
+	maxEntities int
+	socketOrigins map[string]bool
+	spectatorTimeout time.Duration
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		paths: map[Op]string{},
+		methods: map[Op][]string{},
+		disabled: map[Op]bool{},
+		errorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			writeError(w, r, err)
+		},
+		retryPolicy: DefaultRetryPolicy,
+		retryPolicies: map[Op]RetryPolicy{},
+		codecs: defaultCodecs(),
+		maxBodySize: DefaultMaxBodySize,
+		maxEntities: 1,
+		socketOrigins: map[string]bool{},
+		spectatorTimeout: DefaultSpectatorTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *options) getPath(op Op) string {
+	if path, exists := o.paths[op]; exists {
+		return path
+	}
+	return defaultPaths[op]
+}
+
+func (o *options) routePrefix() string {
+	if o.pathPrefix == `` && o.entityType != `` {
+		return `/` + o.entityType
+	}
+	return o.pathPrefix
+}
+
+// EntityType names the Server's entity type so Servers of several types, e.g. "chess", "lobby" and "chat",
+// can be routed on one router sharing the same SessionStore and SessionName so a user's session is the same
+// across them. The type's routes are mounted under "/" + name unless PathPrefix is given, and the entities
+// a user is in are kept in the session per type so each type's MaxEntities, /act and /leave only see their own.
+// Sessions from before a Server was given an EntityType are not read by it.
+func EntityType(name string) Option {
+	return func(o *options) {
+		o.entityType = name
+	}
+}
+
+// PathPrefix mounts all routes under prefix, e.g. "/api/game".
+func PathPrefix(prefix string) Option {
+	return func(o *options) {
+		o.pathPrefix = prefix
+	}
+}
+
+// Path overrides the path of an operation's route, e.g. Path(OpAct, "/move").
+func Path(op Op, path string) Option {
+	return func(o *options) {
+		o.paths[op] = path
+	}
+}
+
+// Methods restricts an operation's route to the given http methods, by default any method is accepted.
+func Methods(op Op, methods ...string) Option {
+	return func(o *options) {
+		o.methods[op] = methods
+	}
+}
+
+// Disable does not register the given operations, neither as http routes nor over websockets,
+// Disable(OpStream, OpSocket) leaves only the plain http transport.
+func Disable(ops ...Op) Option {
+	return func(o *options) {
+		for _, op := range ops {
+			o.disabled[op] = true
+		}
+	}
+}
+
+// OnError replaces the default json error responses, AsError gives the status and body they would have had.
+func OnError(handler ErrorHandler) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// Wrap adds a middleware around every operation's handler, the first added is the outermost.
+func Wrap(middleware Middleware) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, middleware)
+	}
+}
+
+// LongPoll makes /poll block until the entity's version changes or timeout elapses,
+// in which case the usual empty response is sent. Changes are signalled by updates
+// made through oak in this process, while waiting the entity is kicked every kickInterval
+// so time based transitions are still picked up, kickInterval <= 0 disables this.
+func LongPoll(timeout time.Duration, kickInterval time.Duration) Option {
+	return func(o *options) {
+		o.longPollTimeout = timeout
+		o.longPollKickInterval = kickInterval
+	}
+}
+
+// StreamKickInterval sets how often entities are kicked while /stream and /socket connections wait
+// for changes so time based transitions are pushed to clients, by default they are not kicked.
+func StreamKickInterval(kickInterval time.Duration) Option {
+	return func(o *options) {
+		o.streamKickInterval = kickInterval
+	}
+}
+
+// SocketOrigins allows pages from the given origins, e.g. "https://play.example.com", to open /socket.
+// By default browsers may only open it from pages served by the same host, as the socket is authenticated
+// by the session cookie any other site could otherwise act for a user. "*" allows any origin.
+func SocketOrigins(origins ...string) Option {
+	return func(o *options) {
+		for _, origin := range origins {
+			o.socketOrigins[origin] = true
+		}
+	}
+}
+
+// EntityInSession keeps a copy of the user's entity in their session as well as their user and entity ids,
+// as oak originally did, for stores which must not be read to check the session is still engaged.
+// The copy is gob encoded into the session so with cookie sessions large entities can exceed browser limits.
+// By default only the ids are kept and the entity is always loaded from the EntityStore.
+func EntityInSession() Option {
+	return func(o *options) {
+		o.entityInSession = true
+	}
+}
+
+// MaxBodySize sets the most bytes of a request body a Server reads, larger bodies are rejected
+// as CodeTooLarge, size <= 0 removes the limit.
+func MaxBodySize(size int64) Option {
+	return func(o *options) {
+		o.maxBodySize = size
+	}
+}
+
+// MaxEntities sets how many active entities a user may play in at once through one session, by default 1.
+// A user in max entities can't /create or /join another, with the default /create responds with the entity
+// they are in as it always has. Users in more than one entity must give the entity's id as entityId with /act,
+// so it can't clash with the act's own values, and /leave leaves every entity the user is in unless it is given
+// one as entityId, or as id like /join, /watch and /poll take it.
+func MaxEntities(max int) Option {
+	return func(o *options) {
+		if max < 1 {
+			max = 1
+		}
+		o.maxEntities = max
+	}
+}
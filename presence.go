@@ -0,0 +1,262 @@
+package oak
+
+import(
+	`sort`
+	`sync`
+	`time`
+	`errors`
+	`context`
+)
+
+// Presence tracks when each user last polled, acted or joined their entity, and holds them online
+// while they have a /stream or /socket open. Once a user has been idle for idleTimeout they are
+// unregistered with Entity.UnregisterUser and the entity stored, as /leave does, by a background
+// worker run by Server.Start which reads entities from store and sweeps every half idleTimeout.
+// The BeforeLeave and OnLeave hooks run for these leaves without a Request. The entity is taken out of
+// the idle user's session the next time it is seen, so they can /join or /create again as after a /leave.
+// Idle spectators are dropped from the entity's spectators without updating it.
+// Sockets poll every half idleTimeout to keep their users online.
+func Presence(idleTimeout time.Duration, store EntityStore) Option {
+	return func(o *options) {
+		o.idleTimeout = idleTimeout
+		o.presenceStore = store
+	}
+}
+
+type onlineUsersKey struct{}
+
+// OnlineUsers gives the users online in the entity, sorted and without its spectators, from the context
+// GetJoinRespContext and GetEntityChangeRespContext are called with. It is nil unless the Server was given Presence.
+func OnlineUsers(ctx context.Context) []string {
+	if online, ok := ctx.Value(onlineUsersKey{}).(func() []string); ok {
+		return online()
+	}
+	return nil
+}
+
+// presenceContext adds the entity's online users to ctx for OnlineUsers.
+func (srv *Server) presenceContext(ctx context.Context, entityId string) context.Context {
+	if srv.presence == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, onlineUsersKey{}, func() []string {
+		online := []string{}
+		for _, userId := range srv.presence.online(entityId, time.Now()) {
+			if !srv.spectators.has(entityId, userId) {
+				online = append(online, userId)
+			}
+		}
+		return online
+	})
+}
+
+// presence is the last activity of the users of each entity and the worker unregistering idle ones.
+type presence struct{
+	mtx sync.Mutex
+	idleTimeout time.Duration
+	store ContextEntityStore
+	entities map[string]map[string]*presenceRecord
+	left map[presenceKey]bool
+	worker worker
+}
+
+type presenceRecord struct{
+	lastSeen time.Time
+	holds int
+}
+
+type presenceKey struct{
+	entityId string
+	userId string
+}
+
+func newPresence(idleTimeout time.Duration, store EntityStore) *presence {
+	return &presence{
+		idleTimeout: idleTimeout,
+		store: AdaptEntityStore(store),
+		entities: map[string]map[string]*presenceRecord{},
+		left: map[presenceKey]bool{},
+	}
+}
+
+func (p *presence) record(entityId string, userId string) *presenceRecord {
+	users, exists := p.entities[entityId]
+	if !exists {
+		users = map[string]*presenceRecord{}
+		p.entities[entityId] = users
+	}
+	record, exists := users[userId]
+	if !exists {
+		record = &presenceRecord{}
+		users[userId] = record
+	}
+	return record
+}
+
+// seen records activity from the user now.
+func (p *presence) seen(entityId string, userId string) {
+	if p == nil || userId == `` {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.record(entityId, userId).lastSeen = time.Now()
+}
+
+// hold keeps the user online until the returned func is called.
+func (p *presence) hold(entityId string, userId string) func() {
+	if p == nil || userId == `` {
+		return func() {}
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.record(entityId, userId).holds++
+	return func() {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		if record, exists := p.entities[entityId][userId]; exists {
+			record.holds--
+			record.lastSeen = time.Now()
+		}
+	}
+}
+
+// forget stops tracking the user, or every user of the entity if userId is empty.
+func (p *presence) forget(entityId string, userId string) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if userId == `` {
+		delete(p.entities, entityId)
+		for key := range p.left {
+			if key.entityId == entityId {
+				delete(p.left, key)
+			}
+		}
+		return
+	}
+	delete(p.left, presenceKey{entityId, userId})
+	delete(p.entities[entityId], userId)
+	if len(p.entities[entityId]) == 0 {
+		delete(p.entities, entityId)
+	}
+}
+
+// sweptOut stops tracking the user and remembers they were unregistered while idle, until their
+// session lets go of the entity or the entity is forgotten.
+func (p *presence) sweptOut(key presenceKey) {
+	p.forget(key.entityId, key.userId)
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.left[key] = true
+}
+
+func (p *presence) hasLeft(entityId string, userId string) bool {
+	if p == nil || userId == `` {
+		return false
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.left[presenceKey{entityId, userId}]
+}
+
+func (p *presence) isIdle(record *presenceRecord, now time.Time) bool {
+	return record.holds == 0 && !now.Before(record.lastSeen.Add(p.idleTimeout))
+}
+
+func (p *presence) online(entityId string, now time.Time) []string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	online := []string{}
+	for userId, record := range p.entities[entityId] {
+		if !p.isIdle(record, now) {
+			online = append(online, userId)
+		}
+	}
+	sort.Strings(online)
+	return online
+}
+
+func (p *presence) idle(now time.Time) []presenceKey {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	idle := []presenceKey{}
+	for entityId, users := range p.entities {
+		for userId, record := range users {
+			if p.isIdle(record, now) {
+				idle = append(idle, presenceKey{entityId, userId})
+			}
+		}
+	}
+	return idle
+}
+
+func (p *presence) stillIdle(key presenceKey, now time.Time) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	record, exists := p.entities[key.entityId][key.userId]
+	return exists && p.isIdle(record, now)
+}
+
+var errNoLongerIdle = errors.New(`user is no longer idle`)
+
+func (srv *Server) runPresence(ctx context.Context, stopping <-chan struct{}) {
+	ticker := time.NewTicker(srv.presence.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-ticker.C:
+		}
+		srv.sweepIdle(ctx, stopping, time.Now())
+	}
+}
+
+// sweepIdle unregisters the users idle as of now.
+func (srv *Server) sweepIdle(ctx context.Context, stopping <-chan struct{}, now time.Time) {
+	for _, key := range srv.presence.idle(now) {
+		select {
+		case <-stopping:
+			return
+		default:
+		}
+		srv.unregisterIdle(ctx, key, now)
+	}
+}
+
+// unregisterIdle leaves the entity on behalf of a user idle as of now, failures are tried again on the next sweep.
+func (srv *Server) unregisterIdle(ctx context.Context, key presenceKey, now time.Time) {
+	p := srv.presence
+	if srv.spectators.has(key.entityId, key.userId) {
+		if p.stillIdle(key, now) {
+			srv.spectators.remove(key.entityId, key.userId)
+			p.forget(key.entityId, key.userId)
+		}
+		return
+	}
+	var before Entity
+	entity, err := srv.retryUpdate(ctx, OpLeave, key.entityId, p.store, nil, func() (Entity, error) {
+		return p.store.ReadContext(ctx, key.entityId)
+	}, func(e Entity) error {
+		if !e.IsActive() || !p.stillIdle(key, now) {
+			return errNoLongerIdle
+		}
+		before = srv.opts.hooks.OnLeave.before(e)
+		if err := srv.opts.hooks.BeforeLeave.run(&HookEvent{Op: OpLeave, Context: ctx, UserId: key.userId, EntityId: key.entityId, Entity: e}); err != nil {
+			return err
+		}
+		return e.UnregisterUser(key.userId)
+	})
+	switch {
+	case err == nil:
+		p.sweptOut(key)
+		srv.opts.hooks.OnLeave.run(&HookEvent{Op: OpLeave, Context: ctx, UserId: key.userId, EntityId: key.entityId, Entity: entity, Before: before})
+	case AsError(err).Code == CodeNotFound:
+		p.forget(key.entityId, ``)
+	case err == errNoLongerIdle && !entity.IsActive():
+		p.forget(key.entityId, ``)
+	}
+}
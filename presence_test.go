@@ -0,0 +1,210 @@
+package oak
+
+import(
+	`time`
+	`errors`
+	`context`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_presence_tracking(t *testing.T) {
+	p := newPresence(time.Minute, nil)
+	now := time.Now()
+
+	p.seen(`test_entity_id`, `test_user_b`)
+	p.seen(`test_entity_id`, `test_user_a`)
+	p.seen(`test_entity_id`, ``)
+	release := p.hold(`test_entity_id`, `test_user_c`)
+	p.seen(`test_other_entity_id`, `test_user_d`)
+
+	assert.Equal(t, []string{`test_user_a`, `test_user_b`, `test_user_c`}, p.online(`test_entity_id`, now), `seen and held users should be online`)
+	assert.Equal(t, []string{`test_user_c`}, p.online(`test_entity_id`, now.Add(time.Hour)), `held users should stay online`)
+	assert.Equal(t, 3, len(p.idle(now.Add(time.Hour))), `users not held should go idle`)
+
+	release()
+	assert.Equal(t, 4, len(p.idle(now.Add(time.Hour))), `released users should go idle`)
+	assert.Equal(t, 0, len(p.idle(now)), `no one should be idle yet`)
+
+	p.forget(`test_entity_id`, `test_user_a`)
+	assert.Equal(t, []string{`test_user_b`, `test_user_c`}, p.online(`test_entity_id`, now), `forgotten user should not be online`)
+	p.forget(`test_entity_id`, ``)
+	assert.Equal(t, []string{}, p.online(`test_entity_id`, now), `forgotten entity should have no one online`)
+
+	var nilPresence *presence
+	nilPresence.seen(`test_entity_id`, `test_user_a`)
+	nilPresence.hold(`test_entity_id`, `test_user_a`)()
+	nilPresence.forget(`test_entity_id`, `test_user_a`)
+	assert.Nil(t, OnlineUsers(context.Background()), `online users should be nil without presence`)
+}
+
+func Test_presence_unregisters_idle_users(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	left := make(chan *HookEvent, 1)
+	srv := setupServer(store, presenceTestConf, Presence(time.Minute, store), Hook(Hooks{
+		OnLeave: func(e *HookEvent) {
+			left <- e
+		},
+	}))
+	entityId, _, _ := store.Create()
+
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	w := serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"`+entityId+`","`+_VERSION+`":0}`)
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, []interface{}{`test_user_1`}, resp[`online`], `polling user should be online`)
+
+	srv.sweepIdle(context.Background(), nil, time.Now().Add(30 * time.Second))
+	assert.Equal(t, 0, len(left), `user should not be unregistered before the idle timeout`)
+
+	srv.sweepIdle(context.Background(), nil, time.Now().Add(time.Hour))
+	e := <-left
+	assert.Equal(t, `test_user_1`, e.UserId, `idle user should leave`)
+	assert.Nil(t, e.Request, `idle leave should have no request`)
+	entity, _ := store.Read(entityId)
+	assert.Empty(t, entity.(*storeTestEntity).Users, `unregistration should be stored`)
+	assert.Equal(t, []string{}, srv.presence.online(entityId, time.Now()), `idle user should be forgotten`)
+}
+
+func Test_presence_unregisters_idle_creators(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{Creator: `test_creator_user_id`, Users: []string{`test_creator_user_id`}}})
+	left := make(chan *HookEvent, 1)
+	srv := setupServer(store, presenceTestConf, Presence(time.Minute, store), Hook(Hooks{
+		OnLeave: func(e *HookEvent) {
+			left <- e
+		},
+	}))
+
+	resp := Json{}
+	readTestJson(serveTestRequest(`POST`, _CREATE, ``), &resp)
+	entityId := resp[_ID].(string)
+	assert.Equal(t, []string{`test_creator_user_id`}, srv.presence.online(entityId, time.Now()), `creator should be online`)
+
+	srv.sweepIdle(context.Background(), nil, time.Now().Add(time.Hour))
+	e := <-left
+	assert.Equal(t, `test_creator_user_id`, e.UserId, `idle creator should leave`)
+	entity, _ := store.Read(entityId)
+	assert.Empty(t, entity.(*storeTestEntity).Users, `unregistration should be stored`)
+}
+
+func Test_presence_keeps_active_users(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	srv := setupServer(store, presenceTestConf, Presence(time.Minute, store))
+	entityId, _, _ := store.Create()
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+
+	srv.Start()
+	assert.Nil(t, srv.Stop(context.Background()), `stop should not error`)
+
+	serveTestRequest(`POST`, _ACT, `{}`)
+	srv.unregisterIdle(context.Background(), presenceKey{entityId, `test_user_1`}, time.Now().Add(30 * time.Second))
+	entity, _ := store.Read(entityId)
+	assert.Equal(t, []string{`test_user_1`}, entity.(*storeTestEntity).Users, `acting user should stay registered`)
+
+	srv.presence.forget(entityId, `test_user_1`)
+	srv.unregisterIdle(context.Background(), presenceKey{entityId, `test_user_1`}, time.Now().Add(time.Hour))
+	entity, _ = store.Read(entityId)
+	assert.Equal(t, []string{`test_user_1`}, entity.(*storeTestEntity).Users, `users who are not idle should not be unregistered`)
+
+	srv.presence.seen(`test_unknown_entity_id`, `test_user_1`)
+	srv.unregisterIdle(context.Background(), presenceKey{`test_unknown_entity_id`, `test_user_1`}, time.Now().Add(time.Hour))
+	assert.Equal(t, 0, len(srv.presence.entities), `unknown entities should be forgotten`)
+}
+
+func Test_presence_drops_idle_spectators(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	srv := setupServer(store, presenceTestConf, Presence(time.Minute, store))
+	entityId, _, _ := store.Create()
+	serveTestRequest(`POST`, _WATCH, `{"`+_ID+`":"`+entityId+`"}`)
+	spectatorId := testSessionValue(_USER_ID).(string)
+
+	resp := Json{}
+	readTestJson(serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"`+entityId+`","`+_VERSION+`":-1}`), &resp)
+	assert.Equal(t, []interface{}{}, resp[`online`], `spectators should not be online users`)
+
+	srv.unregisterIdle(context.Background(), presenceKey{entityId, spectatorId}, time.Now())
+	assert.True(t, srv.spectators.has(entityId, spectatorId), `spectators who are not idle should be kept`)
+
+	srv.unregisterIdle(context.Background(), presenceKey{entityId, spectatorId}, time.Now().Add(time.Hour))
+	assert.False(t, srv.spectators.has(entityId, spectatorId), `idle spectators should be dropped`)
+	entity, _ := store.Read(entityId)
+	assert.Equal(t, 0, entity.GetVersion(), `dropping spectators should not update the entity`)
+}
+
+func Test_presence_lets_go_of_swept_entities_in_sessions(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &strictTestEntity{}})
+	srv := setupServer(store, Config{
+		Entity: &strictTestEntity{},
+		PerformAct: func(json Json, userId string, e Entity)error{
+			e.(*strictTestEntity).Version++
+			return nil
+		},
+	}, Presence(time.Minute, store))
+	entityId, _, _ := store.Create()
+	users := func() []string {
+		entity, _ := store.Read(entityId)
+		return entity.(*strictTestEntity).Users
+	}
+
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	srv.sweepIdle(context.Background(), nil, time.Now().Add(time.Hour))
+	assert.Empty(t, users(), `idle user should be unregistered`)
+	w := serveTestRequest(`POST`, _LEAVE, ``)
+	assert.Equal(t, 200, w.Code, `leave should not unregister the swept user again`)
+	assert.Empty(t, tss.session.Values, `session should be cleared`)
+
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	srv.sweepIdle(context.Background(), nil, time.Now().Add(time.Hour))
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	assert.Equal(t, []string{`test_user_1`}, users(), `swept user should join again`)
+	w = serveTestRequest(`POST`, _ACT, `{}`)
+	assert.Equal(t, 200, w.Code, `rejoined user given their old id should keep the entity in their session`)
+
+	srv.sweepIdle(context.Background(), nil, time.Now().Add(time.Hour))
+	resp := Json{}
+	readTestJson(serveTestRequest(`POST`, _CREATE, ``), &resp)
+	assert.NotEqual(t, entityId, resp[_ID], `swept user should create a new entity`)
+	w = serveTestRequest(`POST`, _LEAVE, `{"`+_ID+`":"`+entityId+`"}`)
+	assert.Equal(t, 200, w.Code, `leaving the swept entity should do nothing`)
+}
+
+/**
+ * helpers
+ */
+
+// presenceTestConf responds to changes with the online users.
+var presenceTestConf = Config{
+	GetEntityChangeRespContext: func(ctx context.Context, userId string, e Entity)Json{return Json{`online`: OnlineUsers(ctx)}},
+}
+
+// strictTestEntity errors when unregistering users it doesn't have.
+type strictTestEntity storeTestEntity
+
+func (e *strictTestEntity) GetVersion() int {
+	return (*storeTestEntity)(e).GetVersion()
+}
+
+func (e *strictTestEntity) IsActive() bool {
+	return (*storeTestEntity)(e).IsActive()
+}
+
+func (e *strictTestEntity) CreatedBy() string {
+	return (*storeTestEntity)(e).CreatedBy()
+}
+
+func (e *strictTestEntity) RegisterNewUser() (string, error) {
+	return (*storeTestEntity)(e).RegisterNewUser()
+}
+
+func (e *strictTestEntity) UnregisterUser(userId string) error {
+	for _, user := range e.Users {
+		if user == userId {
+			return (*storeTestEntity)(e).UnregisterUser(userId)
+		}
+	}
+	return errors.New(`unknown user ` + userId)
+}
+
+func (e *strictTestEntity) Kick() bool {
+	return (*storeTestEntity)(e).Kick()
+}
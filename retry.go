@@ -0,0 +1,93 @@
+package oak
+
+import(
+	`time`
+	`context`
+	`math/rand`
+)
+
+// RetryPolicy controls how often an operation is reattempted against the latest stored
+// entity after the EntityStore rejects its update with ErrNonsequentialUpdate.
+// MaxAttempts includes the first attempt, so a value <= 1 never retries.
+// The wait before the nth retry is InitialBackoff * Multiplier^(n-1) capped at MaxBackoff
+// (when > 0), Jitter is the fraction (0 to 1) of each wait that is randomised away.
+type RetryPolicy struct{
+	MaxAttempts int
+	InitialBackoff time.Duration
+	MaxBackoff time.Duration
+	Multiplier float64
+	Jitter float64
+}
+
+// DefaultRetryPolicy retries conflicting updates once without waiting.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 2}
+
+// Retry sets the retry policy used by all operations without their own override.
+func Retry(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = policy
+	}
+}
+
+// RetryOp overrides the retry policy for a single operation, one of OpKick, OpJoin, OpAct or OpLeave.
+func RetryOp(op Op, policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicies[op] = policy
+	}
+}
+
+func (o *options) getRetryPolicy(op Op) RetryPolicy {
+	if policy, exists := o.retryPolicies[op]; exists {
+		return policy
+	}
+	return o.retryPolicy
+}
+
+// shouldRetry reports whether another attempt may follow the given failed attempt (1 based).
+func (p RetryPolicy) shouldRetry(attempt int, err error) bool {
+	return attempt < p.MaxAttempts && isNonsequentialUpdate(err)
+}
+
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	if p.InitialBackoff <= 0 {
+		return 0
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	backoff := float64(p.InitialBackoff)
+	for i := 1; i < retry; i++ {
+		backoff *= multiplier
+		if p.MaxBackoff > 0 && backoff >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		backoff -= backoff * jitter * rand.Float64()
+	}
+	return time.Duration(backoff)
+}
+
+// wait sleeps for the backoff before the given retry, returning early with the context's error if it is done first.
+func (p RetryPolicy) wait(ctx context.Context, retry int) error {
+	backoff := p.backoff(retry)
+	if backoff <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,51 @@
+package oak
+
+import(
+	`time`
+	`errors`
+	`context`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_retry_policy_should_retry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3}
+
+	assert.True(t, policy.shouldRetry(2, &ErrNonsequentialUpdate{}), `nonsequential errors should be retried within max attempts`)
+	assert.False(t, policy.shouldRetry(3, &ErrNonsequentialUpdate{}), `nonsequential errors should not be retried past max attempts`)
+	assert.False(t, policy.shouldRetry(1, errors.New(`test_error`)), `other errors should not be retried`)
+	assert.False(t, RetryPolicy{}.shouldRetry(1, &ErrNonsequentialUpdate{}), `zero policy should never retry`)
+}
+
+func Test_retry_policy_backoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 2}
+
+	assert.Equal(t, 10 * time.Millisecond, policy.backoff(1), `first retry should wait the initial backoff`)
+	assert.Equal(t, 20 * time.Millisecond, policy.backoff(2), `second retry should wait double`)
+	assert.Equal(t, 40 * time.Millisecond, policy.backoff(3), `third retry should wait quadruple`)
+	assert.Equal(t, 50 * time.Millisecond, policy.backoff(4), `backoff should be capped`)
+	assert.Equal(t, 50 * time.Millisecond, policy.backoff(1000), `backoff should be capped`)
+	assert.Equal(t, 10 * time.Millisecond, RetryPolicy{InitialBackoff: 10 * time.Millisecond}.backoff(5), `missing multiplier should keep a constant backoff`)
+	assert.Equal(t, time.Duration(0), RetryPolicy{}.backoff(5), `missing initial backoff should not wait`)
+}
+
+func Test_retry_policy_backoff_with_jitter(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 10 * time.Millisecond, Jitter: 0.5}
+	fullJitter := RetryPolicy{InitialBackoff: 10 * time.Millisecond, Jitter: 2}
+
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(1)
+		assert.True(t, backoff > 5 * time.Millisecond && backoff <= 10 * time.Millisecond, `jittered backoff should be within the jitter fraction`)
+		assert.True(t, fullJitter.backoff(1) <= 10 * time.Millisecond, `jitter should be capped at 1`)
+	}
+}
+
+func Test_retry_policy_wait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	assert.Nil(t, RetryPolicy{InitialBackoff: time.Millisecond}.wait(ctx, 1), `wait should return nil after the backoff`)
+	assert.Nil(t, RetryPolicy{}.wait(ctx, 1), `wait without backoff should return immediately`)
+	cancel()
+	assert.Equal(t, context.Canceled, RetryPolicy{InitialBackoff: time.Hour}.wait(ctx, 1), `wait should return the context error when cancelled`)
+	assert.Equal(t, context.Canceled, RetryPolicy{}.wait(ctx, 1), `wait without backoff should return the context error when cancelled`)
+}
@@ -0,0 +1,219 @@
+package oak
+
+import(
+	`sync`
+	`time`
+	`context`
+	`container/heap`
+)
+
+// DefaultKickRetryDelay is used by ScheduleKicks when it is given a retryDelay <= 0.
+const DefaultKickRetryDelay = time.Second
+
+// TimedEntity is implemented by entities with time based transitions, such as turn timers or
+// expiry, so they can be kicked on time by the scheduler ScheduleKicks enables.
+// NextKickAt gives when the entity next needs kicking, the zero time if it doesn't.
+type TimedEntity interface{
+	NextKickAt() time.Time
+}
+
+// ScheduleKicks makes the Server kick entities implementing TimedEntity at their NextKickAt even
+// when no client is connected. Entities are scheduled whenever oak reads, creates or updates them,
+// use Server.ScheduleKick to schedule entities from before a restart. Kicks are made by a
+// background worker run by Server.Start, reading entities from store as there is no request to give
+// EntityStoreFactory, with OpKick's retry policy. Kicks which fail, or leave the entity still due,
+// are tried again after retryDelay. Entities which no longer exist are dropped.
+func ScheduleKicks(store EntityStore, retryDelay time.Duration) Option {
+	return func(o *options) {
+		o.kickStore = store
+		o.kickRetryDelay = retryDelay
+	}
+}
+
+// ScheduleKick schedules a kick of the entity at the given time, replacing any it has,
+// the zero time unschedules it. It does nothing unless ScheduleKicks was given.
+func (srv *Server) ScheduleKick(entityId string, at time.Time) {
+	if srv.kicks != nil {
+		srv.kicks.schedule(entityId, at)
+	}
+}
+
+func (srv *Server) runKicks(ctx context.Context, stopping <-chan struct{}) {
+	sch := srv.kicks
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if at, scheduled := sch.nextAt(); scheduled {
+			timer = time.NewTimer(time.Until(at))
+			due = timer.C
+		}
+		select {
+		case <-stopping:
+			return
+		case <-sch.wake:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		for {
+			select {
+			case <-stopping:
+				return
+			default:
+			}
+			entityId, isDue := sch.popDue(time.Now())
+			if !isDue {
+				break
+			}
+			srv.kickScheduled(ctx, entityId)
+		}
+	}
+}
+
+func (srv *Server) kickScheduled(ctx context.Context, entityId string) {
+	sch := srv.kicks
+	now := time.Now()
+	if _, err := srv.fetchEntity(ctx, entityId, sch.store); err != nil {
+		switch {
+		case ctx.Err() != nil:
+			//stopped mid kick so it is made on the next Start
+			sch.schedule(entityId, now)
+		case AsError(err).Code != CodeNotFound:
+			sch.schedule(entityId, now.Add(sch.retryDelay))
+		}
+		return
+	}
+	//an entity still due after its kick would otherwise be kicked again straight away
+	if at, scheduled := sch.scheduledAt(entityId); scheduled && !at.After(now) {
+		sch.schedule(entityId, now.Add(sch.retryDelay))
+	}
+}
+
+// trackKicks schedules the entity's next kick if it is a TimedEntity and kicks are scheduled.
+func (srv *Server) trackKicks(entityId string, entity Entity) {
+	if srv.kicks == nil {
+		return
+	}
+	if timed, ok := entity.(TimedEntity); ok {
+		srv.kicks.schedule(entityId, timed.NextKickAt())
+	}
+}
+
+// kickScheduler is the queue of scheduled kicks, earliest first, and its worker.
+type kickScheduler struct{
+	mtx sync.Mutex
+	store ContextEntityStore
+	retryDelay time.Duration
+	queue kickQueue
+	items map[string]*kickItem
+	wake chan struct{}
+	worker worker
+}
+
+func newKickScheduler(store EntityStore, retryDelay time.Duration) *kickScheduler {
+	if retryDelay <= 0 {
+		retryDelay = DefaultKickRetryDelay
+	}
+	return &kickScheduler{
+		store: AdaptEntityStore(store),
+		retryDelay: retryDelay,
+		items: map[string]*kickItem{},
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (sch *kickScheduler) schedule(entityId string, at time.Time) {
+	sch.mtx.Lock()
+	defer sch.mtx.Unlock()
+	item, exists := sch.items[entityId]
+	switch {
+	case at.IsZero() && exists:
+		heap.Remove(&sch.queue, item.index)
+		delete(sch.items, entityId)
+		return
+	case at.IsZero():
+		return
+	case exists:
+		item.at = at
+		heap.Fix(&sch.queue, item.index)
+	default:
+		item = &kickItem{entityId: entityId, at: at}
+		sch.items[entityId] = item
+		heap.Push(&sch.queue, item)
+	}
+	if item.index == 0 {
+		//the worker is waiting for a later kick
+		select {
+		case sch.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (sch *kickScheduler) scheduledAt(entityId string) (time.Time, bool) {
+	sch.mtx.Lock()
+	defer sch.mtx.Unlock()
+	if item, exists := sch.items[entityId]; exists {
+		return item.at, true
+	}
+	return time.Time{}, false
+}
+
+func (sch *kickScheduler) nextAt() (time.Time, bool) {
+	sch.mtx.Lock()
+	defer sch.mtx.Unlock()
+	if len(sch.queue) == 0 {
+		return time.Time{}, false
+	}
+	return sch.queue[0].at, true
+}
+
+// popDue unschedules and returns the earliest kick if it is due by now.
+func (sch *kickScheduler) popDue(now time.Time) (string, bool) {
+	sch.mtx.Lock()
+	defer sch.mtx.Unlock()
+	if len(sch.queue) == 0 || sch.queue[0].at.After(now) {
+		return ``, false
+	}
+	item := heap.Pop(&sch.queue).(*kickItem)
+	delete(sch.items, item.entityId)
+	return item.entityId, true
+}
+
+type kickItem struct{
+	entityId string
+	at time.Time
+	index int
+}
+
+// kickQueue implements heap.Interface ordering kicks by time.
+type kickQueue []*kickItem
+
+func (q kickQueue) Len() int {
+	return len(q)
+}
+
+func (q kickQueue) Less(i int, j int) bool {
+	return q[i].at.Before(q[j].at)
+}
+
+func (q kickQueue) Swap(i int, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *kickQueue) Push(x interface{}) {
+	item := x.(*kickItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *kickQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old) - 1]
+	old[len(old) - 1] = nil
+	*q = old[:len(old) - 1]
+	return item
+}
@@ -0,0 +1,137 @@
+package oak
+
+import(
+	`time`
+	`context`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_scheduler_kicks_due_entities(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &timedTestEntity{KickAt: time.Now().Add(20 * time.Millisecond)}})
+	kicked := make(chan string, 1)
+	srv := setupServer(store, Config{}, ScheduleKicks(store, time.Minute), Hook(Hooks{
+		OnKick: func(e *HookEvent) {
+			kicked <- e.EntityId
+		},
+	}))
+	resp := Json{}
+	readTestJson(serveTestRequest(`POST`, _CREATE, ``), &resp)
+	entityId := resp[_ID].(string)
+
+	srv.Start()
+	defer srv.Stop(context.Background())
+
+	select {
+	case id := <-kicked:
+		assert.Equal(t, entityId, id, `created entity should be kicked`)
+	case <-time.After(time.Second):
+		t.Fatal(`entity should be kicked without any requests`)
+	}
+	entity, _ := store.Read(entityId)
+	assert.Equal(t, 1, entity.GetVersion(), `kicked entity should be stored`)
+	assert.False(t, entity.IsActive(), `kicked entity should have expired`)
+	_, scheduled := srv.kicks.scheduledAt(entityId)
+	assert.False(t, scheduled, `entity without a next kick should be unscheduled`)
+}
+
+func Test_scheduler_retries_entities_still_due(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &timedTestEntity{KickAt: time.Now(), Stuck: true}})
+	srv := setupServer(store, Config{}, ScheduleKicks(store, time.Minute))
+	entityId, _, _ := store.Create()
+	srv.ScheduleKick(entityId, time.Now())
+	srv.ScheduleKick(`test_unknown_entity_id`, time.Now())
+
+	srv.Start()
+	time.Sleep(30 * time.Millisecond)
+	assert.Nil(t, srv.Stop(context.Background()), `stop should not error`)
+
+	at, scheduled := srv.kicks.scheduledAt(entityId)
+	assert.True(t, scheduled, `entity still due should stay scheduled`)
+	assert.True(t, at.After(time.Now().Add(time.Minute - time.Second)), `entity still due should be retried after the retry delay`)
+	_, scheduled = srv.kicks.scheduledAt(`test_unknown_entity_id`)
+	assert.False(t, scheduled, `unknown entity should be dropped`)
+}
+
+func Test_scheduler_start_and_stop(t *testing.T) {
+	srv := NewServer(Config{Entity: &testEntity{}})
+	srv.Start()
+	assert.Nil(t, srv.Stop(context.Background()), `stop without ScheduleKicks should do nothing`)
+
+	store := NewMemoryEntityStore(func()Entity{return &timedTestEntity{}})
+	srv = setupServer(store, Config{}, ScheduleKicks(store, time.Minute))
+	assert.Nil(t, srv.Stop(context.Background()), `stop before start should do nothing`)
+	srv.Start()
+	srv.Start()
+	srv.ScheduleKick(`test_entity_id`, time.Now().Add(time.Hour))
+	assert.Nil(t, srv.Stop(context.Background()), `stop should not error`)
+	assert.Nil(t, srv.Stop(context.Background()), `second stop should do nothing`)
+	_, scheduled := srv.kicks.scheduledAt(`test_entity_id`)
+	assert.True(t, scheduled, `kicks should be kept for the next start`)
+}
+
+func Test_kick_scheduler_queue(t *testing.T) {
+	sch := newKickScheduler(nil, 0)
+	now := time.Now()
+	sch.schedule(`c`, now.Add(3 * time.Second))
+	sch.schedule(`a`, now.Add(time.Second))
+	sch.schedule(`b`, now.Add(2 * time.Second))
+	sch.schedule(`c`, now.Add(-time.Second))
+	sch.schedule(`b`, time.Time{})
+
+	next, _ := sch.nextAt()
+	assert.Equal(t, now.Add(-time.Second), next, `earliest kick should be next`)
+	for _, expected := range []string{`c`, `a`} {
+		entityId, due := sch.popDue(now.Add(time.Minute))
+		assert.True(t, due, `kick should be due`)
+		assert.Equal(t, expected, entityId, `kicks should be popped earliest first`)
+	}
+	_, due := sch.popDue(now.Add(time.Minute))
+	assert.False(t, due, `unscheduled kick should not be popped`)
+	assert.Equal(t, DefaultKickRetryDelay, sch.retryDelay, `retry delay should default`)
+}
+
+/**
+ * helpers
+ */
+
+type timedTestEntity struct{
+	Version int
+	KickAt time.Time
+	Expired bool
+	Stuck bool
+}
+
+func (e *timedTestEntity) GetVersion() int {
+	return e.Version
+}
+
+func (e *timedTestEntity) IsActive() bool {
+	return !e.Expired
+}
+
+func (e *timedTestEntity) CreatedBy() string {
+	return `test_creator_user_id`
+}
+
+func (e *timedTestEntity) RegisterNewUser() (string, error) {
+	return `test_user_id`, nil
+}
+
+func (e *timedTestEntity) UnregisterUser(userId string) error {
+	return nil
+}
+
+func (e *timedTestEntity) Kick() bool {
+	if e.Stuck || e.KickAt.IsZero() || time.Now().Before(e.KickAt) {
+		return false
+	}
+	e.Version++
+	e.Expired = true
+	e.KickAt = time.Time{}
+	return true
+}
+
+func (e *timedTestEntity) NextKickAt() time.Time {
+	return e.KickAt
+}
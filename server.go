@@ -0,0 +1,821 @@
+package oak
+
+import(
+	`time`
+	`errors`
+	`strconv`
+	`context`
+	`net/http`
+	`encoding/gob`
+	js `encoding/json`
+	`github.com/gorilla/mux`
+	`github.com/gorilla/sessions`
+)
+
+// Config holds the required dependencies of a Server.
+type Config struct{
+	SessionStore sessions.Store
+	SessionName string
+	Entity Entity
+	EntityStoreFactory EntityStoreFactory
+	GetJoinResp GetJoinResp
+	GetEntityChangeResp GetEntityChangeResp
+	PerformAct PerformAct
+	// the Context variants are used in place of the plain callbacks when set.
+	GetJoinRespContext ContextGetJoinResp
+	GetEntityChangeRespContext ContextGetEntityChangeResp
+	PerformActContext ContextPerformAct
+}
+
+// Server handles the oak operations for a single entity type, see EntityType to route several on one router.
+type Server struct{
+	conf Config
+	opts *options
+	changes *notifier
+	actLocks *keyedMutex
+	views *viewCache
+	kicks *kickScheduler
+	presence *presence
+	spectators *spectators
+	//set by NewTypedServer in place of the Config's callbacks, they fail when responses don't marshal
+	typedJoinResp typedResp
+	typedChangeResp typedResp
+}
+
+type typedResp func(ctx context.Context, userId string, e Entity) (Json, error)
+
+func NewServer(conf Config, opts ...Option) *Server {
+	gob.Register(conf.Entity)
+	gob.Register(map[string]*sessionEntry{})
+	o := newOptions(opts)
+	srv := &Server{
+		conf: conf,
+		opts: o,
+		changes: newNotifier(),
+		actLocks: newKeyedMutex(),
+		spectators: newSpectators(o.spectatorTimeout),
+	}
+	if srv.opts.deltaViews > 0 && srv.opts.deltaVersions > 0 {
+		srv.views = newViewCache(srv.opts.deltaViews, srv.opts.deltaVersions)
+	}
+	if srv.opts.kickStore != nil {
+		srv.kicks = newKickScheduler(srv.opts.kickStore, srv.opts.kickRetryDelay)
+	}
+	if srv.opts.presenceStore != nil && srv.opts.idleTimeout > 0 {
+		srv.presence = newPresence(srv.opts.idleTimeout, srv.opts.presenceStore)
+	}
+	return srv
+}
+
+// Route registers the handlers of all enabled operations on router, under the PathPrefix if given
+// or else under the EntityType.
+func (srv *Server) Route(router *mux.Router) {
+	if prefix := srv.opts.routePrefix(); prefix != `` {
+		router = router.PathPrefix(prefix).Subrouter()
+	}
+	for _, op := range routeOps {
+		if srv.opts.disabled[op] {
+			continue
+		}
+		route := router.Path(srv.opts.getPath(op)).Handler(srv.wrap(op, srv.handler(op)))
+		if methods, exists := srv.opts.methods[op]; exists {
+			route.Methods(methods...)
+		}
+	}
+}
+
+func (srv *Server) handler(op Op) http.HandlerFunc {
+	switch op {
+	case OpCreate:
+		return srv.create
+	case OpJoin:
+		return srv.join
+	case OpWatch:
+		return srv.watch
+	case OpPoll:
+		return srv.poll(srv.opts.longPollTimeout)
+	case OpStream:
+		return srv.stream
+	case OpAct:
+		return srv.act
+	case OpLeave:
+		return srv.leave
+	case OpSocket:
+		return srv.socket
+	}
+	return nil
+}
+
+func (srv *Server) wrap(op Op, handler http.Handler) http.Handler {
+	for i := len(srv.opts.middlewares) - 1; i >= 0; i-- {
+		handler = srv.opts.middlewares[i](op, handler)
+	}
+	return srv.negotiate(srv.limitBody(handler))
+}
+
+// limitBody caps how much of the request body middlewares and handlers can read, see MaxBodySize.
+func (srv *Server) limitBody(next http.Handler) http.Handler {
+	if srv.opts.maxBodySize <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, srv.opts.maxBodySize)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (srv *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	srv.opts.errorHandler(w, r, err)
+}
+
+func (srv *Server) entityStore(r *http.Request) ContextEntityStore {
+	return AdaptEntityStore(srv.conf.EntityStoreFactory(r))
+}
+
+func (srv *Server) getJoinResp(ctx context.Context, entityId string, userId string, entity Entity) (Json, error) {
+	ctx = srv.spectatorContext(srv.presenceContext(ctx, entityId), entityId, userId)
+	if srv.typedJoinResp != nil {
+		return srv.typedJoinResp(ctx, userId, entity)
+	}
+	if srv.conf.GetJoinRespContext != nil {
+		return srv.conf.GetJoinRespContext(ctx, userId, entity), nil
+	}
+	return srv.conf.GetJoinResp(userId, entity), nil
+}
+
+func (srv *Server) getEntityChangeResp(ctx context.Context, entityId string, userId string, entity Entity) (Json, error) {
+	ctx = srv.spectatorContext(srv.presenceContext(ctx, entityId), entityId, userId)
+	if srv.typedChangeResp != nil {
+		return srv.typedChangeResp(ctx, userId, entity)
+	}
+	if srv.conf.GetEntityChangeRespContext != nil {
+		return srv.conf.GetEntityChangeRespContext(ctx, userId, entity), nil
+	}
+	return srv.conf.GetEntityChangeResp(userId, entity), nil
+}
+
+func (srv *Server) performAct(ctx context.Context, json Json, userId string, entity Entity) error {
+	if srv.conf.PerformActContext != nil {
+		return srv.conf.PerformActContext(ctx, json, userId, entity)
+	}
+	return srv.conf.PerformAct(json, userId, entity)
+}
+
+// updateEntity stores entity and signals the change, wasActive is whether the entity was active before
+// op changed it so the OnEntityInactive hook runs only when it becomes inactive.
+func (srv *Server) updateEntity(ctx context.Context, op Op, entityId string, entity Entity, wasActive bool, entityStore ContextEntityStore) error {
+	err := entityStore.UpdateContext(ctx, entityId, entity)
+	if err == nil {
+		srv.changes.notify(entityId)
+		srv.trackKicks(entityId, entity)
+		if wasActive && !entity.IsActive() {
+			srv.presence.forget(entityId, ``)
+			srv.spectators.forget(entityId)
+			srv.opts.hooks.OnEntityInactive.run(&HookEvent{Op: op, Context: ctx, EntityId: entityId, Entity: entity})
+		}
+	}
+	return err
+}
+
+func (srv *Server) getSession(w http.ResponseWriter, r *http.Request) (*session, error) {
+	s, err := srv.conf.SessionStore.Get(r, srv.conf.SessionName)
+
+	session := &session{
+		writer: w,
+		request: r,
+		internalSession: s,
+		withEntity: srv.opts.entityInSession,
+		key: _ENTITIES,
+		entities: map[string]*sessionEntry{},
+	}
+	if srv.opts.entityType != `` {
+		session.key = _ENTITIES + `.` + srv.opts.entityType
+	}
+
+	if entities, ok := s.Values[session.key].(map[string]*sessionEntry); ok {
+		for entityId, entry := range entities {
+			entityCopy := *entry
+			if !session.withEntity {
+				entityCopy.Entity = nil
+			}
+			session.entities[entityId] = &entityCopy
+		}
+	}
+
+	//sessions saved before they held many entities have a single entity's values
+	if entityId, ok := s.Values[_ENTITY_ID].(string); ok && entityId != `` && srv.opts.entityType == `` {
+		entry := &sessionEntry{}
+		entry.UserId, _ = s.Values[_USER_ID].(string)
+		entry.Spectator = s.Values[_SPECTATOR] == true
+		if val, exists := s.Values[_ENTITY]; exists && val != nil && session.withEntity {
+			entry.Entity = val.(Entity)
+		}
+		session.entities[entityId] = entry
+	}
+
+	//entities the presence sweeper unregistered the user from are let go of as a /leave would
+	left := map[string]string{}
+	for entityId, entry := range session.entities {
+		if !entry.Spectator && srv.presence.hasLeft(entityId, entry.UserId) {
+			left[entityId] = entry.UserId
+			delete(session.entities, entityId)
+		}
+	}
+	if len(left) > 0 && session.save() == nil {
+		for entityId, userId := range left {
+			srv.presence.forget(entityId, userId)
+		}
+	}
+
+	return session, err
+}
+
+// engaged gives the ids, sorted, of the active entities the session's user plays in, dropping entities
+// which are no longer active from the session without saving it. Unless entities are kept in the session
+// each one is read from the store, those which can't be read are treated as inactive.
+func (srv *Server) engaged(ctx context.Context, s *session, entityStore ContextEntityStore) []string {
+	engaged := []string{}
+	for _, entityId := range s.entityIds() {
+		entry := s.entities[entityId]
+		var entity Entity
+		if srv.opts.entityInSession && !entry.Spectator {
+			entity = entry.Entity
+		} else if read, err := entityStore.ReadContext(ctx, entityId); err == nil {
+			entity = read
+		}
+		switch {
+		case entity == nil || !entity.IsActive():
+			delete(s.entities, entityId)
+		case !entry.Spectator:
+			engaged = append(engaged, entityId)
+		}
+	}
+	return engaged
+}
+
+// canEngage reports whether the session's user may create or join another entity, that is they play
+// in fewer than MaxEntities active entities, spectating doesn't count.
+func (srv *Server) canEngage(ctx context.Context, s *session, entityStore ContextEntityStore) bool {
+	return len(srv.engaged(ctx, s, entityStore)) < srv.opts.maxEntities
+}
+
+func (srv *Server) fetchEntity(ctx context.Context, entityId string, entityStore ContextEntityStore) (entity Entity, err error) {
+	policy := srv.opts.getRetryPolicy(OpKick)
+	for attempt := 1; ; attempt++ {
+		entity, err = entityStore.ReadContext(ctx, entityId)
+		if err == nil {
+			wasActive := entity.IsActive()
+			if entity.Kick() {
+				err = srv.updateEntity(ctx, OpKick, entityId, entity, wasActive, entityStore)
+				if err != nil && policy.shouldRetry(attempt, err) {
+					if err = policy.wait(ctx, attempt); err != nil {
+						return
+					}
+					continue
+				}
+				if err == nil {
+					srv.opts.hooks.OnKick.run(&HookEvent{Op: OpKick, Context: ctx, EntityId: entityId, Entity: entity})
+				}
+			} else {
+				srv.trackKicks(entityId, entity)
+			}
+		}
+		return
+	}
+}
+
+// retryUpdate applies a change to entity and stores it, if the store rejects the update as
+// nonsequential the latest entity is read and the change is reapplied as the op's retry policy allows.
+// entity may be nil in which case the first attempt also reads the entity,
+// the returned entity is nil only if a read failed.
+func (srv *Server) retryUpdate(ctx context.Context, op Op, entityId string, entityStore ContextEntityStore, entity Entity, read func() (Entity, error), apply func(Entity) error) (Entity, error) {
+	policy := srv.opts.getRetryPolicy(op)
+	for attempt := 1; ; attempt++ {
+		var err error
+		if entity == nil {
+			if entity, err = read(); err != nil {
+				return nil, err
+			}
+		}
+		wasActive := entity.IsActive()
+		if err = apply(entity); err != nil {
+			return entity, err
+		}
+		err = srv.updateEntity(ctx, op, entityId, entity, wasActive, entityStore)
+		if err != nil && policy.shouldRetry(attempt, err) {
+			if waitErr := policy.wait(ctx, attempt); waitErr != nil {
+				return entity, err
+			}
+			entity = nil
+			continue
+		}
+		return entity, err
+	}
+}
+
+// awaitChange blocks until the entity moves past version, timeout elapses or the request
+// is cancelled, a nil entity is returned if the request was cancelled, timeout <= 0 never elapses.
+func (srv *Server) awaitChange(r *http.Request, entityId string, version int, entity Entity, entityStore ContextEntityStore, sub *subscription, timeout time.Duration, kickInterval time.Duration) (Entity, error) {
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+	var kick <-chan time.Time
+	if kickInterval > 0 {
+		ticker := time.NewTicker(kickInterval)
+		defer ticker.Stop()
+		kick = ticker.C
+	}
+	for version == entity.GetVersion() {
+		select {
+		case <-sub.changed:
+			sub.renew()
+		case <-kick:
+			if !entity.Kick() {
+				continue
+			}
+		case <-timedOut:
+			return entity, nil
+		case <-r.Context().Done():
+			return nil, nil
+		}
+		var err error
+		if entity, err = srv.fetchEntity(r.Context(), entityId, entityStore); err != nil {
+			return nil, err
+		}
+	}
+	return entity, nil
+}
+
+func (srv *Server) create(w http.ResponseWriter, r *http.Request){
+	s, _ := srv.getSession(w, r)
+	entityStore := srv.entityStore(r)
+	var entityId string
+	var entity Entity
+	if engaged := srv.engaged(r.Context(), s, entityStore); len(engaged) < srv.opts.maxEntities {
+		if err := srv.opts.hooks.BeforeCreate.run(hookEvent(OpCreate, r, ``, ``, nil)); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+		var err error
+		if entityId, entity, err = entityStore.CreateContext(r.Context()); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+		srv.trackKicks(entityId, entity)
+		s.set(entity.CreatedBy(), entityId, entity)
+		srv.presence.seen(entityId, entity.CreatedBy())
+	} else if srv.opts.maxEntities == 1 {
+		//users who can only be in one entity are given the one they are in
+		entityId = engaged[0]
+	} else {
+		srv.writeError(w, r, NewError(CodeForbidden, `already in ` + strconv.Itoa(srv.opts.maxEntities) + ` entities`))
+		return
+	}
+	event := hookEvent(OpCreate, r, s.getUserId(entityId), entityId, entity)
+	event.Resp = Json{_ID: entityId}
+	srv.opts.hooks.AfterCreate.run(event)
+	writeJson(w, r, &event.Resp)
+}
+
+func (srv *Server) join(w http.ResponseWriter, r *http.Request) {
+	entityId, _, _, err := getRequestData(r, false)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+
+	entityStore := srv.entityStore(r)
+	entity, err := srv.fetchEntity(r.Context(), entityId, entityStore)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+
+	s, _ := srv.getSession(w, r)
+	if err = srv.opts.hooks.BeforeJoin.run(hookEvent(OpJoin, r, s.getUserId(entityId), entityId, entity)); err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	if entity.IsActive() && (!s.has(entityId) || s.isSpectator(entityId)) && srv.canEngage(r.Context(), s, entityStore) {
+		var userId string
+		var before Entity
+		var registerErr error
+		latest, err := srv.retryUpdate(r.Context(), OpJoin, entityId, entityStore, entity, func() (Entity, error) {
+			return srv.fetchEntity(r.Context(), entityId, entityStore)
+		}, func(e Entity) error {
+			if !e.IsActive() {
+				registerErr = errors.New(`entity is not active`)
+				return registerErr
+			}
+			before = srv.opts.hooks.OnJoin.before(e)
+			userId, registerErr = e.RegisterNewUser()
+			return registerErr
+		})
+		var e *Error
+		//users the entity won't register are answered as viewers unless it says how with an *Error,
+		//failures to store the join are always sent
+		if latest == nil || (err != nil && (err != registerErr || errors.As(err, &e))) {
+			srv.writeError(w, r, err)
+			return
+		}
+		entity = latest
+		if err == nil {
+			//entity was updated successfully this user is now active in this entity
+			srv.stopSpectating(s, entityId)
+			//the entity may give a user id it unregistered while idle to the new user
+			srv.presence.forget(entityId, userId)
+			s.set(userId, entityId, entity)
+			event := hookEvent(OpJoin, r, userId, entityId, entity)
+			event.Before = before
+			srv.opts.hooks.OnJoin.run(event)
+		}
+	}
+
+	userId := s.getUserId(entityId)
+	if s.has(entityId) {
+		srv.presence.seen(entityId, userId)
+	}
+
+	etag := entityTag(entityId, userId, entity.GetVersion())
+	w.Header().Set(_ETAG, etag)
+	if etagMatches(r.Header.Get(_IF_NONE_MATCH), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	event := hookEvent(OpJoin, r, userId, entityId, entity)
+	if event.Resp, err = srv.getJoinResp(r.Context(), entityId, userId, entity); err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	event.Resp[_VERSION] = entity.GetVersion()
+	srv.opts.hooks.AfterJoin.run(event)
+	writeJson(w, r, &event.Resp)
+}
+
+func (srv *Server) poll(longPollTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entityId, version, reqJson, err := getRequestData(r, true)
+		if err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+
+		entityStore := srv.entityStore(r)
+		var sub *subscription
+		if longPollTimeout > 0 {
+			sub = srv.changes.subscribe(entityId)
+			defer sub.cancel()
+		}
+
+		entity, err := srv.fetchEntity(r.Context(), entityId, entityStore)
+		if err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+
+		//the session is only read when needed so polls which are cancelled while waiting don't touch it
+		var s *session
+		getSession := func() *session {
+			if s == nil {
+				s, _ = srv.getSession(w, r)
+			}
+			return s
+		}
+		if srv.spectators.count(entityId) > 0 && getSession().isSpectator(entityId) {
+			srv.spectators.seen(entityId, s.getUserId(entityId))
+		}
+		if srv.presence != nil && getSession().has(entityId) {
+			srv.presence.seen(entityId, s.getUserId(entityId))
+		}
+		if hook := srv.opts.hooks.BeforePoll; hook != nil {
+			if err = hook(hookEvent(OpPoll, r, getSession().getUserId(entityId), entityId, entity)); err != nil {
+				srv.writeError(w, r, err)
+				return
+			}
+		}
+
+		//a matching If-None-Match means the client has the current version whatever v it sent
+		notModified := false
+		if ifNoneMatch := r.Header.Get(_IF_NONE_MATCH); ifNoneMatch != `` {
+			if etagMatches(ifNoneMatch, entityTag(entityId, getSession().getUserId(entityId), entity.GetVersion())) {
+				version = entity.GetVersion()
+				notModified = true
+			}
+		}
+
+		if version == entity.GetVersion() && longPollTimeout > 0 {
+			entity, err = srv.awaitChange(r, entityId, version, entity, entityStore, sub, longPollTimeout, srv.opts.longPollKickInterval)
+			if err != nil {
+				srv.writeError(w, r, err)
+				return
+			}
+		}
+
+		if entity == nil {
+			return
+		}
+		if version == entity.GetVersion() {
+			if notModified {
+				w.Header().Set(_ETAG, entityTag(entityId, s.getUserId(entityId), version))
+				w.WriteHeader(http.StatusNotModified)
+			}
+			return
+		}
+
+		userId := getSession().getUserId(entityId)
+		s.sync(entityId, entity)
+		event := hookEvent(OpPoll, r, userId, entityId, entity)
+		if event.Resp, err = srv.getEntityChangeResp(r.Context(), entityId, userId, entity); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+		event.Resp[_VERSION] = entity.GetVersion()
+		srv.opts.hooks.AfterPoll.run(event)
+		respJson := event.Resp
+		if srv.views != nil {
+			respJson = srv.views.delta(entityId, userId, version, entity.GetVersion(), respJson, reqJson[_DELTA] == true)
+		}
+		if _, isPatch := respJson[_PATCH]; !isPatch {
+			//a patch depends on the version it is from so it is not tagged
+			w.Header().Set(_ETAG, entityTag(entityId, userId, entity.GetVersion()))
+		}
+		writeJson(w, r, &respJson)
+	}
+}
+
+func (srv *Server) stream(w http.ResponseWriter, r *http.Request) {
+	entityId, version, hasVersion, err := getStreamRequestData(r)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		srv.writeError(w, r, errors.New(`streaming is not supported by the response writer`))
+		return
+	}
+
+	entityStore := srv.entityStore(r)
+	sub := srv.changes.subscribe(entityId)
+	defer sub.cancel()
+
+	entity, err := srv.fetchEntity(r.Context(), entityId, entityStore)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+
+	s, _ := srv.getSession(w, r)
+	userId := s.getUserId(entityId)
+	if s.has(entityId) {
+		defer srv.presence.hold(entityId, userId)()
+	}
+	if s.isSpectator(entityId) {
+		defer srv.spectators.hold(entityId, userId)()
+	}
+
+	if !entity.IsActive() && hasVersion && version == entity.GetVersion() {
+		//the client has the final version, 204 stops EventSource reconnecting
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set(`Content-Type`, `text/event-stream`)
+	w.Header().Set(`Cache-Control`, `no-cache`)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		if !hasVersion || version != entity.GetVersion() {
+			version = entity.GetVersion()
+			hasVersion = true
+			respJson, err := srv.getEntityChangeResp(r.Context(), entityId, userId, entity)
+			if err != nil {
+				//the stream has started so the error can't be sent, clients reconnect from their last version
+				return
+			}
+			respJson[_VERSION] = version
+			if err := writeEvent(w, version, &respJson); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if !entity.IsActive() {
+			return
+		}
+		entity, err = srv.awaitChange(r, entityId, version, entity, entityStore, sub, 0, srv.opts.streamKickInterval)
+		if err != nil || entity == nil {
+			return
+		}
+	}
+}
+
+func (srv *Server) act(w http.ResponseWriter, r *http.Request) {
+	s, _ := srv.getSession(w, r)
+	json, err := readJson(r)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	entityId, err := actEntityId(s, json)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	if s.isSpectator(entityId) {
+		srv.writeError(w, r, NewError(CodeForbidden, `spectators can not act`))
+		return
+	}
+	if srv.opts.entityInSession && s.getEntity(entityId) == nil {
+		srv.writeError(w, r, NewError(CodeNotEngaged, `no entity in session`))
+		return
+	}
+	userId := s.getUserId(entityId)
+	srv.presence.seen(entityId, userId)
+	idempotencyStore := srv.opts.idempotencyStore
+	key := ``
+	actHash := ``
+	if idempotencyStore != nil {
+		var err error
+		if key, err = getIdempotencyKey(r, json); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+		actHash = hashAct(json)
+	}
+	if key != `` {
+		defer srv.actLocks.lock(idempotencyRecordKey(entityId, userId, key))()
+		resp, found, err := idempotencyStore.Get(r.Context(), entityId, userId, key)
+		if err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+		if found {
+			//responses are remembered as json so a retry may negotiate a different codec
+			remembered := &idempotentResp{}
+			if err = js.Unmarshal(resp, remembered); err != nil {
+				srv.writeError(w, r, err)
+				return
+			}
+			if remembered.ActHash != actHash {
+				srv.writeError(w, r, NewError(CodeConflict, `idempotency key was used for a different act`))
+				return
+			}
+			w.Header().Set(_IDEMPOTENT_REPLAYED, `true`)
+			writeJson(w, r, &remembered.Resp)
+			return
+		}
+	}
+
+	if srv.opts.entityInSession {
+		//check the act against the session's copy before going to the store
+		if err := srv.performAct(r.Context(), json, userId, s.getEntity(entityId)); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+	}
+
+	entityStore := srv.entityStore(r)
+	var before Entity
+	entity, err := srv.retryUpdate(r.Context(), OpAct, entityId, entityStore, nil, func() (Entity, error) {
+		return srv.fetchEntity(r.Context(), entityId, entityStore)
+	}, func(e Entity) error {
+		before = srv.opts.hooks.AfterAct.before(e)
+		event := hookEvent(OpAct, r, userId, entityId, e)
+		event.Json = json
+		if err := srv.opts.hooks.BeforeAct.run(event); err != nil {
+			return err
+		}
+		return srv.performAct(r.Context(), json, userId, e)
+	})
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+
+	s.sync(entityId, entity)
+	event := hookEvent(OpAct, r, userId, entityId, entity)
+	event.Before = before
+	event.Json = json
+	if event.Resp, err = srv.getEntityChangeResp(r.Context(), entityId, userId, entity); err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	event.Resp[_VERSION] = entity.GetVersion()
+	srv.opts.hooks.AfterAct.run(event)
+	respJson := event.Resp
+	if srv.views != nil {
+		srv.views.delta(entityId, userId, -1, entity.GetVersion(), respJson, false)
+	}
+	if key != `` {
+		if resp, err := js.Marshal(&idempotentResp{ActHash: actHash, Resp: respJson}); err == nil {
+			//the act is stored so a failure to remember it must not fail the response
+			idempotencyStore.Put(r.Context(), entityId, userId, key, resp)
+		}
+	}
+	writeJson(w, r, &respJson)
+}
+
+func (srv *Server) leave(w http.ResponseWriter, r *http.Request) {
+	s, _ := srv.getSession(w, r)
+	json, err := readJson(r)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	entityIds := s.entityIds()
+	//the entity may be named as entityId, as with /act, or id, as with /join and /poll
+	for _, key := range []string{_ENTITY_ID, _ID} {
+		if idParam, exists := json[key]; exists {
+			entityId, ok := idParam.(string)
+			if !ok {
+				srv.writeError(w, r, NewError(CodeBadRequest, key + ` must be a string value`))
+				return
+			}
+			entityIds = []string{entityId}
+			break
+		}
+	}
+	for _, entityId := range entityIds {
+		if err := srv.leaveEntity(r, s, entityId); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+	}
+}
+
+// leaveEntity unregisters the session's user from the entity and takes it out of their session.
+func (srv *Server) leaveEntity(r *http.Request, s *session, entityId string) error {
+	userId := s.getUserId(entityId)
+	switch {
+	case !s.has(entityId):
+		return nil
+	case s.isSpectator(entityId):
+		srv.stopSpectating(s, entityId)
+		return s.remove(entityId)
+	case srv.opts.entityInSession && s.getEntity(entityId) == nil:
+		return s.remove(entityId)
+	case srv.opts.entityInSession:
+		if err := s.getEntity(entityId).UnregisterUser(userId); err != nil {
+			return err
+		}
+	}
+
+	entityStore := srv.entityStore(r)
+	var before Entity
+	entity, err := srv.retryUpdate(r.Context(), OpLeave, entityId, entityStore, nil, func() (Entity, error) {
+		return entityStore.ReadContext(r.Context(), entityId)
+	}, func(e Entity) error {
+		before = srv.opts.hooks.OnLeave.before(e)
+		if err := srv.opts.hooks.BeforeLeave.run(hookEvent(OpLeave, r, userId, entityId, e)); err != nil {
+			return err
+		}
+		return e.UnregisterUser(userId)
+	})
+	if err != nil && srv.presence.hasLeft(entityId, userId) {
+		//the presence sweeper unregistered the user since the session was read
+		srv.presence.forget(entityId, userId)
+		return s.remove(entityId)
+	}
+	if err != nil {
+		return err
+	}
+
+	srv.presence.forget(entityId, userId)
+	event := hookEvent(OpLeave, r, userId, entityId, entity)
+	event.Before = before
+	srv.opts.hooks.OnLeave.run(event)
+	return s.remove(entityId)
+}
+
+func (srv *Server) socket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebsocket(w, r, srv.opts.socketOrigins)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	ops := map[string]http.Handler{}
+	for _, op := range []Op{OpCreate, OpJoin, OpWatch, OpPoll, OpAct, OpLeave} {
+		if srv.opts.disabled[op] {
+			continue
+		}
+		handler := srv.handler(op)
+		if op == OpPoll {
+			//changes are pushed to sockets so polls over them never need to wait
+			handler = srv.poll(0)
+		}
+		ops[string(op)] = srv.wrap(op, handler)
+	}
+	//sockets poll often enough that their spectators don't expire, and their users don't go idle
+	keepalive := srv.opts.spectatorTimeout / 2
+	if srv.presence != nil && srv.presence.idleTimeout / 2 < keepalive {
+		keepalive = srv.presence.idleTimeout / 2
+	}
+	serveSocket(conn, r, ops, srv.changes, srv.opts.streamKickInterval, keepalive)
+}
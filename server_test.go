@@ -0,0 +1,273 @@
+package oak
+
+import(
+	`bytes`
+	`errors`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_server_with_path_prefix_and_path(t *testing.T) {
+	setupServer(nil, Config{}, PathPrefix(`/api`), Path(OpCreate, `/new`))
+
+	w := serveTestRequest(`POST`, `/api/new`, ``)
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, `test_entity_id`, resp[_ID], `create should be routed under the prefix and custom path`)
+
+	w = serveTestRequest(`POST`, _CREATE, ``)
+	assert.Equal(t, 404, w.Code, `default path should not be routed`)
+
+	w = serveTestRequest(`POST`, `/api` + _LEAVE, ``)
+	assert.Equal(t, 200, w.Code, `other ops should keep their default paths under the prefix`)
+}
+
+func Test_server_with_methods(t *testing.T) {
+	setupServer(nil, Config{}, Methods(OpCreate, `POST`))
+
+	w := serveTestRequest(`GET`, _CREATE, ``)
+	assert.NotEqual(t, 200, w.Code, `disallowed method should not be routed`)
+
+	w = serveTestRequest(`POST`, _CREATE, ``)
+	assert.Equal(t, 200, w.Code, `allowed method should be routed`)
+}
+
+func Test_server_with_disabled_ops(t *testing.T) {
+	setupServer(nil, Config{}, Disable(OpStream, OpSocket, OpCreate))
+
+	assert.Equal(t, 404, serveTestRequest(`GET`, _STREAM, ``).Code, `stream should not be routed`)
+	assert.Equal(t, 404, serveTestRequest(`GET`, _SOCKET, ``).Code, `socket should not be routed`)
+	assert.Equal(t, 404, serveTestRequest(`POST`, _CREATE, ``).Code, `create should not be routed`)
+	assert.Equal(t, 200, serveTestRequest(`POST`, _LEAVE, ``).Code, `leave should still be routed`)
+}
+
+func Test_server_with_error_handler(t *testing.T) {
+	var handledErr error
+	setupServer(nil, Config{}, OnError(func(w http.ResponseWriter, r *http.Request, err error) {
+		handledErr = err
+		w.WriteHeader(418)
+	}))
+	tes.createErr = errors.New(`test_create_error`)
+
+	w := serveTestRequest(`POST`, _CREATE, ``)
+
+	assert.Equal(t, tes.createErr, handledErr, `error handler should receive the error`)
+	assert.Equal(t, 418, w.Code, `error handler should write the response`)
+}
+
+func Test_server_with_middleware(t *testing.T) {
+	calls := []string{}
+	setupServer(nil, Config{}, Wrap(func(op Op, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, `outer_` + string(op))
+			next.ServeHTTP(w, r)
+		})
+	}), Wrap(func(op Op, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, `inner_` + string(op))
+			next.ServeHTTP(w, r)
+		})
+	}))
+
+	serveTestRequest(`POST`, _LEAVE, ``)
+	assert.Equal(t, []string{`outer_leave`, `inner_leave`}, calls, `middlewares should wrap in order`)
+
+	calls = []string{}
+	c := dialTestSocket(t)
+	defer c.close()
+	c.send(t, Json{_OP: _OP_LEAVE})
+	assert.Equal(t, []string{`outer_socket`, `inner_socket`, `outer_leave`, `inner_leave`}, calls, `middlewares should wrap socket ops too`)
+}
+
+func Test_server_socket_with_disabled_op(t *testing.T) {
+	setupServer(nil, Config{}, Disable(OpLeave))
+	c := dialTestSocket(t)
+	defer c.close()
+
+	resp := c.send(t, Json{_OP: _OP_LEAVE})
+
+	assert.Equal(t, `unknown op "leave"`, resp[_ERROR].(map[string]interface{})[`message`], `disabled ops should not be available over sockets`)
+}
+
+func Test_server_with_max_entities(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	acted := []string{}
+	setupServer(store, Config{
+		PerformAct: func(json Json, userId string, e Entity)error{
+			e.(*storeTestEntity).Version++
+			acted = append(acted, userId)
+			return nil
+		},
+	}, MaxEntities(2))
+	entityA, _, _ := store.Create()
+	entityB, _, _ := store.Create()
+	entityC, _, _ := store.Create()
+	users := func(entityId string) []string {
+		entity, _ := store.Read(entityId)
+		return entity.(*storeTestEntity).Users
+	}
+
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityA+`"}`)
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityB+`"}`)
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityC+`"}`)
+	assert.Equal(t, []string{`test_user_1`}, users(entityA), `user should join the first entity`)
+	assert.Equal(t, []string{`test_user_1`}, users(entityB), `user should join a second entity`)
+	assert.Empty(t, users(entityC), `user should not join more than the max entities`)
+	w := serveTestRequest(`POST`, _CREATE, ``)
+	assertTestError(t, w, CodeForbidden, `already in 2 entities`)
+
+	w = serveTestRequest(`POST`, _ACT, `{}`)
+	assertTestError(t, w, CodeBadRequest, `entityId value must be included in request`)
+	w = serveTestRequest(`POST`, _ACT, `{"`+_ENTITY_ID+`":"`+entityC+`"}`)
+	assertTestError(t, w, CodeNotEngaged, `entity not in session`)
+	w = serveTestRequest(`POST`, _ACT, `{"`+_ENTITY_ID+`":"`+entityB+`"}`)
+	assert.Equal(t, 200, w.Code, `act should be for the given entity`)
+	entity, _ := store.Read(entityB)
+	assert.Equal(t, 2, entity.GetVersion(), `act should update the given entity`)
+
+	serveTestRequest(`POST`, _LEAVE, `{"`+_ID+`":"`+entityA+`"}`)
+	assert.Empty(t, users(entityA), `user should leave the given entity`)
+	assert.Equal(t, []string{`test_user_1`}, users(entityB), `user should stay in their other entity`)
+	w = serveTestRequest(`POST`, _ACT, `{}`)
+	assert.Equal(t, 200, w.Code, `act without an id should be for the only entity`)
+	assert.Equal(t, []string{`test_user_1`, `test_user_1`}, acted, `acts should be performed for the user of each entity`)
+
+	serveTestRequest(`POST`, _LEAVE, ``)
+	assert.Empty(t, users(entityB), `leave without an id should leave every entity`)
+	assert.Empty(t, tss.session.Values, `session should be cleared`)
+}
+
+func Test_server_act_with_its_own_id(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	var actJson Json
+	setupServer(store, Config{
+		PerformAct: func(json Json, userId string, e Entity)error{
+			e.(*storeTestEntity).Version++
+			actJson = json
+			return nil
+		},
+	}, MaxEntities(2))
+	entityA, _, _ := store.Create()
+	entityB, _, _ := store.Create()
+
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityA+`"}`)
+	w := serveTestRequest(`POST`, _ACT, `{"type":"move","`+_ID+`":"piece3"}`)
+	assert.Equal(t, 200, w.Code, `act id should not be taken as the entity id`)
+	assert.Equal(t, Json{`type`: `move`, _ID: `piece3`}, actJson, `act should keep its own id`)
+
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityB+`"}`)
+	w = serveTestRequest(`POST`, _ACT, `{"type":"move","`+_ID+`":"piece4","`+_ENTITY_ID+`":"`+entityB+`"}`)
+	assert.Equal(t, 200, w.Code, `act should be for the given entity`)
+	assert.Equal(t, Json{`type`: `move`, _ID: `piece4`}, actJson, `act should keep its own id alongside the entity id`)
+}
+
+func Test_server_leave_with_entity_id(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	setupServer(store, Config{}, MaxEntities(2))
+	entityA, _, _ := store.Create()
+	entityB, _, _ := store.Create()
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityA+`"}`)
+	serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityB+`"}`)
+
+	w := serveTestRequest(`POST`, _LEAVE, `{"`+_ENTITY_ID+`":1}`)
+	assertTestError(t, w, CodeBadRequest, `entityId must be a string value`)
+	w = serveTestRequest(`POST`, _LEAVE, `{"`+_ENTITY_ID+`":"`+entityA+`"}`)
+	assert.Equal(t, 200, w.Code, `leave should be for the given entity`)
+	entity, _ := store.Read(entityA)
+	assert.Empty(t, entity.(*storeTestEntity).Users, `user should leave the given entity`)
+	entity, _ = store.Read(entityB)
+	assert.Equal(t, []string{`test_user_1`}, entity.(*storeTestEntity).Users, `user should stay in their other entity`)
+}
+
+func Test_server_with_entity_types(t *testing.T) {
+	tss = &testSessionStore{}
+	tr = mux.NewRouter()
+	stores := map[string]*MemoryEntityStore{}
+	for _, entityType := range []string{`chess`, `chat`} {
+		store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{Creator: `test_creator_user_id`}})
+		stores[entityType] = store
+		NewServer(Config{
+			SessionStore: tss,
+			SessionName: `test_session`,
+			Entity: &storeTestEntity{},
+			EntityStoreFactory: func(r *http.Request)EntityStore{return store},
+			GetJoinResp: func(userId string, e Entity)Json{return Json{`userId`: userId}},
+			GetEntityChangeResp: func(userId string, e Entity)Json{return Json{}},
+			PerformAct: func(json Json, userId string, e Entity)error{
+				e.(*storeTestEntity).Version++
+				return nil
+			},
+		}, EntityType(entityType)).Route(tr)
+	}
+	chessId, _, _ := stores[`chess`].Create()
+
+	serveTestRequest(`POST`, `/chess` + _JOIN, `{"`+_ID+`":"`+chessId+`"}`)
+	resp := Json{}
+	readTestJson(serveTestRequest(`POST`, `/chat` + _CREATE, ``), &resp)
+	chatId := resp[_ID].(string)
+	assert.Equal(t, 404, serveTestRequest(`POST`, _CREATE, ``).Code, `routes should only be under the types`)
+
+	_, err := stores[`chat`].Read(chatId)
+	assert.Nil(t, err, `entity should be created in its type's store`)
+	assert.Equal(t, 1, len(tss.session.Values[_ENTITIES + `.chess`].(map[string]*sessionEntry)), `session should hold the chess entity`)
+	assert.Equal(t, 1, len(tss.session.Values[_ENTITIES + `.chat`].(map[string]*sessionEntry)), `session should hold the chat entity`)
+
+	assert.Equal(t, 200, serveTestRequest(`POST`, `/chess` + _ACT, `{}`).Code, `act should be for the user's chess entity`)
+	assert.Equal(t, 200, serveTestRequest(`POST`, `/chat` + _ACT, `{}`).Code, `act should be for the user's chat entity`)
+	resp = Json{}
+	readTestJson(serveTestRequest(`POST`, `/chat` + _JOIN, `{"`+_ID+`":"`+chatId+`"}`), &resp)
+	assert.Equal(t, `test_creator_user_id`, resp[`userId`], `chat user should be kept in the session alongside chess`)
+
+	serveTestRequest(`POST`, `/chess` + _LEAVE, ``)
+	entity, _ := stores[`chess`].Read(chessId)
+	assert.Empty(t, entity.(*storeTestEntity).Users, `user should leave the chess entity`)
+	assert.Nil(t, tss.session.Values[_ENTITIES + `.chess`], `chess entities should be cleared from the session`)
+	assert.NotNil(t, tss.session.Values[_ENTITIES + `.chat`], `chat entities should be kept in the session`)
+}
+
+/**
+ * helpers
+ */
+
+// setupServer routes a Server on tr with entities from store, tes if nil, and the fields conf leaves
+// unset defaulted to tss, testEntity and callbacks responding with empty json.
+func setupServer(store EntityStore, conf Config, opts ...Option) *Server {
+	tss = &testSessionStore{}
+	tes = &testEntityStore{}
+	tr = mux.NewRouter()
+	if store == nil {
+		store = tes
+	}
+	if conf.SessionStore == nil {
+		conf.SessionStore = tss
+	}
+	if conf.SessionName == `` {
+		conf.SessionName = `test_session`
+	}
+	if conf.Entity == nil {
+		conf.Entity = &testEntity{}
+	}
+	conf.EntityStoreFactory = func(r *http.Request)EntityStore{return store}
+	if conf.GetJoinResp == nil && conf.GetJoinRespContext == nil {
+		conf.GetJoinResp = func(userId string, e Entity)Json{return Json{}}
+	}
+	if conf.GetEntityChangeResp == nil && conf.GetEntityChangeRespContext == nil {
+		conf.GetEntityChangeResp = func(userId string, e Entity)Json{return Json{}}
+	}
+	if conf.PerformAct == nil && conf.PerformActContext == nil {
+		conf.PerformAct = func(json Json, userId string, e Entity)error{return nil}
+	}
+	srv := NewServer(conf, opts...)
+	srv.Route(tr)
+	return srv
+}
+
+func serveTestRequest(method string, path string, reqJson string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(method, path, bytes.NewBufferString(reqJson))
+	tr.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,356 @@
+package oak
+
+import(
+	`io`
+	`sync`
+	`time`
+	`bytes`
+	`context`
+	`strings`
+	`net/http`
+	js `encoding/json`
+	gcontext `github.com/gorilla/context`
+)
+
+const (
+	_OP		= `op`
+	_REF	= `ref`
+	_CODE	= `code`
+	_BODY	= `body`
+	_ERROR	= `error`
+
+	_OP_CREATE	= `create`
+	_OP_JOIN	= `join`
+	_OP_WATCH	= `watch`
+	_OP_POLL	= `poll`
+	_OP_ACT		= `act`
+	_OP_LEAVE	= `leave`
+	_OP_CHANGE	= `change`
+)
+
+// socket multiplexes the http handlers over a single websocket connection, every message
+// is run through the same handler as its http counterpart using a request cloned from the
+// handshake, session cookies set by earlier messages are carried forward for the life of the
+// connection but can not reach the browser's cookie jar. Changes are pushed for every entity
+// created, joined, watched or polled over the connection until it is left over the connection.
+type socket struct{
+	conn *wsConn
+	handshake *http.Request
+	ctx context.Context
+	ops map[string]http.Handler
+	changes *notifier
+	kickInterval time.Duration
+	keepalive time.Duration
+
+	opMtx sync.Mutex
+	cookies map[string]*http.Cookie
+
+	watchMtx sync.Mutex
+	watches map[string]*socketWatch
+	watching sync.WaitGroup
+}
+
+// socketWatch is an entity the socket pushes changes for, version is the last one the client was sent.
+type socketWatch struct{
+	version int
+	//played is set for entities created or joined over the socket, which acts without an entityId are for
+	played bool
+	rewatch chan struct{}
+	stop chan struct{}
+}
+
+// serveSocket handles messages on an upgraded connection until it is closed, r is the handshake request.
+// Watched entities are polled every keepalive, when > 0, so the user is seen as present while connected.
+func serveSocket(conn *wsConn, r *http.Request, ops map[string]http.Handler, changes *notifier, kickInterval time.Duration, keepalive time.Duration) {
+	defer conn.close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	s := &socket{
+		conn: conn,
+		handshake: r,
+		ctx: ctx,
+		ops: ops,
+		changes: changes,
+		kickInterval: kickInterval,
+		keepalive: keepalive,
+		cookies: map[string]*http.Cookie{},
+		watches: map[string]*socketWatch{},
+	}
+	for _, cookie := range r.Cookies() {
+		s.cookies[cookie.Name] = cookie
+	}
+	defer func() {
+		cancel()
+		s.watching.Wait()
+	}()
+
+	for {
+		message, err := conn.readMessage()
+		if err != nil {
+			return
+		}
+		if err = s.handle(message); err != nil {
+			return
+		}
+	}
+}
+
+func (s *socket) handle(message []byte) error {
+	reqJson := Json{}
+	if err := js.Unmarshal(message, &reqJson); err != nil {
+		e := NewError(CodeBadRequest, err.Error())
+		return s.write(Json{_OP: ``, _CODE: e.Status(), _ERROR: e})
+	}
+	op, _ := reqJson[_OP].(string)
+	ref := reqJson[_REF]
+	delete(reqJson, _OP)
+	delete(reqJson, _REF)
+
+	respJson := Json{_OP: op}
+	if ref != nil {
+		respJson[_REF] = ref
+	}
+	if _, exists := s.ops[op]; !exists {
+		e := NewError(CodeBadRequest, `unknown op "` + op + `"`)
+		respJson[_CODE] = e.Status()
+		respJson[_ERROR] = e
+		return s.write(respJson)
+	}
+
+	code, body := s.do(op, reqJson)
+	respJson[_CODE] = code
+	if code != http.StatusOK {
+		if js.Valid(body) {
+			respJson[_ERROR] = js.RawMessage(body)
+		} else {
+			//a custom ErrorHandler may not respond with json
+			respJson[_ERROR] = strings.TrimSpace(string(body))
+		}
+		return s.write(respJson)
+	}
+	if len(body) > 0 {
+		respJson[_BODY] = js.RawMessage(body)
+	}
+
+	switch op {
+	case _OP_ACT:
+		if version, ok := readBodyValue(body, _VERSION).(float64); ok {
+			entityId, _ := reqJson[_ENTITY_ID].(string)
+			s.actedOn(entityId, int(version))
+		}
+	case _OP_CREATE:
+		if entityId, ok := readBodyValue(body, _ID).(string); ok {
+			s.setWatch(entityId, -1, true)
+		}
+	case _OP_JOIN, _OP_WATCH, _OP_POLL:
+		if entityId, ok := reqJson[_ID].(string); ok {
+			if version, ok := readBodyValue(body, _VERSION).(float64); ok {
+				s.setWatch(entityId, int(version), op == _OP_JOIN)
+			}
+		}
+	}
+	return s.write(respJson)
+}
+
+// do runs the op's handler with a request cloned from the handshake and returns the response.
+func (s *socket) do(op string, reqJson Json) (code int, body []byte) {
+	s.opMtx.Lock()
+	defer s.opMtx.Unlock()
+
+	reqBody, _ := js.Marshal(reqJson)
+	r := s.handshake.Clone(s.ctx)
+	r.Method = `POST`
+	r.Body = io.NopCloser(bytes.NewReader(reqBody))
+	r.ContentLength = int64(len(reqBody))
+	//socket messages are always json whatever the handshake negotiated
+	r.Header.Set(_CONTENT_TYPE, _JSON_CONTENT_TYPE)
+	r.Header.Del(_ACCEPT)
+	r.Header.Del(`Cookie`)
+	for _, cookie := range s.cookies {
+		r.AddCookie(cookie)
+	}
+	defer gcontext.Clear(r)
+
+	w := newResponseBuffer()
+	s.ops[op].ServeHTTP(w, r)
+
+	for _, cookie := range (&http.Response{Header: w.header}).Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(s.cookies, cookie.Name)
+		} else {
+			s.cookies[cookie.Name] = cookie
+		}
+	}
+	if op == _OP_LEAVE && w.code == http.StatusOK {
+		//stopped while ops are locked so no change polled after the leave is pushed
+		s.stopWatches(reqJson)
+	}
+	return w.code, w.body.Bytes()
+}
+
+func (s *socket) write(obj interface{}) error {
+	message, err := js.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return s.conn.writeMessage(message)
+}
+
+// setWatch starts pushing changes for the entity, or moves its version on if it is already watched.
+func (s *socket) setWatch(entityId string, version int, played bool) {
+	s.watchMtx.Lock()
+	defer s.watchMtx.Unlock()
+	if watch, exists := s.watches[entityId]; exists {
+		watch.version = version
+		watch.played = watch.played || played
+		select {
+		case watch.rewatch <- struct{}{}:
+		default:
+		}
+		return
+	}
+	watch := &socketWatch{
+		version: version,
+		played: played,
+		rewatch: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	s.watches[entityId] = watch
+	s.watching.Add(1)
+	go func() {
+		defer s.watching.Done()
+		s.watch(entityId, watch)
+	}()
+}
+
+// actedOn moves the acted on entity on to version so the act's own change isn't pushed back, acts without
+// an entityId are for the only entity the user plays in over the socket, or else the only entity watched.
+func (s *socket) actedOn(entityId string, version int) {
+	s.watchMtx.Lock()
+	defer s.watchMtx.Unlock()
+	if entityId == `` {
+		var played []string
+		for id, watch := range s.watches {
+			if watch.played {
+				played = append(played, id)
+			}
+		}
+		switch {
+		case len(played) == 1:
+			entityId = played[0]
+		case len(played) == 0 && len(s.watches) == 1:
+			for id := range s.watches {
+				entityId = id
+			}
+		}
+	}
+	if watch, exists := s.watches[entityId]; exists && version > watch.version {
+		watch.version = version
+	}
+}
+
+// stopWatches stops pushing changes for the entity named in the leave, or every entity when none was named.
+func (s *socket) stopWatches(reqJson Json) {
+	entityId, hasId := reqJson[_ENTITY_ID].(string)
+	if !hasId {
+		entityId, hasId = reqJson[_ID].(string)
+	}
+	s.watchMtx.Lock()
+	defer s.watchMtx.Unlock()
+	for id, watch := range s.watches {
+		if !hasId || id == entityId {
+			close(watch.stop)
+			delete(s.watches, id)
+		}
+	}
+}
+
+// watch pushes the change response to the client whenever the entity moves past the last version it was sent.
+func (s *socket) watch(entityId string, watch *socketWatch) {
+	var kick <-chan time.Time
+	if s.kickInterval > 0 {
+		ticker := time.NewTicker(s.kickInterval)
+		defer ticker.Stop()
+		kick = ticker.C
+	}
+	var keepalive <-chan time.Time
+	if s.keepalive > 0 {
+		ticker := time.NewTicker(s.keepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	for {
+		sub := s.changes.subscribe(entityId)
+		s.push(entityId, watch)
+		select {
+		case <-sub.changed:
+		case <-kick:
+		case <-keepalive:
+		case <-watch.rewatch:
+		case <-watch.stop:
+			sub.cancel()
+			return
+		case <-s.ctx.Done():
+			sub.cancel()
+			return
+		}
+		sub.cancel()
+	}
+}
+
+func (s *socket) push(entityId string, watch *socketWatch) {
+	s.watchMtx.Lock()
+	version := watch.version
+	s.watchMtx.Unlock()
+
+	code, body := s.do(_OP_POLL, Json{_ID: entityId, _VERSION: version})
+	if code != http.StatusOK || len(body) == 0 {
+		return
+	}
+	s.watchMtx.Lock()
+	select {
+	case <-watch.stop:
+		//the entity was left while it was polled
+		s.watchMtx.Unlock()
+		return
+	default:
+	}
+	if newVersion, ok := readBodyValue(body, _VERSION).(float64); ok && int(newVersion) > watch.version {
+		watch.version = int(newVersion)
+	}
+	s.watchMtx.Unlock()
+	s.write(Json{_OP: _OP_CHANGE, _BODY: js.RawMessage(body)})
+}
+
+func readBodyValue(body []byte, key string) interface{} {
+	bodyJson := Json{}
+	js.Unmarshal(body, &bodyJson)
+	return bodyJson[key]
+}
+
+// responseBuffer is an in memory http.ResponseWriter used to capture handler responses for socket messages.
+type responseBuffer struct{
+	header http.Header
+	code int
+	body bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{
+		header: http.Header{},
+		code: http.StatusOK,
+	}
+}
+
+func (w *responseBuffer) Header() http.Header {
+	return w.header
+}
+
+func (w *responseBuffer) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *responseBuffer) WriteHeader(code int) {
+	w.code = code
+}
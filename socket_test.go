@@ -0,0 +1,434 @@
+package oak
+
+import(
+	`io`
+	`net`
+	`time`
+	`bufio`
+	`bytes`
+	`errors`
+	`testing`
+	`net/http`
+	`crypto/rand`
+	`encoding/binary`
+	`encoding/base64`
+	js `encoding/json`
+	`net/http/httptest`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_socket_join_act_and_change_push(t *testing.T) {
+	version := 0
+	setup(func(userId string, e Entity)Json{return Json{"test": "join"}}, func(userId string, e Entity)Json{return Json{"test": "change"}}, func(json Json, userId string, e Entity)error{
+		if json[`move`] != `yo` {
+			return errors.New(`bad move`)
+		}
+		return nil
+	}, ``, ``)
+	tes.Create()
+	tes.entity.getVersion = func()int{return version}
+	c := dialTestSocket(t)
+	defer c.close()
+
+	resp := c.send(t, Json{_OP: _OP_JOIN, _REF: 1, _ID: `test_entity_id`})
+	assert.Equal(t, _OP_JOIN, resp[_OP], `response should have the op`)
+	assert.Equal(t, 1, int(resp[_REF].(float64)), `response should have the ref`)
+	assert.Equal(t, 200, int(resp[_CODE].(float64)), `response should have a 200 code`)
+	assert.Equal(t, `join`, resp[_BODY].(map[string]interface{})[`test`], `response body should be the join response`)
+	assert.Equal(t, `test_user_id`, testSessionValue(_USER_ID), `session should have the provided user id`)
+
+	resp = c.send(t, Json{_OP: _OP_ACT, _REF: 2, `move`: `nope`})
+	assert.Equal(t, 500, int(resp[_CODE].(float64)), `response should have a 500 code`)
+	assert.Equal(t, map[string]interface{}{`code`: `internal`, `message`: `bad move`}, resp[_ERROR], `response should have the error`)
+
+	version = 1
+	resp = c.send(t, Json{_OP: _OP_ACT, _REF: 3, `move`: `yo`})
+	if resp[_OP] == _OP_CHANGE {
+		resp = c.receive(t)
+	}
+	assert.Equal(t, _OP_ACT, resp[_OP], `response should have the op`)
+	assert.Equal(t, 200, int(resp[_CODE].(float64)), `response should have a 200 code`)
+	assert.Equal(t, 1, int(resp[_BODY].(map[string]interface{})[_VERSION].(float64)), `response body should have the new version`)
+}
+
+func Test_socket_pushes_changes_made_over_http(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	setupServer(store, Config{
+		SessionStore: newTestCookieStore(),
+		GetEntityChangeResp: func(userId string, e Entity)Json{return Json{"test": "change"}},
+	})
+	entityId, _, _ := store.Create()
+	c := dialTestSocket(t)
+	defer c.close()
+
+	resp := c.send(t, Json{_OP: _OP_POLL, _ID: entityId, _VERSION: -1})
+	assert.Equal(t, 0, int(resp[_BODY].(map[string]interface{})[_VERSION].(float64)), `response body should have the current version`)
+
+	r, _ := http.NewRequest(`POST`, c.url + _JOIN, bytes.NewBufferString(`{"`+_ID+`":"`+entityId+`"}`))
+	resp2, err := http.DefaultClient.Do(r)
+	if err == nil {
+		resp2.Body.Close()
+	}
+
+	resp = c.receive(t)
+	assert.Equal(t, _OP_CHANGE, resp[_OP], `message should be a pushed change`)
+	assert.Equal(t, `change`, resp[_BODY].(map[string]interface{})[`test`], `message body should be the change response`)
+	assert.Equal(t, 1, int(resp[_BODY].(map[string]interface{})[_VERSION].(float64)), `message body should have the new version`)
+}
+
+func Test_socket_pushes_changes_of_every_entity(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	setupServer(store, Config{
+		SessionStore: newTestCookieStore(),
+		GetEntityChangeResp: func(userId string, e Entity)Json{return Json{"test": e.CreatedBy()}},
+	}, MaxEntities(2))
+	create := func(creator string) string {
+		entityId, entity, _ := store.Create()
+		entity.(*storeTestEntity).Creator = creator
+		entity.(*storeTestEntity).Version++
+		store.Update(entityId, entity)
+		return entityId
+	}
+	entityA := create(`test_creator_a`)
+	entityB := create(`test_creator_b`)
+	c := dialTestSocket(t)
+	defer c.close()
+	c.send(t, Json{_OP: _OP_JOIN, _ID: entityA})
+	c.send(t, Json{_OP: _OP_JOIN, _ID: entityB})
+	join := func(entityId string) {
+		resp, err := http.Post(c.url + _JOIN, _JSON_CONTENT_TYPE, bytes.NewBufferString(`{"`+_ID+`":"`+entityId+`"}`))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	join(entityA)
+	resp := c.receive(t)
+	assert.Equal(t, _OP_CHANGE, resp[_OP], `message should be a pushed change`)
+	assert.Equal(t, `test_creator_a`, resp[_BODY].(map[string]interface{})[`test`], `change of the first entity should be pushed`)
+	join(entityB)
+	resp = c.receive(t)
+	assert.Equal(t, `test_creator_b`, resp[_BODY].(map[string]interface{})[`test`], `change of the second entity should be pushed`)
+
+	resp = c.send(t, Json{_OP: _OP_LEAVE, _ENTITY_ID: entityA})
+	assert.Equal(t, 200, int(resp[_CODE].(float64)), `leave should have a 200 code`)
+	join(entityA)
+	join(entityB)
+	resp = c.receive(t)
+	assert.Equal(t, `test_creator_b`, resp[_BODY].(map[string]interface{})[`test`], `changes of the left entity should not be pushed`)
+	assert.Equal(t, 4, int(resp[_BODY].(map[string]interface{})[_VERSION].(float64)), `message body should have the new version`)
+}
+
+func Test_socket_create_pushes_initial_state(t *testing.T) {
+	setup(nil, func(userId string, e Entity)Json{return Json{"test": "change"}}, nil, ``, ``)
+	c := dialTestSocket(t)
+	defer c.close()
+
+	resp := c.send(t, Json{_OP: _OP_CREATE})
+	assert.Equal(t, `test_entity_id`, resp[_BODY].(map[string]interface{})[_ID], `response body should have the entity id`)
+
+	resp = c.receive(t)
+	assert.Equal(t, _OP_CHANGE, resp[_OP], `message should be a pushed change`)
+	assert.Equal(t, 0, int(resp[_BODY].(map[string]interface{})[_VERSION].(float64)), `message body should have the version`)
+}
+
+func Test_socket_leave(t *testing.T) {
+	setup(nil, nil, nil, ``, ``)
+	c := dialTestSocket(t)
+	defer c.close()
+
+	resp := c.send(t, Json{_OP: _OP_LEAVE})
+
+	assert.Equal(t, 200, int(resp[_CODE].(float64)), `response should have a 200 code`)
+	assert.Nil(t, resp[_BODY], `response should not have a body`)
+}
+
+func Test_socket_with_unknown_op(t *testing.T) {
+	setup(nil, nil, nil, ``, ``)
+	c := dialTestSocket(t)
+	defer c.close()
+
+	resp := c.send(t, Json{_OP: `yo`})
+
+	assert.Equal(t, 400, int(resp[_CODE].(float64)), `response should have a 400 code`)
+	assert.Equal(t, map[string]interface{}{`code`: `bad_request`, `message`: `unknown op "yo"`}, resp[_ERROR], `response should have the error`)
+}
+
+func Test_socket_with_invalid_json(t *testing.T) {
+	setup(nil, nil, nil, ``, ``)
+	c := dialTestSocket(t)
+	defer c.close()
+
+	c.writeFrame(t, _WS_OP_TEXT, true, []byte(`{`))
+	resp := c.receive(t)
+
+	assert.Equal(t, 400, int(resp[_CODE].(float64)), `response should have a 400 code`)
+	assert.Equal(t, map[string]interface{}{`code`: `bad_request`, `message`: `unexpected end of JSON input`}, resp[_ERROR], `response should have the error`)
+}
+
+func Test_socket_fragmented_message_and_ping(t *testing.T) {
+	setup(nil, nil, nil, ``, ``)
+	c := dialTestSocket(t)
+	defer c.close()
+
+	c.writeFrame(t, _WS_OP_TEXT, false, []byte(`{"op":`))
+	c.writeFrame(t, _WS_OP_PING, true, []byte(`hi`))
+	opcode, payload := c.readFrame(t)
+	assert.Equal(t, byte(_WS_OP_PONG), opcode, `ping should be answered with a pong`)
+	assert.Equal(t, `hi`, string(payload), `pong should echo the ping payload`)
+	c.writeFrame(t, _WS_OP_PONG, true, nil)
+	c.writeFrame(t, _WS_OP_CONTINUATION, true, []byte(`"leave"}`))
+
+	resp := c.receive(t)
+	assert.Equal(t, _OP_LEAVE, resp[_OP], `fragments should be joined into one message`)
+}
+
+func Test_socket_close(t *testing.T) {
+	setup(nil, nil, nil, ``, ``)
+	c := dialTestSocket(t)
+	defer c.close()
+
+	c.writeFrame(t, _WS_OP_CLOSE, true, []byte{0x03, 0xE8})
+	opcode, payload := c.readFrame(t)
+
+	assert.Equal(t, byte(_WS_OP_CLOSE), opcode, `close should be answered with a close`)
+	assert.Equal(t, uint16(_WS_CLOSE_NORMAL), binary.BigEndian.Uint16(payload), `close code should be normal`)
+}
+
+func Test_socket_protocol_errors(t *testing.T) {
+	setup(nil, nil, nil, ``, ``)
+	for _, frame := range [][]byte{
+		{0x80 | _WS_OP_TEXT, 0x00},
+		{0xC0 | _WS_OP_TEXT, 0x80, 0, 0, 0, 0},
+		{0x80 | _WS_OP_CONTINUATION, 0x80, 0, 0, 0, 0},
+		{0x80 | 0x3, 0x80, 0, 0, 0, 0},
+		{_WS_OP_PING, 0x80, 0, 0, 0, 0},
+		{_WS_OP_TEXT, 0x80, 0, 0, 0, 0, 0x80 | _WS_OP_TEXT, 0x80, 0, 0, 0, 0},
+	} {
+		c := dialTestSocket(t)
+		c.conn.Write(frame)
+		opcode, payload := c.readFrame(t)
+		assert.Equal(t, byte(_WS_OP_CLOSE), opcode, `protocol errors should close the connection`)
+		assert.Equal(t, uint16(_WS_CLOSE_PROTOCOL_ERROR), binary.BigEndian.Uint16(payload), `close code should be protocol error`)
+		c.close()
+	}
+}
+
+func Test_socket_message_too_big(t *testing.T) {
+	setup(nil, nil, nil, ``, ``)
+	for _, frame := range [][]byte{
+		{0x80 | _WS_OP_TEXT, 0x80 | 127, 0, 0, 0, 0, 0x7F, 0, 0, 0},
+		{_WS_OP_TEXT, 0x80 | 127, 0, 0, 0, 0, 0, 0x0F, 0xFF, 0xFF, 0, 0, 0, 0},
+	} {
+		c := dialTestSocket(t)
+		c.conn.Write(frame)
+		if frame[0] & 0x80 == 0 {
+			c.conn.Write(make([]byte, 0x0FFFFF))
+			c.writeFrame(t, _WS_OP_CONTINUATION, true, []byte(`12`))
+		}
+		opcode, payload := c.readFrame(t)
+		assert.Equal(t, byte(_WS_OP_CLOSE), opcode, `oversized messages should close the connection`)
+		assert.Equal(t, uint16(_WS_CLOSE_TOO_BIG), binary.BigEndian.Uint16(payload), `close code should be too big`)
+		c.close()
+	}
+}
+
+func Test_socket_large_messages(t *testing.T) {
+	setup(nil, nil, func(json Json, userId string, e Entity)error{return errors.New(json[`big`].(string))}, ``, ``)
+	tes.Create()
+	tss.Get(nil, ``)
+	tss.session.Values[_ENTITY_ID] = `test_entity_id`
+	c := dialTestSocket(t)
+	defer c.close()
+
+	for _, size := range []int{200, 70000} {
+		big := make([]byte, size)
+		for i := range big {
+			big[i] = 'a'
+		}
+		resp := c.send(t, Json{_OP: _OP_ACT, `big`: string(big)})
+		assert.Equal(t, string(big), resp[_ERROR].(map[string]interface{})[`message`], `large messages should be sent and received`)
+	}
+}
+
+func Test_socket_with_invalid_handshakes(t *testing.T) {
+	setup(nil, nil, nil, ``, ``)
+	for _, test := range []struct{
+		method string
+		header http.Header
+		code ErrorCode
+		err string
+	}{
+		{`POST`, http.Header{}, CodeBadRequest, `websocket handshake must be a GET request`},
+		{`GET`, http.Header{}, CodeBadRequest, `websocket handshake must request a websocket upgrade`},
+		{`GET`, http.Header{`Connection`: {`keep-alive, Upgrade`}, `Upgrade`: {`websocket`}}, CodeBadRequest, `websocket handshake must use version 13`},
+		{`GET`, http.Header{`Connection`: {`Upgrade`}, `Upgrade`: {`websocket`}, `Sec-Websocket-Version`: {`13`}}, CodeBadRequest, `websocket handshake must include a key`},
+		{`GET`, http.Header{`Connection`: {`Upgrade`}, `Upgrade`: {`websocket`}, `Sec-Websocket-Version`: {`13`}, `Sec-Websocket-Key`: {`yo`}, `Origin`: {`http://other.example`}}, CodeForbidden, `websocket origin not allowed`},
+		{`GET`, http.Header{`Connection`: {`Upgrade`}, `Upgrade`: {`websocket`}, `Sec-Websocket-Version`: {`13`}, `Sec-Websocket-Key`: {`yo`}, `Origin`: {`http://oak`}}, CodeInternal, `websockets are not supported by the response writer`},
+		{`GET`, http.Header{`Connection`: {`Upgrade`}, `Upgrade`: {`websocket`}, `Sec-Websocket-Version`: {`13`}, `Sec-Websocket-Key`: {`yo`}}, CodeInternal, `websockets are not supported by the response writer`},
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(test.method, `http://oak` + _SOCKET, nil)
+		r.Header = test.header
+
+		tr.ServeHTTP(w, r)
+
+		assertTestError(t, w, test.code, test.err)
+		assert.Equal(t, NewError(test.code, ``).Status(), w.Code, `return code should match the error code`)
+	}
+}
+
+func Test_socket_with_allowed_origins(t *testing.T) {
+	for _, test := range []struct{
+		origins []string
+		origin string
+		allowed bool
+	}{
+		{nil, `http://other.example`, false},
+		{[]string{`http://other.example`}, `http://other.example`, true},
+		{[]string{`http://other.example`}, `http://another.example`, false},
+		{[]string{`*`}, `http://another.example`, true},
+	} {
+		setup(nil, nil, nil, ``, ``, SocketOrigins(test.origins...))
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(`GET`, `http://oak` + _SOCKET, nil)
+		r.Header = http.Header{`Connection`: {`Upgrade`}, `Upgrade`: {`websocket`}, `Sec-Websocket-Version`: {`13`}, `Sec-Websocket-Key`: {`yo`}, `Origin`: {test.origin}}
+
+		tr.ServeHTTP(w, r)
+
+		//handshakes which are allowed fail to hijack the recorder instead
+		assert.Equal(t, !test.allowed, w.Code == http.StatusForbidden, `origin ` + test.origin + ` should be allowed only if listed`)
+	}
+}
+
+func Test_socket_with_failing_hijack(t *testing.T) {
+	setup(nil, nil, nil, ``, ``)
+	w := &failingHijacker{httptest.NewRecorder()}
+	r, _ := http.NewRequest(`GET`, _SOCKET, nil)
+	r.Header = http.Header{`Connection`: {`Upgrade`}, `Upgrade`: {`websocket`}, `Sec-Websocket-Version`: {`13`}, `Sec-Websocket-Key`: {`yo`}}
+
+	tr.ServeHTTP(w, r)
+
+	assertTestError(t, w.ResponseRecorder, CodeInternal, `test_hijack_error`)
+}
+
+func Test_websocket_accept(t *testing.T) {
+	assert.Equal(t, `s3pPLMBiTxaQ9kYGzzhZRbK+xOo=`, websocketAccept(`dGhlIHNhbXBsZSBub25jZQ==`), `accept should match the RFC 6455 example`)
+}
+
+/**
+ * helpers
+ */
+
+type failingHijacker struct{
+	*httptest.ResponseRecorder
+}
+
+func (w *failingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New(`test_hijack_error`)
+}
+
+type testSocket struct{
+	server *httptest.Server
+	url string
+	conn net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestSocket(t *testing.T) *testSocket {
+	server := httptest.NewServer(tr)
+	conn, err := net.Dial(`tcp`, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, 16)
+	rand.Read(key)
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	io.WriteString(conn, "GET " + _SOCKET + " HTTP/1.1\r\nHost: oak\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + encodedKey + "\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get(`Sec-Websocket-Accept`) != websocketAccept(encodedKey) {
+		t.Fatal(`websocket handshake failed`)
+	}
+	return &testSocket{
+		server: server,
+		url: server.URL,
+		conn: conn,
+		reader: reader,
+	}
+}
+
+func (c *testSocket) send(t *testing.T, msg Json) Json {
+	data, _ := js.Marshal(msg)
+	c.writeFrame(t, _WS_OP_TEXT, true, data)
+	return c.receive(t)
+}
+
+func (c *testSocket) receive(t *testing.T) Json {
+	opcode, payload := c.readFrame(t)
+	if opcode != _WS_OP_TEXT {
+		t.Fatalf(`expected a text frame but got opcode %d`, opcode)
+	}
+	msg := Json{}
+	js.Unmarshal(payload, &msg)
+	return msg
+}
+
+func (c *testSocket) writeFrame(t *testing.T, opcode byte, fin bool, payload []byte) {
+	header := []byte{opcode, 0x80}
+	if fin {
+		header[0] |= 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		header[1] |= byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] |= 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header[1] |= 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i % 4]
+	}
+	if _, err := c.conn.Write(append(append(header, mask...), masked...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testSocket) readFrame(t *testing.T) (byte, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.reader, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.reader, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+func (c *testSocket) close() {
+	c.conn.Close()
+	c.server.Close()
+}
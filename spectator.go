@@ -0,0 +1,252 @@
+package oak
+
+import(
+	`sync`
+	`time`
+	`strconv`
+	`context`
+	`net/http`
+)
+
+// SpectatedEntity is implemented by entities which cap how many spectators may /watch them at once.
+// MaxSpectators is read whenever a spectator is added, 0 allows none and a negative number any number.
+// Entities which don't implement it may have any number of spectators.
+type SpectatedEntity interface{
+	MaxSpectators() int
+}
+
+// DefaultSpectatorTimeout is how long spectators keep their place without being seen unless SpectatorTimeout is given.
+const DefaultSpectatorTimeout = time.Minute
+
+// SpectatorTimeout sets how long a spectator keeps their place, counting towards the entity's MaxSpectators,
+// without a /watch or /poll or an open /stream or /socket. Spectators are dropped after it whether or not the
+// Server has Presence, so those who close their page or never keep their session cookie don't fill the entity.
+func SpectatorTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.spectatorTimeout = timeout
+	}
+}
+
+type spectatorsKey struct{}
+
+type spectatorInfo struct{
+	count func() int
+	isSpectator bool
+}
+
+// Spectators gives how many spectators are watching the entity, from the context GetJoinRespContext
+// and GetEntityChangeRespContext are called with. Spectators are counted by the Server in process
+// memory, joining spectators do not change the entity's version so the count is as of each response.
+func Spectators(ctx context.Context) int {
+	if sc, ok := ctx.Value(spectatorsKey{}).(*spectatorInfo); ok {
+		return sc.count()
+	}
+	return 0
+}
+
+// IsSpectator reports whether the user GetJoinRespContext or GetEntityChangeRespContext is called
+// for is a spectator, spectators are given their spectator id as their userId which the entity never registered.
+func IsSpectator(ctx context.Context) bool {
+	if sc, ok := ctx.Value(spectatorsKey{}).(*spectatorInfo); ok {
+		return sc.isSpectator
+	}
+	return false
+}
+
+// spectatorContext adds the entity's spectators to ctx for Spectators and IsSpectator.
+func (srv *Server) spectatorContext(ctx context.Context, entityId string, userId string) context.Context {
+	return context.WithValue(ctx, spectatorsKey{}, &spectatorInfo{
+		count: func() int {
+			return srv.spectators.count(entityId)
+		},
+		isSpectator: srv.spectators.has(entityId, userId),
+	})
+}
+
+// watch records the session as a spectator of an active entity, unless the user plays in it, and responds
+// as join does. Spectating doesn't count towards MaxEntities. Spectators stay until they /leave or /join
+// the entity, it becomes inactive or they haven't been seen for the SpectatorTimeout or, with Presence,
+// are idle. They are always forbidden from /act.
+func (srv *Server) watch(w http.ResponseWriter, r *http.Request) {
+	entityId, _, _, err := getRequestData(r, false)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+
+	entityStore := srv.entityStore(r)
+	entity, err := srv.fetchEntity(r.Context(), entityId, entityStore)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+
+	s, sessionErr := srv.getSession(w, r)
+	if entity.IsActive() && (!s.has(entityId) || s.isSpectator(entityId)) {
+		spectatorId := s.getUserId(entityId)
+		if spectatorId == `` {
+			//a new id is only given to a session which can be kept, else every request would take another place
+			if sessionErr != nil {
+				srv.writeError(w, r, sessionErr)
+				return
+			}
+			if spectatorId, err = newEntityId(); err != nil {
+				srv.writeError(w, r, err)
+				return
+			}
+		}
+		if err = srv.spectators.add(entityId, spectatorId, maxSpectators(entity)); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+		if err = s.spectate(spectatorId, entityId); err != nil {
+			srv.spectators.remove(entityId, spectatorId)
+			srv.writeError(w, r, err)
+			return
+		}
+	}
+
+	userId := s.getUserId(entityId)
+	if s.has(entityId) {
+		srv.presence.seen(entityId, userId)
+	}
+
+	etag := entityTag(entityId, userId, entity.GetVersion())
+	w.Header().Set(_ETAG, etag)
+	if etagMatches(r.Header.Get(_IF_NONE_MATCH), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	respJson, err := srv.getJoinResp(r.Context(), entityId, userId, entity)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	respJson[_VERSION] = entity.GetVersion()
+	writeJson(w, r, &respJson)
+}
+
+// stopSpectating removes the session's user from the spectators of the entity if they are one.
+func (srv *Server) stopSpectating(s *session, entityId string) {
+	if s.isSpectator(entityId) {
+		srv.spectators.remove(entityId, s.getUserId(entityId))
+		srv.presence.forget(entityId, s.getUserId(entityId))
+	}
+}
+
+func maxSpectators(entity Entity) int {
+	if spectated, ok := entity.(SpectatedEntity); ok {
+		return spectated.MaxSpectators()
+	}
+	return -1
+}
+
+// spectators are the spectators of each entity with when each was last seen, spectators not seen for
+// the timeout, and not held by a /stream or /socket, are dropped so abandoned ones don't keep their places.
+type spectators struct{
+	mtx sync.Mutex
+	timeout time.Duration
+	now func() time.Time
+	entities map[string]map[string]*presenceRecord
+}
+
+func newSpectators(timeout time.Duration) *spectators {
+	return &spectators{
+		timeout: timeout,
+		now: time.Now,
+		entities: map[string]map[string]*presenceRecord{},
+	}
+}
+
+// prune drops the entity's expired spectators, the lock must be held.
+func (sp *spectators) prune(entityId string) map[string]*presenceRecord {
+	now := sp.now()
+	records := sp.entities[entityId]
+	for spectatorId, record := range records {
+		if record.holds == 0 && !now.Before(record.lastSeen.Add(sp.timeout)) {
+			delete(records, spectatorId)
+		}
+	}
+	if len(records) == 0 {
+		delete(sp.entities, entityId)
+		return nil
+	}
+	return records
+}
+
+// add records the spectator as seen unless the entity already has max others, max < 0 is no limit.
+func (sp *spectators) add(entityId string, spectatorId string, max int) error {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	records := sp.prune(entityId)
+	if record, exists := records[spectatorId]; exists {
+		record.lastSeen = sp.now()
+		return nil
+	}
+	if max >= 0 && len(records) >= max {
+		e := NewError(CodeForbidden, `entity can have at most ` + strconv.Itoa(max) + ` spectators`)
+		e.Details = Json{`maxSpectators`: max}
+		return e
+	}
+	if records == nil {
+		records = map[string]*presenceRecord{}
+		sp.entities[entityId] = records
+	}
+	records[spectatorId] = &presenceRecord{lastSeen: sp.now()}
+	return nil
+}
+
+// seen keeps the spectator from expiring, users who aren't spectators of the entity are ignored.
+func (sp *spectators) seen(entityId string, spectatorId string) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	if record, exists := sp.entities[entityId][spectatorId]; exists {
+		record.lastSeen = sp.now()
+	}
+}
+
+// hold keeps the spectator from expiring until the returned func is called.
+func (sp *spectators) hold(entityId string, spectatorId string) func() {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	record, exists := sp.entities[entityId][spectatorId]
+	if !exists {
+		return func() {}
+	}
+	record.holds++
+	return func() {
+		sp.mtx.Lock()
+		defer sp.mtx.Unlock()
+		record.holds--
+		record.lastSeen = sp.now()
+	}
+}
+
+func (sp *spectators) remove(entityId string, spectatorId string) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	delete(sp.entities[entityId], spectatorId)
+	if len(sp.entities[entityId]) == 0 {
+		delete(sp.entities, entityId)
+	}
+}
+
+// forget removes every spectator of the entity.
+func (sp *spectators) forget(entityId string) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	delete(sp.entities, entityId)
+}
+
+func (sp *spectators) has(entityId string, spectatorId string) bool {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	_, exists := sp.prune(entityId)[spectatorId]
+	return exists
+}
+
+func (sp *spectators) count(entityId string) int {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	return len(sp.prune(entityId))
+}
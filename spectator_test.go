@@ -0,0 +1,195 @@
+package oak
+
+import(
+	`time`
+	`bytes`
+	`errors`
+	`context`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/gorilla/sessions`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_watch_records_spectator(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	setupServer(store, spectatorTestConf)
+	entityId, _, _ := store.Create()
+
+	w := serveTestRequest(`POST`, _WATCH, `{"`+_ID+`":"`+entityId+`"}`)
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, 200, w.Code, `watch should succeed`)
+	assert.Equal(t, float64(1), resp[`spectators`], `spectator should be counted`)
+	assert.Equal(t, true, resp[`spectator`], `user should be a spectator`)
+	assert.Equal(t, true, testSessionValue(_SPECTATOR), `spectator should be recorded in the session`)
+	spectatorId := testSessionValue(_USER_ID)
+	assert.NotEmpty(t, spectatorId, `spectator should have an id`)
+	entity, _ := store.Read(entityId)
+	assert.Empty(t, entity.(*storeTestEntity).Users, `spectator should not be registered with the entity`)
+
+	serveTestRequest(`POST`, _WATCH, `{"`+_ID+`":"`+entityId+`"}`)
+	assert.Equal(t, spectatorId, testSessionValue(_USER_ID), `watching again should keep the spectator id`)
+
+	w = serveTestRequest(`POST`, _ACT, `{}`)
+	assert.Equal(t, 403, w.Code, `spectators should not act`)
+	assertTestError(t, w, CodeForbidden, `spectators can not act`)
+
+	w = serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	resp = Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, `test_user_1`, testSessionValue(_USER_ID), `spectator should be able to join`)
+	assert.Nil(t, testSessionValue(_SPECTATOR), `player should not be a spectator`)
+	assert.Equal(t, float64(0), resp[`spectators`], `joined spectator should no longer be counted`)
+	assert.Equal(t, false, resp[`spectator`], `player should not be a spectator`)
+
+	w = serveTestRequest(`POST`, _WATCH, `{"`+_ID+`":"`+entityId+`"}`)
+	resp = Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, `test_user_1`, testSessionValue(_USER_ID), `player should not become a spectator`)
+	assert.Equal(t, float64(0), resp[`spectators`], `player should not be counted as a spectator`)
+}
+
+func Test_watch_with_spectator_limit(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &limitedTestEntity{Max: 1}})
+	setupServer(store, spectatorTestConf)
+	entityId, _, _ := store.Create()
+
+	assert.Equal(t, 200, serveTestRequest(`POST`, _WATCH, `{"`+_ID+`":"`+entityId+`"}`).Code, `first spectator should be allowed`)
+	firstSession := tss.session
+
+	tss.session = nil
+	w := serveTestRequest(`POST`, _WATCH, `{"`+_ID+`":"`+entityId+`"}`)
+	assert.Equal(t, 403, w.Code, `spectators over the limit should be rejected`)
+	assertTestError(t, w, CodeForbidden, `entity can have at most 1 spectators`)
+	assert.Nil(t, testSessionValue(_SPECTATOR), `rejected spectator should not be recorded`)
+
+	tss.session = firstSession
+	assert.Equal(t, 200, serveTestRequest(`POST`, _LEAVE, ``).Code, `spectator should leave`)
+	assert.Empty(t, tss.session.Values, `leaving spectator should be cleared from the session`)
+
+	tss.session = nil
+	assert.Equal(t, 200, serveTestRequest(`POST`, _WATCH, `{"`+_ID+`":"`+entityId+`"}`).Code, `spectator should be allowed once another has left`)
+}
+
+func Test_watch_frees_places_of_abandoned_spectators(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &limitedTestEntity{Max: 2}})
+	conf := spectatorTestConf
+	conf.SessionStore = newTestCookieStore()
+	srv := setupServer(store, conf)
+	entityId, _, _ := store.Create()
+	watch := `{"`+_ID+`":"`+entityId+`"}`
+
+	kept := serveTestRequest(`POST`, _WATCH, watch)
+	assert.Equal(t, 200, kept.Code, `first cookieless spectator should be allowed`)
+	assert.Equal(t, 200, serveTestRequest(`POST`, _WATCH, watch).Code, `second cookieless spectator should be allowed`)
+	assertTestError(t, serveTestRequest(`POST`, _WATCH, watch), CodeForbidden, `entity can have at most 2 spectators`)
+
+	start := time.Now()
+	srv.spectators.now = func() time.Time {return start.Add(DefaultSpectatorTimeout / 2)}
+	r, _ := http.NewRequest(`POST`, _POLL, bytes.NewBufferString(`{"`+_ID+`":"`+entityId+`","`+_VERSION+`":-1}`))
+	r.Header.Set(`Cookie`, kept.Header().Get(`Set-Cookie`))
+	tr.ServeHTTP(httptest.NewRecorder(), r)
+
+	srv.spectators.now = func() time.Time {return start.Add(DefaultSpectatorTimeout)}
+	assert.Equal(t, 1, srv.spectators.count(entityId), `abandoned spectator should expire while the polling one is kept`)
+	assert.Equal(t, 200, serveTestRequest(`POST`, _WATCH, watch).Code, `abandoned spectator's place should be freed`)
+	assertTestError(t, serveTestRequest(`POST`, _WATCH, watch), CodeForbidden, `entity can have at most 2 spectators`)
+}
+
+func Test_watch_with_unsaveable_session(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &limitedTestEntity{Max: 1}})
+	conf := spectatorTestConf
+	conf.SessionStore = &unsaveableSessionStore{}
+	srv := setupServer(store, conf)
+	entityId, _, _ := store.Create()
+
+	w := serveTestRequest(`POST`, _WATCH, `{"`+_ID+`":"`+entityId+`"}`)
+	assertTestError(t, w, CodeInternal, `sessions: error saving session "test_session" -- test_save_error`)
+	assert.Equal(t, 0, srv.spectators.count(entityId), `spectator who can't be kept in the session should not take a place`)
+}
+
+func Test_watch_with_unreadable_session(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &limitedTestEntity{Max: 1}})
+	conf := spectatorTestConf
+	conf.SessionStore = &unreadableSessionStore{}
+	srv := setupServer(store, conf)
+	entityId, _, _ := store.Create()
+
+	w := serveTestRequest(`POST`, _WATCH, `{"`+_ID+`":"`+entityId+`"}`)
+	assertTestError(t, w, CodeInternal, `test_session_error`)
+	assert.Equal(t, 0, srv.spectators.count(entityId), `spectator whose session can't be kept should not take a place`)
+}
+
+func Test_spectators(t *testing.T) {
+	sp := newSpectators(time.Minute)
+
+	assert.Nil(t, sp.add(`test_entity_id`, `test_spectator_a`, 2), `spectator under the limit should be added`)
+	assert.Nil(t, sp.add(`test_entity_id`, `test_spectator_b`, 2), `spectator at the limit should be added`)
+	assert.Nil(t, sp.add(`test_entity_id`, `test_spectator_b`, 2), `existing spectator should be allowed at the limit`)
+	assert.NotNil(t, sp.add(`test_entity_id`, `test_spectator_c`, 2), `spectator over the limit should be rejected`)
+	assert.NotNil(t, sp.add(`test_other_entity_id`, `test_spectator_a`, 0), `no spectators should be allowed with a limit of 0`)
+	assert.Nil(t, sp.add(`test_other_entity_id`, `test_spectator_a`, -1), `any spectators should be allowed with a negative limit`)
+
+	assert.Equal(t, 2, sp.count(`test_entity_id`), `spectators should be counted`)
+	assert.True(t, sp.has(`test_entity_id`, `test_spectator_a`), `added spectator should be had`)
+	sp.remove(`test_entity_id`, `test_spectator_a`)
+	assert.False(t, sp.has(`test_entity_id`, `test_spectator_a`), `removed spectator should not be had`)
+	sp.forget(`test_entity_id`)
+	assert.Equal(t, 0, sp.count(`test_entity_id`), `forgotten entity should have no spectators`)
+	assert.Equal(t, 1, len(sp.entities), `only entities with spectators should be kept`)
+}
+
+/**
+ * helpers
+ */
+
+// spectatorTestConf responds with the spectator context values.
+var spectatorTestConf = Config{
+	GetJoinRespContext: func(ctx context.Context, userId string, e Entity)Json{
+		return Json{`spectators`: Spectators(ctx), `spectator`: IsSpectator(ctx)}
+	},
+	GetEntityChangeRespContext: func(ctx context.Context, userId string, e Entity)Json{
+		return Json{`spectators`: Spectators(ctx), `spectator`: IsSpectator(ctx)}
+	},
+}
+
+// unsaveableSessionStore gives sessions, through the request's registry as gorilla's stores do, which can't be saved.
+type unsaveableSessionStore struct{}
+
+func (uss *unsaveableSessionStore) Get(r *http.Request, sessName string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(uss, sessName)
+}
+
+func (uss *unsaveableSessionStore) New(r *http.Request, sessName string) (*sessions.Session, error) {
+	return sessions.NewSession(uss, sessName), nil
+}
+
+func (uss *unsaveableSessionStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	return errors.New(`test_save_error`)
+}
+
+// unreadableSessionStore gives a new session with an error, as cookie stores do for cookies they can't decode.
+type unreadableSessionStore struct{}
+
+func (uss *unreadableSessionStore) Get(r *http.Request, sessName string) (*sessions.Session, error) {
+	return sessions.NewSession(uss, sessName), errors.New(`test_session_error`)
+}
+
+func (uss *unreadableSessionStore) New(r *http.Request, sessName string) (*sessions.Session, error) {
+	return sessions.NewSession(uss, sessName), errors.New(`test_session_error`)
+}
+
+func (uss *unreadableSessionStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	return nil
+}
+
+type limitedTestEntity struct{
+	storeTestEntity
+	Max int
+}
+
+func (e *limitedTestEntity) MaxSpectators() int {
+	return e.Max
+}
@@ -0,0 +1,186 @@
+package oak
+
+import(
+	`context`
+	`errors`
+	`regexp`
+	`strconv`
+	`database/sql`
+	`encoding/gob`
+)
+
+// SqlDialect holds the database specific parts of the statements used by SqlEntityStore.
+type SqlDialect struct{
+	// Placeholder returns the bind parameter for the nth (1 based) argument of a statement.
+	Placeholder func(n int) string
+	// BlobType is the column type used to store the gob encoded entities.
+	BlobType string
+}
+
+var (
+	SqliteDialect = SqlDialect{
+		Placeholder: func(n int) string { return `?` },
+		BlobType: `BLOB`,
+	}
+	MysqlDialect = SqlDialect{
+		Placeholder: func(n int) string { return `?` },
+		BlobType: `LONGBLOB`,
+	}
+	PostgresDialect = SqlDialect{
+		Placeholder: func(n int) string { return `$` + strconv.Itoa(n) },
+		BlobType: `BYTEA`,
+	}
+)
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SqlEntityStore is an EntityStore keeping gob encoded entities alongside their version in a
+// single table, updates are conditional on the stored version so only sequential updates succeed.
+// Call Migrate before first use to create or upgrade the table.
+type SqlEntityStore struct{
+	db *sql.DB
+	table string
+	dialect SqlDialect
+	newEntity func() Entity
+}
+
+// SqlStoreOption configures optional behaviour of a SqlEntityStore.
+type SqlStoreOption func(*SqlEntityStore)
+
+// UseSqlDialect sets the dialect, the default is SqliteDialect.
+func UseSqlDialect(dialect SqlDialect) SqlStoreOption {
+	return func(ses *SqlEntityStore) {
+		ses.dialect = dialect
+	}
+}
+
+// NewSqlEntityStore returns a store using table in db, newEntity must return a fresh entity for each call to Create.
+func NewSqlEntityStore(db *sql.DB, table string, newEntity func() Entity, opts ...SqlStoreOption) (*SqlEntityStore, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, errors.New(`invalid table name "` + table + `"`)
+	}
+	gob.Register(newEntity())
+	ses := &SqlEntityStore{
+		db: db,
+		table: table,
+		dialect: SqliteDialect,
+		newEntity: newEntity,
+	}
+	for _, opt := range opts {
+		opt(ses)
+	}
+	return ses, nil
+}
+
+// sqlMigrations are applied in order, each once, new schema changes must be appended never edited.
+var sqlMigrations = []func(ses *SqlEntityStore) []string{
+	func(ses *SqlEntityStore) []string {
+		return []string{`CREATE TABLE IF NOT EXISTS ` + ses.table + ` (id VARCHAR(64) NOT NULL PRIMARY KEY, version BIGINT NOT NULL, entity ` + ses.dialect.BlobType + ` NOT NULL)`}
+	},
+}
+
+// Migrate brings the store's schema up to date, recording applied migrations in a <table>_migrations table.
+func (ses *SqlEntityStore) Migrate() error {
+	migrationsTable := ses.table + `_migrations`
+	if _, err := ses.db.Exec(`CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var current int
+	if err := ses.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM ` + migrationsTable).Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(sqlMigrations); i++ {
+		tx, err := ses.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range sqlMigrations[i](ses) {
+			if _, err = tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err = tx.Exec(`INSERT INTO ` + migrationsTable + ` (version) VALUES (` + ses.dialect.Placeholder(1) + `)`, i + 1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ses *SqlEntityStore) Create() (string, Entity, error) {
+	return ses.CreateContext(context.Background())
+}
+
+func (ses *SqlEntityStore) Read(entityId string) (Entity, error) {
+	return ses.ReadContext(context.Background(), entityId)
+}
+
+func (ses *SqlEntityStore) Update(entityId string, entity Entity) error {
+	return ses.UpdateContext(context.Background(), entityId, entity)
+}
+
+func (ses *SqlEntityStore) CreateContext(ctx context.Context) (entityId string, entity Entity, err error) {
+	entity = ses.newEntity()
+	data, err := encodeEntity(entity)
+	if err != nil {
+		return ``, nil, err
+	}
+	if entityId, err = newEntityId(); err != nil {
+		return ``, nil, err
+	}
+	p := ses.dialect.Placeholder
+	if _, err = ses.db.ExecContext(ctx, `INSERT INTO ` + ses.table + ` (id, version, entity) VALUES (` + p(1) + `, ` + p(2) + `, ` + p(3) + `)`, entityId, entity.GetVersion(), data); err != nil {
+		return ``, nil, err
+	}
+	entity, err = decodeEntity(data)
+	return
+}
+
+func (ses *SqlEntityStore) ReadContext(ctx context.Context, entityId string) (Entity, error) {
+	var data []byte
+	err := ses.db.QueryRowContext(ctx, `SELECT entity FROM ` + ses.table + ` WHERE id = ` + ses.dialect.Placeholder(1), entityId).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errEntityNotFound(entityId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEntity(data)
+}
+
+func (ses *SqlEntityStore) UpdateContext(ctx context.Context, entityId string, entity Entity) error {
+	data, err := encodeEntity(entity)
+	if err != nil {
+		return err
+	}
+	p := ses.dialect.Placeholder
+	version := entity.GetVersion()
+	result, err := ses.db.ExecContext(ctx, `UPDATE ` + ses.table + ` SET version = ` + p(1) + `, entity = ` + p(2) + ` WHERE id = ` + p(3) + ` AND version = ` + p(4), version, data, entityId, version - 1)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+	var storedVersion int
+	err = ses.db.QueryRowContext(ctx, `SELECT version FROM ` + ses.table + ` WHERE id = ` + p(1), entityId).Scan(&storedVersion)
+	if err == sql.ErrNoRows {
+		return errEntityNotFound(entityId)
+	}
+	if err != nil {
+		return err
+	}
+	return &ErrNonsequentialUpdate{
+		EntityId: entityId,
+		ExpectedVersion: storedVersion + 1,
+		ActualVersion: version,
+	}
+}
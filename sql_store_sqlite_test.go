@@ -0,0 +1,92 @@
+package oak
+
+// these tests run SqlEntityStore against a real SQLite database rather than the fake driver of
+// sql_store_test.go, using the vendored github.com/mattn/go-sqlite3 which needs cgo, they are
+// skipped when it is built without.
+
+import(
+	`testing`
+	`database/sql`
+	`path/filepath`
+	`github.com/stretchr/testify/assert`
+	_ `github.com/mattn/go-sqlite3`
+)
+
+func Test_sqlite_store_migrate(t *testing.T) {
+	db := openTestSqlite(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{}})
+
+	assert.Nil(t, store.Migrate(), `migrate should not error`)
+	assert.Nil(t, store.Migrate(), `migrate should be idempotent`)
+
+	var migrations int
+	db.QueryRow(`SELECT COUNT(*) FROM entities_migrations`).Scan(&migrations)
+	assert.Equal(t, 1, migrations, `each migration should be recorded once`)
+}
+
+func Test_sqlite_store_create_read_and_update(t *testing.T) {
+	db := openTestSqlite(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{Creator: `test_creator_user_id`}})
+	assert.Nil(t, store.Migrate(), `migrate should not error`)
+
+	entityId, entity, err := store.Create()
+	assert.Nil(t, err, `create should not error`)
+	read, err := store.Read(entityId)
+	assert.Nil(t, err, `read should not error`)
+	assert.Equal(t, entity, read, `read entity should equal the created entity`)
+
+	read.(*storeTestEntity).Version = 1
+	read.(*storeTestEntity).Users = []string{`test_user_id`}
+	assert.Nil(t, store.Update(entityId, read), `next version should be accepted`)
+	reread, _ := store.Read(entityId)
+	assert.Equal(t, read, reread, `update should be stored`)
+
+	err = store.Update(entityId, &storeTestEntity{Version: 1})
+	assert.Equal(t, &ErrNonsequentialUpdate{EntityId: entityId, ExpectedVersion: 2, ActualVersion: 1}, err, `stale version should be nonsequential`)
+	err = store.Update(entityId, &storeTestEntity{Version: 3})
+	assert.Equal(t, &ErrNonsequentialUpdate{EntityId: entityId, ExpectedVersion: 2, ActualVersion: 3}, err, `skipped version should be nonsequential`)
+}
+
+func Test_sqlite_store_with_concurrent_updates(t *testing.T) {
+	db := openTestSqlite(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{}})
+	store.Migrate()
+	entityId, _, _ := store.Create()
+	first, _ := store.Read(entityId)
+	second, _ := store.Read(entityId)
+
+	first.(*storeTestEntity).Version++
+	second.(*storeTestEntity).Version++
+	assert.Nil(t, store.Update(entityId, first), `first update of a version should be accepted`)
+	_, isNonsequential := store.Update(entityId, second).(*ErrNonsequentialUpdate)
+	assert.True(t, isNonsequential, `second update of the same version should be nonsequential`)
+}
+
+func Test_sqlite_store_with_unknown_entity(t *testing.T) {
+	db := openTestSqlite(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{}})
+	store.Migrate()
+
+	_, err := store.Read(`test_entity_id`)
+	assert.Equal(t, CodeNotFound, AsError(err).Code, `read should be not found`)
+	err = store.Update(`test_entity_id`, &storeTestEntity{Version: 1})
+	assert.Equal(t, CodeNotFound, AsError(err).Code, `update should be not found`)
+}
+
+/**
+ * helpers
+ */
+
+func openTestSqlite(t *testing.T) *sql.DB {
+	db, err := sql.Open(`sqlite3`, filepath.Join(t.TempDir(), `oak.db`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	if err = db.Ping(); err != nil {
+		t.Skip(`sqlite is unavailable: ` + err.Error())
+	}
+	return db
+}
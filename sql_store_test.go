@@ -0,0 +1,319 @@
+package oak
+
+import(
+	`io`
+	`sync`
+	`errors`
+	`strings`
+	`testing`
+	`database/sql`
+	`database/sql/driver`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_sql_store_migrate(t *testing.T) {
+	db, state := openFakeSql(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{}})
+
+	assert.Nil(t, store.Migrate(), `migrate should not error`)
+	assert.Nil(t, store.Migrate(), `migrate should be idempotent`)
+
+	assert.Equal(t, []int{1}, state.migrations, `each migration should be recorded once`)
+	assert.Equal(t, 1, state.count(`CREATE TABLE IF NOT EXISTS entities (id VARCHAR(64) NOT NULL PRIMARY KEY, version BIGINT NOT NULL, entity BLOB NOT NULL)`), `entity table should be created once`)
+	assert.Equal(t, 1, state.commits, `each migration should be committed`)
+}
+
+func Test_sql_store_migrate_errors(t *testing.T) {
+	for _, prefix := range []string{`CREATE TABLE IF NOT EXISTS entities_migrations`, `SELECT COALESCE`, `BEGIN`, `CREATE TABLE IF NOT EXISTS entities `, `INSERT INTO entities_migrations`, `COMMIT`} {
+		db, state := openFakeSql(t)
+		store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{}})
+		state.errs[prefix] = errors.New(`test_sql_error`)
+
+		assert.Equal(t, `test_sql_error`, store.Migrate().Error(), `migrate should return the error`)
+	}
+}
+
+func Test_sql_store_create_read_and_update(t *testing.T) {
+	db, _ := openFakeSql(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{Creator: `test_creator_user_id`}})
+	store.Migrate()
+
+	entityId, entity, err := store.Create()
+	assert.Nil(t, err, `create should not error`)
+	assert.Equal(t, 32, len(entityId), `entity id should be generated`)
+	assert.Equal(t, `test_creator_user_id`, entity.CreatedBy(), `created entity should be returned`)
+
+	read, err := store.Read(entityId)
+	assert.Nil(t, err, `read should not error`)
+	assert.Equal(t, entity, read, `read entity should equal the created entity`)
+
+	read.(*storeTestEntity).Version = 1
+	read.(*storeTestEntity).Users = []string{`test_user_id`}
+	assert.Nil(t, store.Update(entityId, read), `next version should be accepted`)
+	reread, _ := store.Read(entityId)
+	assert.Equal(t, read, reread, `update should be stored`)
+
+	err = store.Update(entityId, &storeTestEntity{Version: 1})
+	assert.Equal(t, &ErrNonsequentialUpdate{EntityId: entityId, ExpectedVersion: 2, ActualVersion: 1}, err, `stale version should be nonsequential`)
+}
+
+func Test_sql_store_with_unknown_entity(t *testing.T) {
+	db, _ := openFakeSql(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{}})
+
+	_, err := store.Read(`test_entity_id`)
+	assert.Equal(t, `no entity with id "test_entity_id"`, err.Error(), `read should error`)
+
+	err = store.Update(`test_entity_id`, &storeTestEntity{Version: 1})
+	assert.Equal(t, `no entity with id "test_entity_id"`, err.Error(), `update should error`)
+}
+
+func Test_sql_store_errors(t *testing.T) {
+	for _, prefix := range []string{`INSERT INTO entities `, `SELECT entity`, `UPDATE`, `SELECT version`} {
+		db, state := openFakeSql(t)
+		store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{}})
+		state.rows[`test_entity_id`] = &fakeSqlRow{version: 5}
+		state.errs[prefix] = errors.New(`test_sql_error`)
+
+		var err error
+		switch prefix {
+		case `INSERT INTO entities `:
+			_, _, err = store.Create()
+		case `SELECT entity`:
+			_, err = store.Read(`test_entity_id`)
+		default:
+			err = store.Update(`test_entity_id`, &storeTestEntity{Version: 1})
+		}
+		assert.Equal(t, `test_sql_error`, err.Error(), `store should return the error`)
+	}
+}
+
+func Test_sql_store_with_unencodable_entity(t *testing.T) {
+	db, state := openFakeSql(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &testEntity{}})
+	state.rows[`test_entity_id`] = &fakeSqlRow{data: []byte(`garbage`)}
+
+	_, _, err := store.Create()
+	assert.NotNil(t, err, `create should error`)
+	assert.NotNil(t, store.Update(`test_entity_id`, &testEntity{}), `update should error`)
+	_, err = store.Read(`test_entity_id`)
+	assert.NotNil(t, err, `read should error`)
+}
+
+func Test_sql_store_with_postgres_dialect(t *testing.T) {
+	db, state := openFakeSql(t)
+	store, _ := NewSqlEntityStore(db, `entities`, func()Entity{return &storeTestEntity{}}, UseSqlDialect(PostgresDialect))
+	store.Migrate()
+
+	entityId, _, _ := store.Create()
+	store.Update(entityId, &storeTestEntity{Version: 1})
+
+	assert.Equal(t, 1, state.count(`CREATE TABLE IF NOT EXISTS entities (id VARCHAR(64) NOT NULL PRIMARY KEY, version BIGINT NOT NULL, entity BYTEA NOT NULL)`), `postgres blob type should be used`)
+	assert.Equal(t, 1, state.count(`INSERT INTO entities (id, version, entity) VALUES ($1, $2, $3)`), `postgres placeholders should be used`)
+	assert.Equal(t, 1, state.count(`UPDATE entities SET version = $1, entity = $2 WHERE id = $3 AND version = $4`), `postgres placeholders should be used`)
+}
+
+func Test_sql_store_with_invalid_table_name(t *testing.T) {
+	db, _ := openFakeSql(t)
+
+	_, err := NewSqlEntityStore(db, `entities; DROP TABLE users`, func()Entity{return &storeTestEntity{}})
+
+	assert.Equal(t, `invalid table name "entities; DROP TABLE users"`, err.Error(), `constructor should reject the table name`)
+}
+
+/**
+ * helpers
+ *
+ * no sql driver is vendored so these tests run against a fake database/sql driver which only
+ * matches the statements SqlEntityStore issues, they check the statements and error handling
+ * but not that any database accepts them, see sql_store_sqlite_test.go for that.
+ */
+
+var (
+	fakeSqlOnce sync.Once
+	fakeSqlMtx sync.Mutex
+	fakeSqlStates = map[string]*fakeSqlState{}
+)
+
+type fakeSqlState struct{
+	mtx sync.Mutex
+	stmts []string
+	migrations []int
+	rows map[string]*fakeSqlRow
+	errs map[string]error
+	commits int
+}
+
+type fakeSqlRow struct{
+	version int64
+	data []byte
+}
+
+func openFakeSql(t *testing.T) (*sql.DB, *fakeSqlState) {
+	fakeSqlOnce.Do(func() {
+		sql.Register(`oak_fake_sql`, fakeSqlDriver{})
+	})
+	state := &fakeSqlState{
+		rows: map[string]*fakeSqlRow{},
+		errs: map[string]error{},
+	}
+	fakeSqlMtx.Lock()
+	fakeSqlStates[t.Name()] = state
+	fakeSqlMtx.Unlock()
+	db, _ := sql.Open(`oak_fake_sql`, t.Name())
+	t.Cleanup(func() { db.Close() })
+	return db, state
+}
+
+func (s *fakeSqlState) count(stmt string) int {
+	count := 0
+	for _, s := range s.stmts {
+		if s == stmt {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *fakeSqlState) err(stmt string) error {
+	for prefix, err := range s.errs {
+		if strings.HasPrefix(stmt, prefix) {
+			return err
+		}
+	}
+	return nil
+}
+
+type fakeSqlDriver struct{}
+
+func (fakeSqlDriver) Open(name string) (driver.Conn, error) {
+	fakeSqlMtx.Lock()
+	defer fakeSqlMtx.Unlock()
+	return &fakeSqlConn{fakeSqlStates[name]}, nil
+}
+
+type fakeSqlConn struct{
+	state *fakeSqlState
+}
+
+func (c *fakeSqlConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSqlStmt{c.state, query}, nil
+}
+
+func (c *fakeSqlConn) Close() error {
+	return nil
+}
+
+func (c *fakeSqlConn) Begin() (driver.Tx, error) {
+	if err := c.state.err(`BEGIN`); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *fakeSqlConn) Commit() error {
+	if err := c.state.err(`COMMIT`); err != nil {
+		return err
+	}
+	c.state.commits++
+	return nil
+}
+
+func (c *fakeSqlConn) Rollback() error {
+	return nil
+}
+
+type fakeSqlStmt struct{
+	state *fakeSqlState
+	query string
+}
+
+func (s *fakeSqlStmt) Close() error {
+	return nil
+}
+
+func (s *fakeSqlStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeSqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	st := s.state
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.stmts = append(st.stmts, s.query)
+	if err := st.err(s.query); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(s.query, `CREATE TABLE`):
+		return driver.RowsAffected(0), nil
+	case strings.Contains(s.query, `_migrations (version)`):
+		st.migrations = append(st.migrations, int(args[0].(int64)))
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, `INSERT INTO`):
+		st.rows[args[0].(string)] = &fakeSqlRow{version: args[1].(int64), data: args[2].([]byte)}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, `UPDATE`):
+		row, exists := st.rows[args[2].(string)]
+		if !exists || row.version != args[3].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		row.version = args[0].(int64)
+		row.data = args[1].([]byte)
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New(`unexpected statement: ` + s.query)
+}
+
+func (s *fakeSqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	st := s.state
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.stmts = append(st.stmts, s.query)
+	if err := st.err(s.query); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(s.query, `SELECT COALESCE`):
+		max := int64(0)
+		for _, version := range st.migrations {
+			if int64(version) > max {
+				max = int64(version)
+			}
+		}
+		return &fakeSqlRows{columns: []string{`version`}, values: [][]driver.Value{{max}}}, nil
+	case strings.HasPrefix(s.query, `SELECT entity`):
+		if row, exists := st.rows[args[0].(string)]; exists {
+			return &fakeSqlRows{columns: []string{`entity`}, values: [][]driver.Value{{row.data}}}, nil
+		}
+		return &fakeSqlRows{columns: []string{`entity`}}, nil
+	case strings.HasPrefix(s.query, `SELECT version`):
+		if row, exists := st.rows[args[0].(string)]; exists {
+			return &fakeSqlRows{columns: []string{`version`}, values: [][]driver.Value{{row.version}}}, nil
+		}
+		return &fakeSqlRows{columns: []string{`version`}}, nil
+	}
+	return nil, errors.New(`unexpected query: ` + s.query)
+}
+
+type fakeSqlRows struct{
+	columns []string
+	values [][]driver.Value
+}
+
+func (r *fakeSqlRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeSqlRows) Close() error {
+	return nil
+}
+
+func (r *fakeSqlRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,97 @@
+package oak
+
+import(
+	`context`
+	`reflect`
+	js `encoding/json`
+	`github.com/gorilla/sessions`
+)
+
+// TypedConfig is the Config of a server for a single concrete entity type E, its callbacks receive
+// E rather than Entity and return typed responses which oak marshals and adds the version to.
+// Responses must marshal to json objects so the version can be added, those which fail to marshal
+// are sent as internal errors. The EntityStore must return entities of type E.
+type TypedConfig[E Entity, J any, C any] struct{
+	SessionStore sessions.Store
+	SessionName string
+	Entity E
+	EntityStoreFactory EntityStoreFactory
+	GetJoinResp func(userId string, e E) J
+	GetEntityChangeResp func(userId string, e E) C
+	PerformAct func(json Json, userId string, e E) error
+	// the Context variants are used in place of the plain callbacks when set, as with Config.
+	GetJoinRespContext func(ctx context.Context, userId string, e E) J
+	GetEntityChangeRespContext func(ctx context.Context, userId string, e E) C
+	PerformActContext func(ctx context.Context, json Json, userId string, e E) error
+}
+
+// NewTypedServer returns a Server for the typed config, e.g.
+// NewTypedServer[*Game, JoinResp, ChangeResp](TypedConfig[*Game, JoinResp, ChangeResp]{...}).
+// It panics if J or C can't marshal to json objects, such as slices or strings.
+func NewTypedServer[E Entity, J any, C any](conf TypedConfig[E, J, C], opts ...Option) *Server {
+	for _, respType := range []reflect.Type{reflect.TypeFor[J](), reflect.TypeFor[C]()} {
+		if !marshalsToObject(respType) {
+			panic(`oak: typed response ` + respType.String() + ` does not marshal to a json object`)
+		}
+	}
+	srv := NewServer(Config{
+		SessionStore: conf.SessionStore,
+		SessionName: conf.SessionName,
+		Entity: conf.Entity,
+		EntityStoreFactory: conf.EntityStoreFactory,
+		PerformActContext: func(ctx context.Context, json Json, userId string, e Entity) error {
+			if conf.PerformActContext != nil {
+				return conf.PerformActContext(ctx, json, userId, e.(E))
+			}
+			return conf.PerformAct(json, userId, e.(E))
+		},
+	}, opts...)
+	srv.typedJoinResp = func(ctx context.Context, userId string, e Entity) (Json, error) {
+		if conf.GetJoinRespContext != nil {
+			return toJson(conf.GetJoinRespContext(ctx, userId, e.(E)))
+		}
+		return toJson(conf.GetJoinResp(userId, e.(E)))
+	}
+	srv.typedChangeResp = func(ctx context.Context, userId string, e Entity) (Json, error) {
+		if conf.GetEntityChangeRespContext != nil {
+			return toJson(conf.GetEntityChangeRespContext(ctx, userId, e.(E)))
+		}
+		return toJson(conf.GetEntityChangeResp(userId, e.(E)))
+	}
+	return srv
+}
+
+// marshalsToObject reports whether values of t marshal to json objects, or may do as with interfaces
+// and types marshalling themselves.
+func marshalsToObject(t reflect.Type) bool {
+	marshaler := reflect.TypeFor[js.Marshaler]()
+	if t.Implements(marshaler) || reflect.PointerTo(t).Implements(marshaler) {
+		return true
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Interface:
+		return true
+	}
+	return false
+}
+
+// toJson converts obj to the Json it marshals to, null gives an empty Json. Values which fail to
+// marshal, or don't marshal to a json object, give an internal error.
+func toJson(obj interface{}) (Json, error) {
+	data, err := js.Marshal(obj)
+	if err != nil {
+		return nil, NewError(CodeInternal, `response could not be marshalled: ` + err.Error())
+	}
+	json := Json{}
+	if err = js.Unmarshal(data, &json); err != nil {
+		return nil, NewError(CodeInternal, `response must marshal to a json object`)
+	}
+	if json == nil {
+		//obj marshalled to null
+		json = Json{}
+	}
+	return json, nil
+}
@@ -0,0 +1,154 @@
+package oak
+
+import(
+	`context`
+	`testing`
+	`net/http`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+type testJoinResp struct{
+	Creator string `json:"creator"`
+	Users []string `json:"users"`
+}
+
+type testChangeResp struct{
+	UserCount int `json:"userCount"`
+}
+
+func Test_typed_server(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{Creator: `test_creator_user_id`}})
+	var actedOn *storeTestEntity
+	tss = &testSessionStore{}
+	tr = mux.NewRouter()
+	NewTypedServer(TypedConfig[*storeTestEntity, testJoinResp, testChangeResp]{
+		SessionStore: tss,
+		SessionName: `test_session`,
+		Entity: &storeTestEntity{},
+		EntityStoreFactory: func(r *http.Request)EntityStore{return store},
+		GetJoinResp: func(userId string, e *storeTestEntity) testJoinResp {
+			return testJoinResp{Creator: e.Creator, Users: e.Users}
+		},
+		GetEntityChangeResp: func(userId string, e *storeTestEntity) testChangeResp {
+			return testChangeResp{UserCount: len(e.Users)}
+		},
+		PerformAct: func(json Json, userId string, e *storeTestEntity) error {
+			actedOn = e
+			e.Version++
+			return nil
+		},
+	}).Route(tr)
+	entityId, _, _ := store.Create()
+
+	w := serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`)
+	resp := Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, Json{`creator`: `test_creator_user_id`, `users`: []interface{}{`test_user_1`}, _VERSION: 1.0}, resp, `join response should be the marshalled struct with the version`)
+
+	w = serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"`+entityId+`","`+_VERSION+`":0}`)
+	resp = Json{}
+	readTestJson(w, &resp)
+	assert.Equal(t, Json{`userCount`: 1.0, _VERSION: 1.0}, resp, `change response should be the marshalled struct with the version`)
+
+	r, _ := http.NewRequest(`POST`, _ACT, nil)
+	tss.Get(r, ``)
+	tss.session.Values[_USER_ID] = `test_user_1`
+	tss.session.Values[_ENTITY_ID] = entityId
+	w = serveTestRequest(`POST`, _ACT, `{}`)
+	assert.Equal(t, 200, w.Code, `act should succeed`)
+	assert.Equal(t, 2, actedOn.Version, `perform act should have received the concrete entity`)
+}
+
+func Test_typed_server_with_context_callbacks(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	tss = &testSessionStore{}
+	tr = mux.NewRouter()
+	NewTypedServer(TypedConfig[*storeTestEntity, testJoinResp, testChangeResp]{
+		SessionStore: tss,
+		SessionName: `test_session`,
+		Entity: &storeTestEntity{},
+		EntityStoreFactory: func(r *http.Request)EntityStore{return store},
+		GetJoinRespContext: func(ctx context.Context, userId string, e *storeTestEntity) testJoinResp {
+			return testJoinResp{Creator: ctx.Value(testContextKey{}).(string)}
+		},
+		GetEntityChangeRespContext: func(ctx context.Context, userId string, e *storeTestEntity) testChangeResp {
+			return testChangeResp{UserCount: len(ctx.Value(testContextKey{}).(string))}
+		},
+		PerformActContext: func(ctx context.Context, json Json, userId string, e *storeTestEntity) error {
+			e.Version++
+			e.Users = append(e.Users, ctx.Value(testContextKey{}).(string))
+			return nil
+		},
+	}, Wrap(func(op Op, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), testContextKey{}, `test_value`)))
+		})
+	})).Route(tr)
+	entityId, _, _ := store.Create()
+
+	resp := Json{}
+	readTestJson(serveTestRequest(`POST`, _JOIN, `{"`+_ID+`":"`+entityId+`"}`), &resp)
+	assert.Equal(t, `test_value`, resp[`creator`], `join response should be given the request's context`)
+
+	resp = Json{}
+	readTestJson(serveTestRequest(`POST`, _ACT, `{}`), &resp)
+	assert.Equal(t, 10.0, resp[`userCount`], `change response should be given the request's context`)
+	entity, _ := store.Read(entityId)
+	assert.Equal(t, []string{`test_user_1`, `test_value`}, entity.(*storeTestEntity).Users, `perform act should be given the request's context`)
+}
+
+func Test_typed_server_with_unmarshalable_resp(t *testing.T) {
+	store := NewMemoryEntityStore(func()Entity{return &storeTestEntity{}})
+	tss = &testSessionStore{}
+	tr = mux.NewRouter()
+	NewTypedServer(TypedConfig[*storeTestEntity, testJoinResp, testUnmarshalableResp]{
+		SessionStore: tss,
+		SessionName: `test_session`,
+		Entity: &storeTestEntity{},
+		EntityStoreFactory: func(r *http.Request)EntityStore{return store},
+		GetJoinResp: func(userId string, e *storeTestEntity) testJoinResp {
+			return testJoinResp{}
+		},
+		GetEntityChangeResp: func(userId string, e *storeTestEntity) testUnmarshalableResp {
+			return testUnmarshalableResp{Changes: make(chan int)}
+		},
+	}).Route(tr)
+	entityId, _, _ := store.Create()
+
+	w := serveTestRequest(`POST`, _POLL, `{"`+_ID+`":"`+entityId+`","`+_VERSION+`":-1}`)
+	assertTestError(t, w, CodeInternal, `response could not be marshalled: json: unsupported type: chan int`)
+}
+
+func Test_typed_server_with_non_object_resp(t *testing.T) {
+	assert.Panics(t, func() {
+		NewTypedServer(TypedConfig[*storeTestEntity, testJoinResp, []int]{Entity: &storeTestEntity{}})
+	}, `responses which don't marshal to objects should be rejected`)
+	assert.Panics(t, func() {
+		NewTypedServer(TypedConfig[*storeTestEntity, *string, testChangeResp]{Entity: &storeTestEntity{}})
+	}, `pointers to values which don't marshal to objects should be rejected`)
+	assert.NotPanics(t, func() {
+		NewTypedServer(TypedConfig[*storeTestEntity, *testJoinResp, map[string]int]{Entity: &storeTestEntity{}})
+	}, `pointers to structs and maps should be accepted`)
+}
+
+func Test_to_json(t *testing.T) {
+	json, err := toJson(testChangeResp{UserCount: 2})
+	assert.Equal(t, Json{`userCount`: 2.0}, json, `structs should become json objects`)
+	assert.Nil(t, err, `structs should not error`)
+	json, err = toJson(nil)
+	assert.Equal(t, Json{}, json, `null should become an empty json object`)
+	assert.Nil(t, err, `null should not error`)
+	_, err = toJson([]int{1})
+	assert.Equal(t, CodeInternal, AsError(err).Code, `non objects should error`)
+	_, err = toJson(func(){})
+	assert.Equal(t, CodeInternal, AsError(err).Code, `unmarshalable values should error`)
+}
+
+/**
+ * helpers
+ */
+
+type testUnmarshalableResp struct{
+	Changes chan int `json:"changes"`
+}
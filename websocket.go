@@ -0,0 +1,255 @@
+package oak
+
+import(
+	`io`
+	`net`
+	`sync`
+	`bufio`
+	`errors`
+	`strings`
+	`net/url`
+	`net/http`
+	`crypto/sha1`
+	`encoding/binary`
+	`encoding/base64`
+)
+
+// a minimal RFC 6455 server side implementation, only what oak needs to exchange
+// text messages with browsers, no extensions or subprotocols are negotiated.
+
+const (
+	_WS_GUID			= `258EAFA5-E914-47DA-95CA-C5AB0DC85B11`
+	_WS_MAX_MESSAGE_SIZE	= 1 << 20
+
+	_WS_OP_CONTINUATION	= 0x0
+	_WS_OP_TEXT			= 0x1
+	_WS_OP_BINARY		= 0x2
+	_WS_OP_CLOSE		= 0x8
+	_WS_OP_PING			= 0x9
+	_WS_OP_PONG			= 0xA
+
+	_WS_CLOSE_NORMAL			= 1000
+	_WS_CLOSE_PROTOCOL_ERROR	= 1002
+	_WS_CLOSE_TOO_BIG			= 1009
+)
+
+var (
+	errWsClosed		= errors.New(`websocket closed`)
+	errWsProtocol	= errors.New(`websocket protocol error`)
+	errWsTooBig		= errors.New(`websocket message too big`)
+)
+
+type wsConn struct{
+	conn net.Conn
+	reader *bufio.Reader
+	writeMtx sync.Mutex
+	writer *bufio.Writer
+}
+
+// upgradeWebsocket completes the handshake, browsers always send the Origin of the page opening the
+// socket which must be the handshake's Host or in allowedOrigins, so other sites can't use the user's cookies.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request, allowedOrigins map[string]bool) (*wsConn, error) {
+	if r.Method != `GET` {
+		return nil, NewError(CodeBadRequest, `websocket handshake must be a GET request`)
+	}
+	if !headerContainsToken(r.Header, `Connection`, `upgrade`) || !headerContainsToken(r.Header, `Upgrade`, `websocket`) {
+		return nil, NewError(CodeBadRequest, `websocket handshake must request a websocket upgrade`)
+	}
+	if r.Header.Get(`Sec-Websocket-Version`) != `13` {
+		return nil, NewError(CodeBadRequest, `websocket handshake must use version 13`)
+	}
+	key := r.Header.Get(`Sec-Websocket-Key`)
+	if key == `` {
+		return nil, NewError(CodeBadRequest, `websocket handshake must include a key`)
+	}
+	if !originAllowed(r, allowedOrigins) {
+		return nil, NewError(CodeForbidden, `websocket origin not allowed`)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New(`websockets are not supported by the response writer`)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{
+		conn: conn,
+		reader: rw.Reader,
+		writer: rw.Writer,
+	}, nil
+}
+
+// originAllowed accepts handshakes without an Origin, which only non browser clients make.
+func originAllowed(r *http.Request, allowedOrigins map[string]bool) bool {
+	origin := r.Header.Get(`Origin`)
+	if origin == `` || allowedOrigins[`*`] || allowedOrigins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != `` && strings.EqualFold(u.Host, r.Host)
+}
+
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + _WS_GUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, `,`) {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next complete data message, control frames are handled internally,
+// errWsClosed is returned once the client has closed the connection.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			switch err {
+			case errWsTooBig:
+				c.writeClose(_WS_CLOSE_TOO_BIG)
+			case errWsProtocol:
+				c.writeClose(_WS_CLOSE_PROTOCOL_ERROR)
+			}
+			return nil, err
+		}
+		switch opcode {
+		case _WS_OP_PING:
+			if err = c.writeFrame(_WS_OP_PONG, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case _WS_OP_PONG:
+			continue
+		case _WS_OP_CLOSE:
+			c.writeClose(_WS_CLOSE_NORMAL)
+			return nil, errWsClosed
+		case _WS_OP_TEXT, _WS_OP_BINARY:
+			if started {
+				c.writeClose(_WS_CLOSE_PROTOCOL_ERROR)
+				return nil, errWsProtocol
+			}
+			started = true
+		case _WS_OP_CONTINUATION:
+			if !started {
+				c.writeClose(_WS_CLOSE_PROTOCOL_ERROR)
+				return nil, errWsProtocol
+			}
+		default:
+			c.writeClose(_WS_CLOSE_PROTOCOL_ERROR)
+			return nil, errWsProtocol
+		}
+		if len(message) + len(payload) > _WS_MAX_MESSAGE_SIZE {
+			c.writeClose(_WS_CLOSE_TOO_BIG)
+			return nil, errWsTooBig
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	fin = header[0] & 0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0] & 0x70 != 0 || header[1] & 0x80 == 0 {
+		//no extensions are negotiated and clients must always mask their frames
+		err = errWsProtocol
+		return
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= _WS_OP_CLOSE && (length > 125 || !fin) {
+		err = errWsProtocol
+		return
+	}
+	if length > _WS_MAX_MESSAGE_SIZE {
+		err = errWsTooBig
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i % 4]
+	}
+	return
+}
+
+func (c *wsConn) writeMessage(message []byte) error {
+	return c.writeFrame(_WS_OP_TEXT, message)
+}
+
+func (c *wsConn) writeClose(code uint16) error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	return c.writeFrame(_WS_OP_CLOSE, payload[:])
+}
+
+// writeFrame is safe to call concurrently, replies to control frames are written while messages are pushed.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	if _, err := c.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(payload); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,77 @@
+package oak
+
+import(
+	`sync`
+	`context`
+)
+
+// Start runs the background workers of the options which need them, the kick scheduler of
+// ScheduleKicks and the idle sweeper of Presence, until Stop is called. Workers already running are left be.
+func (srv *Server) Start() {
+	if srv.kicks != nil {
+		srv.kicks.worker.start(srv.runKicks)
+	}
+	if srv.presence != nil {
+		srv.presence.worker.start(srv.runPresence)
+	}
+}
+
+// Stop stops the background workers, waiting for the work in progress to finish. If ctx is done
+// first the work is cancelled and ctx's error returned. Scheduled work is kept for the next Start.
+func (srv *Server) Stop(ctx context.Context) error {
+	var err error
+	if srv.kicks != nil {
+		err = srv.kicks.worker.stop(ctx)
+	}
+	if srv.presence != nil {
+		if presenceErr := srv.presence.worker.stop(ctx); err == nil {
+			err = presenceErr
+		}
+	}
+	return err
+}
+
+// worker runs a single background goroutine which can be started and stopped repeatedly.
+type worker struct{
+	mtx sync.Mutex
+	cancel context.CancelFunc
+	stopping chan struct{}
+	done chan struct{}
+}
+
+// start runs run in a new goroutine unless one is running, run must return once stopping is closed
+// and should give up on its work once ctx is done.
+func (w *worker) start(run func(ctx context.Context, stopping <-chan struct{})) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.done != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopping, done := make(chan struct{}), make(chan struct{})
+	w.cancel, w.stopping, w.done = cancel, stopping, done
+	go func() {
+		defer close(done)
+		run(ctx, stopping)
+	}()
+}
+
+func (w *worker) stop(ctx context.Context) error {
+	w.mtx.Lock()
+	cancel, stopping, done := w.cancel, w.stopping, w.done
+	w.cancel, w.stopping, w.done = nil, nil, nil
+	w.mtx.Unlock()
+	if done == nil {
+		return nil
+	}
+	defer cancel()
+	close(stopping)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		<-done
+		return ctx.Err()
+	}
+}